@@ -2,6 +2,7 @@ package buffer
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/chronos-tachyon/enumhelper"
 )
@@ -19,18 +20,44 @@ const (
 	// ErrBadDistance is returned when Window.LookupByte is called with a
 	// distance that isn't contained within the Window.
 	ErrBadDistance
+
+	// ErrCorrupt is returned when UnmarshalBinary or GobDecode is given
+	// data which is truncated or otherwise malformed, or when
+	// Window.Restore is given a WindowSnapshot not returned by Snapshot.
+	ErrCorrupt
+
+	// ErrBadNumBits is returned when a Window is initialized with a size
+	// which is out of range.  It is wrapped by NumBitsError.
+	ErrBadNumBits
+
+	// ErrBadOptions is returned when LZ77Options cannot be used to
+	// initialize a LZ77.  It is wrapped by LZ77OptionsError.
+	ErrBadOptions
+
+	// ErrInvariant is returned by LZ77.CheckInvariants when the LZ77's
+	// internal state is inconsistent.  It is also wrapped by the panic
+	// raised when a Window is mutated during iteration by Window.All.
+	ErrInvariant
 )
 
 var errorData = [...]enumhelper.EnumData{
 	{GoName: "ErrEmpty"},
 	{GoName: "ErrFull"},
 	{GoName: "ErrBadDistance"},
+	{GoName: "ErrCorrupt"},
+	{GoName: "ErrBadNumBits"},
+	{GoName: "ErrBadOptions"},
+	{GoName: "ErrInvariant"},
 }
 
 var errorText = [...]string{
 	"buffer is empty",
 	"buffer is full",
 	"given distance lies outside of sliding window",
+	"binary data is corrupt or malformed",
+	"number of bits is out of range",
+	"invalid options",
+	"internal invariant violated",
 }
 
 // GoString returns the name of the Go constant.
@@ -45,3 +72,41 @@ func (err Error) Error() string {
 
 var _ fmt.GoStringer = Error(0)
 var _ error = Error(0)
+
+// NumBitsError is returned when a Window is initialized with a number of bits
+// which exceeds the maximum supported value, or when UnmarshalBinaryLimit
+// decodes one which exceeds the caller's limit.
+type NumBitsError struct {
+	NumBits uint
+	Max     uint
+}
+
+// Error returns the error message for this error.
+func (err NumBitsError) Error() string {
+	return fmt.Sprintf("%v: numBits %d must not exceed %d", ErrBadNumBits, err.NumBits, err.Max)
+}
+
+// Unwrap returns ErrBadNumBits.
+func (err NumBitsError) Unwrap() error {
+	return ErrBadNumBits
+}
+
+var _ error = NumBitsError{}
+
+// LZ77OptionsError is returned by LZ77Options.Validate.  It lists every
+// problem found with the options.
+type LZ77OptionsError struct {
+	Problems []string
+}
+
+// Error returns the error message for this error.
+func (err LZ77OptionsError) Error() string {
+	return fmt.Sprintf("%v: %s", ErrBadOptions, strings.Join(err.Problems, "; "))
+}
+
+// Unwrap returns ErrBadOptions.
+func (err LZ77OptionsError) Unwrap() error {
+	return ErrBadOptions
+}
+
+var _ error = LZ77OptionsError{}
@@ -1,7 +1,12 @@
 package buffer
 
 import (
+	"bufio"
+	"encoding"
+	"encoding/binary"
 	"fmt"
+	"hash/crc32"
+	"io"
 	"math/bits"
 
 	"github.com/chronos-tachyon/assert"
@@ -12,30 +17,69 @@ import (
 const hashLen = 4
 const hashLenSubOne = hashLen - 1
 
+// lz77MaxWindowNumBits is the largest WindowNumBits which Init accepts.  It is
+// 30 on 32-bit platforms, where storage must remain indexable by int.
+const lz77MaxWindowNumBits = 30 + 10*(bits.UintSize/64)
+
+// lz77MaxBufferNumBits is the largest BufferNumBits which Init accepts.
+const lz77MaxBufferNumBits = lz77MaxWindowNumBits
+
 // LZ77 implements a combination Window/Buffer that uses the Window to
 // remember bytes that were recently removed from the Buffer, and that hashes
 // all data that enters the Window so that LZ77-style prefix matching can be
 // made efficient.
+//
+// Internally, the Window and the Buffer share a circular buffer of exactly
+// WindowSize + BufferSize bytes.  Methods which return a single slice into the
+// LZ77's contents, such as WindowBytesView, must therefore allocate a copy
+// when the requested bytes wrap around the end of the circular buffer.
 type LZ77 struct {
 	slice         []byte
-	htLastByHash  []uint32
-	htPrevByIndex []uint32
-	h             uint32
-	i             uint32
-	j             uint32
-	bsize         uint32
-	wsize         uint32
+	htLastByHash  lz77Table
+	htPrevByIndex lz77Table
+	stats         *LZ77Stats
+	sumTable      *crc32.Table
+	score         func(distance, length uint) int
+	minScore      int
+	sum           uint32
+	org           uint64
+	h             uint64
+	i             uint64
+	j             uint64
+	bsize         uint64
+	wsize         uint64
 	hashMask      uint32
-	minLen        uint32
-	maxLen        uint32
-	maxDist       uint32
+	minLen        uint64
+	maxLen        uint64
+	maxDist       uint64
+	maxChain      uint64
+	minDist       uint64
+	tailLen       uint64
+	repBias       uint64
+	niceLen       uint64
+	stride        uint64
+	litRun        uint64
+	lastDist      uint64
 	bbits         byte
 	wbits         byte
 	hbits         byte
+	backExt       bool
+	sumKind       byte
+	noMatch       bool
+	notFinal      bool
+	selfCheck     bool
 }
 
 // LZ77Options holds options for initializing an instance of LZ77.
 type LZ77Options struct {
+	// BufferNumBits and WindowNumBits give the sizes of the Buffer and
+	// the Window in bits.  BufferNumBits must be at least 2, and neither
+	// may exceed 40 (or 30 on 32-bit platforms).  An LZ77 with hashing
+	// enabled uses 5 bytes of memory per byte of Window and Buffer, plus
+	// 4 bytes per hash bucket.  Once WindowSize + BufferSize exceeds
+	// 1 GiB, positions no longer fit in 32 bits and this rises to 9 bytes
+	// per byte plus 8 bytes per bucket, so a 1 TiB Window needs 9 TiB of
+	// memory.
 	BufferNumBits       uint
 	WindowNumBits       uint
 	HashNumBits         uint
@@ -45,6 +89,153 @@ type LZ77Options struct {
 	HasMinMatchLength   bool
 	HasMaxMatchLength   bool
 	HasMaxMatchDistance bool
+
+	// MaxChainLength, if HasMaxChainLength is true and it is non-zero,
+	// limits the number of candidate positions which Advance examines
+	// when searching for a match.  Candidates are examined newest first,
+	// and the best match among them is returned.  The default is to
+	// examine every candidate.
+	MaxChainLength    uint
+	HasMaxChainLength bool
+
+	// MinMatchDistance, if HasMinMatchDistance is true, is the smallest
+	// distance which Advance may report for a match.  Closer candidates
+	// are ignored in favor of farther ones or of literals.  It must not
+	// exceed the effective MaxMatchDistance.  The default is 1.
+	MinMatchDistance    uint
+	HasMinMatchDistance bool
+
+	// TailLiteralBytes, if non-zero, forbids Advance from reporting any
+	// match which ends within that many bytes of the end of the data in
+	// the Buffer, as required by formats such as LZ4 which mandate that
+	// each block end with literals.  It is capped at the buffer size.
+	TailLiteralBytes uint
+
+	// ScoreMatch, if non-nil, replaces the "longest match wins" rule used
+	// by Advance to choose among candidates.  For each candidate, it is
+	// called with the distance and the longest length available at that
+	// distance, and the candidate with the highest score wins; ties go to
+	// the closest candidate.  Because a farther candidate may always score
+	// higher, the search does not stop early upon finding a match of
+	// maximum length, so setting MaxChainLength is advisable.  LZ77s with
+	// a ScoreMatch function cannot be marshaled.
+	ScoreMatch func(distance, length uint) int
+
+	// MinMatchScore, if HasMinMatchScore is true, causes Advance to
+	// reject the best match in favor of a literal if its score is lower
+	// than this.  It is ignored if ScoreMatch is nil.
+	MinMatchScore    int
+	HasMinMatchScore bool
+
+	// RepeatOffsetBias, if non-zero, lets a match at the same distance as
+	// the previous match win over a longer match found by the search, so
+	// long as it is less than RepeatOffsetBias bytes shorter.  Thus a bias
+	// of 1 makes the repeat offset win ties.  It is capped at the buffer
+	// size, and it is ignored if ScoreMatch is non-nil; a ScoreMatch
+	// function can consult LastMatchDistance instead.
+	RepeatOffsetBias uint
+
+	// NiceMatchLength, if non-zero, makes Advance stop searching for a
+	// match as soon as it finds one of at least this length, instead of
+	// only upon finding one of MaxMatchLength.  This trades a little
+	// compression for speed on repetitive data, much as the "nice length"
+	// of flate does.  It is capped at MaxMatchLength, which is also the
+	// default, and it is ignored if ScoreMatch is non-nil.
+	NiceMatchLength uint
+
+	// HashInsertStride, if greater than 1, makes the LZ77 hash only every
+	// HashInsertStride-th position which enters the Window while in the
+	// midst of a run of at least HashInsertStride literals, as LZ4-style
+	// encoders do.  Dense hashing resumes as soon as a match is found.
+	// This speeds up incompressible regions at a small cost in compression.
+	// The default is 1, which hashes every position.
+	HashInsertStride uint
+
+	// BackwardMatchExtension, if true, allows Advance to extend a match
+	// backward over the run of literals emitted by the immediately
+	// preceding calls to Advance.  See Advance for details.
+	BackwardMatchExtension bool
+}
+
+// LZ77Stats holds token statistics for an LZ77, as returned by LZ77.Stats.
+// The histograms are bucketed by bit length: bucket k counts the matches
+// whose length (or distance) L satisfies 2**(k-1) <= L < 2**k.
+type LZ77Stats struct {
+	// Literals is the number of literal bytes returned by Advance and
+	// Skip.  Literals which were later absorbed into a match by
+	// BackwardMatchExtension are not counted.
+	Literals uint64
+
+	// Matches is the number of matches returned by Advance.
+	Matches uint64
+
+	// MatchBytes is the sum of the lengths of all matches returned by
+	// Advance.
+	MatchBytes uint64
+
+	// LengthHistogram counts matches by the bit length of their length.
+	// Like DistanceHistogram, it has a bucket for every possible bit
+	// length, as lengths may exceed 2**31 in a large Buffer.
+	LengthHistogram [65]uint64
+
+	// DistanceHistogram counts matches by the bit length of their
+	// distance.  It has a bucket for every possible bit length, as
+	// distances may exceed 2**31 in a large Window.
+	DistanceHistogram [65]uint64
+}
+
+// LZ77Token describes a single step taken by LZ77.AdvanceToken.
+type LZ77Token struct {
+	// Bytes holds the bytes moved from the Buffer to the Window, as
+	// returned by Advance.
+	Bytes []byte
+
+	// Distance and Length describe the match, if IsMatch is true.
+	Distance uint
+	Length   uint
+	IsMatch  bool
+
+	// IsRepeatOffset is true iff the token is a match whose Distance is
+	// equal to that of the previous match.
+	IsRepeatOffset bool
+}
+
+// LZ77Candidate describes a single candidate match, as returned by
+// LZ77.MatchCandidates.
+type LZ77Candidate struct {
+	// Distance is the distance from the current position back to the
+	// candidate.
+	Distance uint
+
+	// Length is the number of bytes which match at Distance, up to the
+	// longest match which Advance could currently return.  It is 0 if
+	// TooOld is true.
+	Length uint
+
+	// TooClose is true iff the candidate is closer than
+	// MinMatchDistance, so Advance would skip it.
+	TooClose bool
+
+	// TooOld is true iff the candidate precedes the start of the Window,
+	// so Advance would stop searching upon reaching it.
+	TooOld bool
+}
+
+// LZ77DumpOptions holds options for LZ77.DumpTo.
+type LZ77DumpOptions struct {
+	// IncludeBytes, if true, causes the contents of the Window and the
+	// Buffer to be dumped.
+	IncludeBytes bool
+
+	// MaxBytesPerRegion, if non-zero, limits the number of bytes dumped
+	// from each of the Window and the Buffer.  Only the bytes nearest to
+	// the boundary between them are dumped, and the rest are elided.
+	MaxBytesPerRegion uint
+
+	// FullBuckets, if true, causes every position in each non-empty hash
+	// bucket to be listed, newest first.  Otherwise, each non-empty bucket
+	// is summarized by its count and its newest and oldest positions.
+	FullBuckets bool
 }
 
 // NewLZ77 is a convenience function that allocates a LZ77 and calls Init on it.
@@ -54,6 +245,81 @@ func NewLZ77(o LZ77Options) *LZ77 {
 	return lz77
 }
 
+// NewLZ77E is like NewLZ77, but returns an error instead of panicking if the
+// options are invalid.
+func NewLZ77E(o LZ77Options) (*LZ77, error) {
+	lz77 := new(LZ77)
+	if err := lz77.InitE(o); err != nil {
+		return nil, err
+	}
+	return lz77, nil
+}
+
+// LZ77DeflateOptions holds the options used by NewLZ77Deflate.  They match the
+// limits of DEFLATE (RFC 1951): a 32 KiB window and matches of up to 258
+// bytes.  DEFLATE permits 3-byte matches, but hashing requires at least 4, so
+// MinMatchLength is 4.  Copy and modify this value to customize the preset.
+var LZ77DeflateOptions = LZ77Options{
+	BufferNumBits:       9,
+	WindowNumBits:       15,
+	HashNumBits:         15,
+	MinMatchLength:      4,
+	MaxMatchLength:      258,
+	MaxMatchDistance:    32768,
+	HasMinMatchLength:   true,
+	HasMaxMatchLength:   true,
+	HasMaxMatchDistance: true,
+}
+
+// LZ77SnappyOptions holds the options used by NewLZ77Snappy.  They match the
+// limits of Snappy: a 64 KiB block, offsets of at most 65535 bytes, and
+// copies of 4 to 64 bytes.  Copy and modify this value to customize the
+// preset.
+var LZ77SnappyOptions = LZ77Options{
+	BufferNumBits:       8,
+	WindowNumBits:       16,
+	HashNumBits:         14,
+	MinMatchLength:      4,
+	MaxMatchLength:      64,
+	MaxMatchDistance:    65535,
+	HasMinMatchLength:   true,
+	HasMaxMatchLength:   true,
+	HasMaxMatchDistance: true,
+}
+
+// LZ77LZ4Options holds the options used by NewLZ77LZ4.  They match the limits
+// of the LZ4 block format: matches of at least 4 bytes, offsets of at most
+// 65535 bytes, and no match starting within the last 12 bytes of a block.
+// The last rule is enforced conservatively with TailLiteralBytes, which also
+// satisfies the rule that each block end with 5 literals, so long as the
+// Buffer is only drained to empty at the end of each block.  Copy and modify
+// this value to customize the preset.
+var LZ77LZ4Options = LZ77Options{
+	BufferNumBits:       16,
+	WindowNumBits:       16,
+	HashNumBits:         16,
+	MinMatchLength:      4,
+	MaxMatchDistance:    65535,
+	HasMinMatchLength:   true,
+	HasMaxMatchDistance: true,
+	TailLiteralBytes:    12,
+}
+
+// NewLZ77Deflate returns a LZ77 configured with LZ77DeflateOptions.
+func NewLZ77Deflate() *LZ77 {
+	return NewLZ77(LZ77DeflateOptions)
+}
+
+// NewLZ77Snappy returns a LZ77 configured with LZ77SnappyOptions.
+func NewLZ77Snappy() *LZ77 {
+	return NewLZ77(LZ77SnappyOptions)
+}
+
+// NewLZ77LZ4 returns a LZ77 configured with LZ77LZ4Options.
+func NewLZ77LZ4() *LZ77 {
+	return NewLZ77(LZ77LZ4Options)
+}
+
 // Options returns a LZ77Options struct which can be used to construct a new
 // LZ77 with the same settings.
 func (lz77 LZ77) Options() LZ77Options {
@@ -67,6 +333,26 @@ func (lz77 LZ77) Options() LZ77Options {
 		HasMinMatchLength:   true,
 		HasMaxMatchLength:   true,
 		HasMaxMatchDistance: true,
+
+		MaxChainLength:    uint(lz77.maxChain),
+		HasMaxChainLength: true,
+
+		MinMatchDistance:    uint(lz77.minDist),
+		HasMinMatchDistance: true,
+
+		TailLiteralBytes: uint(lz77.tailLen),
+
+		ScoreMatch:       lz77.score,
+		MinMatchScore:    lz77.minScore,
+		HasMinMatchScore: true,
+
+		RepeatOffsetBias: uint(lz77.repBias),
+
+		NiceMatchLength: uint(lz77.niceLen),
+
+		HashInsertStride: uint(lz77.stride),
+
+		BackwardMatchExtension: lz77.backExt,
 	}
 }
 
@@ -127,66 +413,91 @@ func (lz77 LZ77) IsFull() bool {
 
 // Init initializes a LZ77.
 func (lz77 *LZ77) Init(o LZ77Options) {
-	bbits := o.BufferNumBits
-	wbits := o.WindowNumBits
-	hbits := o.HashNumBits
-
-	assert.Assertf(bbits >= 2, "BufferNumBits %d must be at least 2", bbits)
-	assert.Assertf(bbits <= 30, "BufferNumBits %d must not exceed 30", bbits)
-	assert.Assertf(wbits <= 30, "WindowNumBits %d must not exceed 30", wbits)
-	assert.Assertf(hbits <= 32, "HashNumBits %d must not exceed 32", hbits)
-
-	bsize := (uint32(1) << bbits)
-	wsize := (uint32(1) << wbits)
-
-	maxLen := bsize
-	if o.HasMaxMatchLength {
-		if o.MaxMatchLength > uint(bsize) {
-			o.MaxMatchLength = uint(bsize)
-		}
-		maxLen = uint32(o.MaxMatchLength)
-	}
-
-	minLen := uint32(hashLen)
-	if o.HasMinMatchLength {
-		if o.MinMatchLength > uint(bsize) {
-			assert.Raisef("MinMatchLength %d > buffer capacity %d", o.MinMatchLength, bsize)
-		}
-		minLen = uint32(o.MinMatchLength)
-	}
+	lz77.init(o, false)
+}
 
-	maxDist := wsize
-	if o.HasMaxMatchDistance {
-		if o.MaxMatchDistance > uint(wsize) {
-			o.MaxMatchDistance = uint(wsize)
-		}
-		maxDist = uint32(o.MaxMatchDistance)
+// InitE is like Init, but returns an error instead of panicking if the options
+// are invalid.  Use this when the options come from user configuration or
+// from untrusted input.  The error is a LZ77OptionsError listing every
+// problem found, as with LZ77Options.Validate.  On error, the LZ77 is left
+// unchanged.
+func (lz77 *LZ77) InitE(o LZ77Options) error {
+	if err := o.Validate(); err != nil {
+		return err
 	}
+	lz77.Init(o)
+	return nil
+}
 
-	if maxLen == 0 || maxDist == 0 {
-		minLen = 0
-		maxLen = 0
-		maxDist = 0
-		hbits = 0
-	}
+// Reset empties the LZ77's Window and Buffer and re-enables matching and the
+// final flag, as Init does, without changing its options.  Unlike Init, no
+// memory is allocated: only the hash table heads are zeroed, as the remaining
+// storage is always written before it is read.  Also unlike Init, Reset keeps
+// the token statistics, the running checksum, and self-checking enabled if
+// they were, and it does not reset the statistics or the checksum; call
+// ResetStats and ResetChecksum to do so.
+func (lz77 *LZ77) Reset() {
+	wsize := lz77.wsize
+	lz77.org = 0
+	lz77.h = wsize
+	lz77.i = wsize
+	lz77.j = wsize
+	lz77.litRun = 0
+	lz77.lastDist = 0
+	lz77.noMatch = false
+	lz77.notFinal = false
+	lz77.htLastByHash.zero()
+}
 
-	if minLen == 0 && maxLen != 0 {
-		minLen = 1
-	}
+// ResetWithOptions is like Init, but reuses the LZ77's existing storage
+// whenever the new options require storage of the same size.  This makes it
+// suitable for LZ77 instances which are kept in a pool.
+func (lz77 *LZ77) ResetWithOptions(o LZ77Options) {
+	lz77.init(o, true)
+}
 
-	if minLen < hashLen {
-		hbits = 0
+func (lz77 *LZ77) init(o LZ77Options, reuse bool) {
+	o, problems := o.normalize()
+	if len(problems) != 0 {
+		assert.Raise(problems[0])
 	}
 
-	assert.Assertf(minLen <= maxLen, "MinMatchLength %d > MaxMatchLength %d", minLen, maxLen)
+	bbits := o.BufferNumBits
+	wbits := o.WindowNumBits
+	hbits := o.HashNumBits
+	bsize := (uint64(1) << bbits)
+	wsize := (uint64(1) << wbits)
+	minLen := uint64(o.MinMatchLength)
+	maxLen := uint64(o.MaxMatchLength)
+	maxDist := uint64(o.MaxMatchDistance)
+	maxChain := uint64(o.MaxChainLength)
+	minDist := uint64(o.MinMatchDistance)
+	tailLen := uint64(o.TailLiteralBytes)
+	repBias := uint64(o.RepeatOffsetBias)
+	niceLen := uint64(o.NiceMatchLength)
+	stride := uint64(o.HashInsertStride)
 
 	hashMask := ^uint32(0)
 	if hbits < 32 {
 		hashMask = (uint32(1) << hbits) - 1
 	}
 
+	var oldSlice []byte
+	var oldLast, oldPrev lz77Table
+	if reuse {
+		oldSlice = lz77.slice
+		oldLast = lz77.htLastByHash
+		oldPrev = lz77.htPrevByIndex
+	}
+
+	n := uint(wsize) + uint(bsize)
+	slice := oldSlice
+	if uint(len(slice)) != n {
+		slice = make([]byte, n)
+	}
+
 	*lz77 = LZ77{
-		slice:    make([]byte, wsize+bsize*2),
+		slice:    slice,
 		h:        wsize,
 		i:        wsize,
 		j:        wsize,
@@ -196,35 +507,171 @@ func (lz77 *LZ77) Init(o LZ77Options) {
 		minLen:   minLen,
 		maxLen:   maxLen,
 		maxDist:  maxDist,
+		maxChain: maxChain,
+		minDist:  minDist,
+		tailLen:  tailLen,
+		repBias:  repBias,
+		niceLen:  niceLen,
+		stride:   stride,
+		score:    o.ScoreMatch,
+		minScore: o.MinMatchScore,
 		bbits:    byte(bbits),
 		wbits:    byte(wbits),
 		hbits:    byte(hbits),
+		backExt:  o.BackwardMatchExtension,
 	}
 
 	if hbits != 0 {
-		lz77.htLastByHash = make([]uint32, uint(1)<<hbits)
-		lz77.htPrevByIndex = make([]uint32, uint(len(lz77.slice)))
+		wide := lz77WideTables(uint64(n))
+		if oldLast.len() == (uint64(1)<<hbits) && oldLast.isWide() == wide {
+			oldLast.zero()
+		} else {
+			oldLast = makeLZ77Table(uint64(1)<<hbits, wide)
+		}
+		if oldPrev.len() != uint64(n) || oldPrev.isWide() != wide {
+			oldPrev = makeLZ77Table(uint64(n), wide)
+		}
+		lz77.htLastByHash = oldLast
+		lz77.htPrevByIndex = oldPrev
+	}
+}
+
+// Clone returns an independent deep copy of the LZ77, including its Window,
+// its Buffer, its hash chains, and its token statistics.  The cost is
+// proportional to the total memory used by the LZ77, which is dominated by the
+// hash chains when hashing is enabled: roughly 4*(2**HashNumBits) +
+// 5*(WindowSize + BufferSize) bytes, or 8*(2**HashNumBits) + 9*(WindowSize +
+// BufferSize) bytes once WindowSize + BufferSize exceeds 1 GiB.
+func (lz77 LZ77) Clone() *LZ77 {
+	dupe := lz77
+	dupe.slice = cloneBytes(lz77.slice)
+	dupe.htLastByHash = lz77.htLastByHash.clone()
+	dupe.htPrevByIndex = lz77.htPrevByIndex.clone()
+	if lz77.stats != nil {
+		stats := *lz77.stats
+		dupe.stats = &stats
+	}
+	return &dupe
+}
+
+// EnableStats enables the collection of token statistics by Advance, starting
+// from zero.  The cost is a handful of additions per token.  Statistics remain
+// enabled until the next call to Init, ResetWithOptions, or DisableStats.
+func (lz77 *LZ77) EnableStats() {
+	lz77.stats = new(LZ77Stats)
+}
+
+// DisableStats disables the collection of token statistics.
+func (lz77 *LZ77) DisableStats() {
+	lz77.stats = nil
+}
+
+// Stats returns the token statistics collected since the last call to
+// EnableStats or ResetStats.  Returns the zero value if statistics are not
+// enabled.
+func (lz77 LZ77) Stats() LZ77Stats {
+	if lz77.stats == nil {
+		return LZ77Stats{}
+	}
+	return *lz77.stats
+}
+
+// ResetStats resets all of the token statistics to zero.  It is a no-op if
+// statistics are not enabled.
+func (lz77 *LZ77) ResetStats() {
+	if lz77.stats != nil {
+		*lz77.stats = LZ77Stats{}
 	}
 }
 
+// EnableChecksum enables a running CRC-32 checksum, computed with the given
+// table, of every byte which moves from the Buffer into the Window by any
+// means, such as Advance, Skip, Read, ReadByte, or CommitBulkRead.  This is
+// the CRC-32 required by gzip framing if table is crc32.IEEETable, which is
+// used if table is nil.  Bytes added to the Window by SetWindow or
+// SetWindowFromReader are not included.  The checksum starts from its initial
+// value, and remains enabled until the next call to Init, ResetWithOptions,
+// or DisableChecksum.  It is not encoded by MarshalBinary.
+func (lz77 *LZ77) EnableChecksum(table *crc32.Table) {
+	if table == nil {
+		table = crc32.IEEETable
+	}
+	lz77.sumKind = lz77SumCRC32
+	lz77.sumTable = table
+	lz77.ResetChecksum()
+}
+
+// EnableAdler32Checksum is like EnableChecksum, but computes the Adler-32
+// checksum required by zlib framing instead.
+func (lz77 *LZ77) EnableAdler32Checksum() {
+	lz77.sumKind = lz77SumAdler32
+	lz77.sumTable = nil
+	lz77.ResetChecksum()
+}
+
+// DisableChecksum disables the running checksum.
+func (lz77 *LZ77) DisableChecksum() {
+	lz77.sumKind = lz77SumNone
+	lz77.sumTable = nil
+	lz77.sum = 0
+}
+
+// ResetChecksum resets the running checksum to its initial value.  It is a
+// no-op if the checksum is not enabled.
+func (lz77 *LZ77) ResetChecksum() {
+	lz77.sum = 0
+	if lz77.sumKind == lz77SumAdler32 {
+		lz77.sum = 1
+	}
+}
+
+// Checksum returns the running checksum of the bytes which have moved from
+// the Buffer into the Window since the last call to EnableChecksum,
+// EnableAdler32Checksum, or ResetChecksum.  Returns 0 if the checksum is not
+// enabled.
+func (lz77 LZ77) Checksum() uint32 {
+	return lz77.sum
+}
+
+// EnableSelfCheck enables a debugging mode in which Advance also performs an
+// exhaustive search of the Window at each position, as if HashNumBits were 0,
+// and panics with an error wrapping ErrInvariant if the hash chains yielded
+// an invalid match or missed a longer one.  This is very slow, and is
+// intended for fuzzing and testing.  Self-checking remains enabled until the
+// next call to Init, ResetWithOptions, or DisableSelfCheck.  It has no effect
+// if hashing is disabled.
+func (lz77 *LZ77) EnableSelfCheck() {
+	lz77.selfCheck = true
+}
+
+// DisableSelfCheck disables the debugging mode enabled by EnableSelfCheck.
+func (lz77 *LZ77) DisableSelfCheck() {
+	lz77.selfCheck = false
+}
+
 // Clear clears all data, emptying both the buffer and the sliding window.
 func (lz77 *LZ77) Clear() {
 	wsize := lz77.wsize
+	lz77.org = 0
 	lz77.h = wsize
 	lz77.i = wsize
 	lz77.j = wsize
+	lz77.litRun = 0
+	lz77.lastDist = 0
 	bzero.Uint8(lz77.slice)
-	bzero.Uint32(lz77.htLastByHash)
-	bzero.Uint32(lz77.htPrevByIndex)
+	lz77.htLastByHash.zero()
+	lz77.htPrevByIndex.zero()
 }
 
 // WindowClear clears the sliding window.
 func (lz77 *LZ77) WindowClear() {
 	i := lz77.i
 	lz77.h = i
-	bzero.Uint8(lz77.slice[:i])
-	bzero.Uint32(lz77.htLastByHash)
-	bzero.Uint32(lz77.htPrevByIndex)
+	lz77.advanceOrigin()
+	lz77.litRun = 0
+	lz77.zeroOutside(i, lz77.j)
+	lz77.htLastByHash.zero()
+	lz77.htPrevByIndex.zero()
 }
 
 // SetWindow replaces the sliding window with the given data.
@@ -236,172 +683,809 @@ func (lz77 *LZ77) SetWindow(data []byte) {
 		length = maxDist
 	}
 
+	// Make room for the new Window before the Buffer, without wrapping.
+	lz77.relocate()
 	i := lz77.i
-	h := (i - uint32(length))
-
-	lz77.h = h
-	bzero.Uint8(lz77.slice[:h])
+	h := (i - uint64(length))
 	copy(lz77.slice[h:i], data)
-	bzero.Uint32(lz77.htLastByHash)
-	bzero.Uint32(lz77.htPrevByIndex)
-	lz77.windowUpdateRegion(h)
+	lz77.windowReplaced(h)
 }
 
-// DebugString returns a detailed dump of the LZ77's internal state.
-func (lz77 LZ77) DebugString() string {
-	bb := bufferpool.Get()
-	defer bufferpool.Put(bb)
+// SetWindowFromReader replaces the sliding window with up to n bytes read
+// from the provided Reader, stopping early if the Reader reaches EOF.  Like
+// SetWindow, only the last MaxMatchDistance bytes are kept, but they are
+// streamed directly into place, so that a large dictionary need not be held
+// in memory.  If the Reader returns an error other than io.EOF, the sliding
+// window is left empty and the error is returned.
+//
+// Once more than MaxMatchDistance bytes have been read, each read is staged
+// through a separate chunk of up to 64 KiB, as an io.Reader may scribble on
+// all of the slice passed to Read, including bytes beyond those it returns.
+func (lz77 *LZ77) SetWindowFromReader(r io.Reader, n uint) error {
+	keep := n
+	if maxDist := uint(lz77.maxDist); keep > maxDist {
+		keep = maxDist
+	}
 
-	bb.WriteString("LZ77(\n")
+	lz77.relocate()
+	i := lz77.i
+	if keep == 0 {
+		_, err := io.CopyN(io.Discard, r, int64(n))
+		lz77.windowReplaced(i)
+		if err == io.EOF {
+			err = nil
+		}
+		return err
+	}
 
-	slice := lz77.slice
+	// Use the tail of the window region as a circular buffer, so that
+	// only the last keep bytes are retained.
+	ring := lz77.slice[i-uint64(keep) : i]
+	var stage []byte
+	var pos, total uint
+	for total < n {
+		end := keep
+		if limit := pos + (n - total); end > limit {
+			end = limit
+		}
+
+		// Until the ring first fills, the bytes past pos are not yet
+		// part of the dictionary, so the Reader may read into place.
+		buf := ring[pos:end]
+		if total >= keep {
+			if stage == nil {
+				size := keep
+				if size > windowStageMax {
+					size = windowStageMax
+				}
+				stage = make([]byte, size)
+			}
+			if uint(len(buf)) > uint(len(stage)) {
+				buf = buf[:len(stage)]
+			}
+			buf = stage[:len(buf)]
+		}
+
+		nn, err := r.Read(buf)
+		assert.Assertf(nn >= 0, "Read() returned %d, which is < 0", nn)
+		assert.Assertf(nn <= len(buf), "Read() returned %d, which is > len(buffer) %d", nn, len(buf))
+		if total >= keep {
+			copy(ring[pos:], buf[:nn])
+		}
+		pos += uint(nn)
+		total += uint(nn)
+		if pos == keep {
+			pos = 0
+		}
+
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			lz77.windowReplaced(i)
+			return err
+		}
+	}
+
+	length := total
+	if total < keep {
+		copy(ring[keep-total:], ring[:total])
+	} else {
+		reverseBytes(ring[:pos])
+		reverseBytes(ring[pos:])
+		reverseBytes(ring)
+		length = keep
+	}
+
+	lz77.windowReplaced(i - uint64(length))
+	return nil
+}
+
+// AppendWindow extends the sliding window with the given data, as if it had
+// been written to the LZ77 and consumed by Advance, but without disturbing the
+// data in the Buffer, which then follows the appended data.  Unlike SetWindow,
+// the existing Window is kept, except that the oldest bytes are discarded as
+// needed to keep its length within MaxMatchDistance, and the existing hash
+// chains are kept as well, so only the appended data need be hashed.  As with
+// SetWindow, the appended data is treated as a dictionary: it is not counted
+// in the token statistics or the running checksum, and it does not extend the
+// run of literals seen by BackwardMatchExtension or HashInsertStride.
+func (lz77 *LZ77) AppendWindow(data []byte) {
+	length := uint(len(data))
+	if maxDist := uint(lz77.maxDist); length > maxDist {
+		x := length - maxDist
+		data = data[x:]
+		length = maxDist
+	}
+	if length == 0 {
+		return
+	}
+
+	lz77.rebase()
 	h := lz77.h
 	i := lz77.i
 	j := lz77.j
-	n := uint32(len(slice))
+	delta := uint64(length)
 
-	used := (j - i)
+	// The last few positions in the Window may have been hashed using bytes
+	// from the Buffer, which will no longer follow them.
+	start := h
+	if (i - h) > hashLenSubOne {
+		start = i - hashLenSubOne
+	}
+	lz77.windowUnhashRegion(start, lz77.hashEnd())
 
-	fmt.Fprintf(bb, "\tcapacity = %d\n", n)
-	fmt.Fprintf(bb, "\tbbits = %d\n", lz77.bbits)
-	fmt.Fprintf(bb, "\twbits = %d\n", lz77.wbits)
-	fmt.Fprintf(bb, "\thbits = %d\n", lz77.hbits)
-	fmt.Fprintf(bb, "\tminLen = %d\n", lz77.minLen)
-	fmt.Fprintf(bb, "\tmaxLen = %d\n", lz77.maxLen)
-	fmt.Fprintf(bb, "\tmaxDist = %d\n", lz77.maxDist)
-	fmt.Fprintf(bb, "\thashMask = %#08x\n", lz77.hashMask)
-	fmt.Fprintf(bb, "\tbCap = %d\n", lz77.bsize)
-	fmt.Fprintf(bb, "\twCap = %d\n", lz77.wsize)
-	fmt.Fprintf(bb, "\th = %d\n", h)
-	fmt.Fprintf(bb, "\ti = %d\n", i)
-	fmt.Fprintf(bb, "\tj = %d\n", j)
-	fmt.Fprintf(bb, "\tlength = %d\n", used)
-
-	bb.WriteString("\tbytes = [")
-	for index := h; index < j; index++ {
-		prefix := ""
-		if index == i {
-			prefix = " |"
-		}
-		ch := lz77.slice[index]
-		fmt.Fprintf(bb, "%s %02x", prefix, ch)
+	if (i + delta - h) > lz77.maxDist {
+		lz77.h = i + delta - lz77.maxDist
+		lz77.advanceOrigin()
 	}
-	if i == j {
-		bb.WriteString(" |")
+	lz77.moveRange(i, j, delta)
+	head, tail := lz77.span(i, i+delta)
+	copy(tail, data[copy(head, data):])
+	lz77.i = i + delta
+	lz77.j = j + delta
+	lz77.litRun = 0
+	lz77.windowUpdateRegion(start)
+}
+
+// GrowBuffer changes the size of the Buffer to 2**newBufferNumBits bytes,
+// without disturbing the Window, the data in the Buffer, or the hash chains,
+// so that subsequent calls to Advance find exactly the same matches into the
+// existing Window as they would have before.  A MaxMatchLength (and a
+// NiceMatchLength) equal to the old buffer size, as when it was capped or
+// defaulted by Init, becomes the new buffer size; other options which are
+// capped at the buffer size are capped anew.  Despite the name, the Buffer
+// may also shrink, but ErrFull is returned if the data in the Buffer would
+// not fit.  If the new size is invalid for the LZ77's other options, a
+// LZ77OptionsError is returned.  On error, the LZ77 is left unchanged.
+func (lz77 *LZ77) GrowBuffer(newBufferNumBits uint) error {
+	o := lz77.Options()
+	o.BufferNumBits = newBufferNumBits
+	if lz77.maxLen == lz77.bsize {
+		o.MaxMatchLength = ^uint(0)
+		if lz77.niceLen == lz77.maxLen {
+			o.NiceMatchLength = 0
+		}
+	}
+	o, problems := o.normalize()
+	if len(problems) != 0 {
+		return LZ77OptionsError{Problems: problems}
 	}
-	bb.WriteString(" ]\n")
 
-	if lz77.htLastByHash != nil {
-		bb.WriteString("\thashtable = [")
+	wsize := lz77.wsize
+	bsize := (uint64(1) << o.BufferNumBits)
+	h := lz77.h
+	i := lz77.i
+	j := lz77.j
+	if used := (j - i); used > bsize {
+		return fmt.Errorf("%w: %d bytes in the Buffer will not fit in a new Buffer of %d bytes", ErrFull, used, bsize)
+	}
 
-		for index, lastPlusOne := range lz77.htLastByHash {
-			if lastPlusOne > h && lastPlusOne <= i {
-				hash := uint32(index)
-				last := lastPlusOne - 1
-				fmt.Fprintf(bb, " %#02x:[%d", hash, last)
-				prevPlusOne := lz77.htPrevByIndex[last]
-				for prevPlusOne > h && prevPlusOne < lastPlusOne {
-					prev := prevPlusOne - 1
-					fmt.Fprintf(bb, " %d", prev)
-					lastPlusOne = prevPlusOne
-					prevPlusOne = lz77.htPrevByIndex[prev]
+	// As in relocate, the new storage begins with the Buffer at index
+	// wsize, so that no positions wrap.
+	n := wsize + bsize
+	delta := i - wsize
+	slice := make([]byte, n)
+	x, y := lz77.span(h, j)
+	copy(slice[(h-delta)+uint64(copy(slice[h-delta:], x)):], y)
+
+	// The new storage may also need hash chains of a different width.
+	if !lz77.htPrevByIndex.isNil() {
+		wide := lz77WideTables(n)
+		last := lz77.htLastByHash
+		if last.isWide() != wide {
+			last = makeLZ77Table(last.len(), wide)
+		}
+		prev := makeLZ77Table(n, wide)
+		if !lz77.noMatch {
+			remap := func(posPlusOne uint64) uint64 {
+				if posPlusOne > h {
+					return posPlusOne - delta
 				}
-				bb.WriteString("]")
+				return 0
+			}
+			for pos := h; pos != i; pos++ {
+				prev.set(pos-delta, remap(lz77.htPrevByIndex.get(lz77.phys(pos))))
+			}
+			for index, length := uint64(0), last.len(); index < length; index++ {
+				last.set(index, remap(lz77.htLastByHash.get(index)))
 			}
 		}
-
-		bb.WriteString(" ]\n")
+		lz77.htLastByHash = last
+		lz77.htPrevByIndex = prev
 	}
 
-	bb.WriteString(")\n")
-	return bb.String()
+	lz77.slice = slice
+	lz77.org = 0
+	lz77.h = h - delta
+	lz77.i = i - delta
+	lz77.j = j - delta
+	lz77.bsize = bsize
+	lz77.bbits = byte(o.BufferNumBits)
+	lz77.maxLen = uint64(o.MaxMatchLength)
+	lz77.niceLen = uint64(o.NiceMatchLength)
+	lz77.tailLen = uint64(o.TailLiteralBytes)
+	lz77.repBias = uint64(o.RepeatOffsetBias)
+	return nil
 }
 
-// GoString returns a brief dump of the LZ77's internal state.
-func (lz77 LZ77) GoString() string {
-	bb := bufferpool.Get()
-	defer bufferpool.Put(bb)
+// SetMatchingEnabled enables or disables match finding.  While matching is
+// disabled, Advance returns only single-byte literals, and no data is hashed
+// as it enters the Window, which makes draining the LZ77 with Read, ReadByte,
+// WriteTo, or CommitBulkRead nearly as cheap as draining a plain Buffer.
+// Re-enabling matching rebuilds the hash chains for the current Window, at a
+// cost proportional to its length.  Matching is enabled by Init and Reset.
+func (lz77 *LZ77) SetMatchingEnabled(enabled bool) {
+	if enabled == !lz77.noMatch {
+		return
+	}
+	lz77.noMatch = !enabled
+	if enabled {
+		lz77.htLastByHash.zero()
+		lz77.htPrevByIndex.zero()
+		lz77.windowUpdateRegion(lz77.h)
+	}
+}
 
-	bb.WriteString("LZ77(")
-	fmt.Fprintf(bb, "bbits=%d, ", lz77.bbits)
-	fmt.Fprintf(bb, "wbits=%d, ", lz77.wbits)
-	fmt.Fprintf(bb, "hbits=%d, ", lz77.hbits)
-	fmt.Fprintf(bb, "minLen=%d, ", lz77.minLen)
-	fmt.Fprintf(bb, "maxLen=%d, ", lz77.maxLen)
-	fmt.Fprintf(bb, "maxDist=%d, ", lz77.maxDist)
-	fmt.Fprintf(bb, "bsize=%d, ", lz77.bsize)
-	fmt.Fprintf(bb, "wsize=%d, ", lz77.wsize)
-	fmt.Fprintf(bb, "h=%d, ", lz77.h)
-	fmt.Fprintf(bb, "i=%d, ", lz77.i)
-	fmt.Fprintf(bb, "j=%d", lz77.j)
-	bb.WriteString(")")
+// MatchingEnabled returns true iff match finding is enabled.  See
+// SetMatchingEnabled.
+func (lz77 LZ77) MatchingEnabled() bool {
+	return !lz77.noMatch
+}
 
-	return bb.String()
+// SetFinal declares whether the data in the Buffer runs to the end of the
+// stream.  While it does not, Advance declines to consume any position which
+// lies within MaxMatchLength + TailLiteralBytes of the end of the Buffer,
+// returning a nil buf instead, so that the tokens it returns do not depend on
+// how the stream was divided into writes.  Use NeedsInput to distinguish this
+// from an empty Buffer.  The stream is final after Init and Reset, which
+// preserves the behavior of LZ77s which never call SetFinal.
+func (lz77 *LZ77) SetFinal(final bool) {
+	lz77.notFinal = !final
 }
 
-// String returns the contents of the LZ77's Buffer as a string.
-func (lz77 LZ77) String() string {
-	return string(lz77.BufferBytesView())
+// IsFinal returns true iff the data in the Buffer runs to the end of the
+// stream.  See SetFinal.
+func (lz77 LZ77) IsFinal() bool {
+	return !lz77.notFinal
 }
 
-// PrepareBulkWrite obtains a slice into which the caller can write bytes.  See
-// Buffer.PrepareBulkWrite for more details.
-//
-func (lz77 *LZ77) PrepareBulkWrite(length uint) []byte {
-	bsize := lz77.bsize
-	i := lz77.i
-	j := lz77.j
-	x := (j - i)
-	y := bsize - x
+// NeedsInput returns true iff Advance is declining to consume the data in
+// the Buffer because the stream is not final and not enough data is buffered.
+// See SetFinal.
+func (lz77 LZ77) NeedsInput() bool {
+	return lz77.needsInput()
+}
 
-	if length > uint(y) {
-		length = uint(y)
+func (lz77 *LZ77) needsInput() bool {
+	if !lz77.notFinal {
+		return false
+	}
+	used := (lz77.j - lz77.i)
+	if lz77.maxLen == 0 || lz77.noMatch {
+		return used == 0
 	}
+	need := lz77.maxLen + lz77.tailLen
+	if need > lz77.bsize {
+		need = lz77.bsize
+	}
+	return used < need
+}
 
-	lz77.shift(uint32(length))
-	j = lz77.j
-	jPrime := j + uint32(length)
-	return lz77.slice[j:jPrime]
+// windowReplaced finishes replacing the sliding window with the contents of
+// positions h through i, discarding all older data and rebuilding the hash
+// chains.
+func (lz77 *LZ77) windowReplaced(h uint64) {
+	lz77.h = h
+	lz77.litRun = 0
+	lz77.zeroOutside(h, lz77.j)
+	lz77.htLastByHash.zero()
+	lz77.htPrevByIndex.zero()
+	lz77.windowUpdateRegion(h)
 }
 
-// CommitBulkWrite completes the bulk write begun by the previous call to
-// PrepareBulkWrite.  The argument must be between 0 and the length of the
-// slice returned by PrepareBulkWrite.
-//
-func (lz77 *LZ77) CommitBulkWrite(length uint) {
-	bsize := lz77.bsize
+// CheckInvariants verifies the consistency of the LZ77's internal state,
+// returning an error wrapping ErrInvariant which describes the first problem
+// found.  Every position in the Window which is followed by enough bytes to
+// be hashed must appear exactly once in the hash chain for its hash (or at
+// most once, if HashInsertStride is greater than 1), and the hash chains must
+// contain nothing else.  The LZ77 is not modified, so this
+// is suitable for calling after every operation when fuzzing, but its cost is
+// proportional to the size of the hash table plus the length of the Window.
+// The hash chains are not checked while matching is disabled.
+func (lz77 LZ77) CheckInvariants() error {
+	h := lz77.h
 	i := lz77.i
 	j := lz77.j
-	x := (j - i)
-	y := bsize - x
+	n := uint64(len(lz77.slice))
 
-	assert.Assertf(length <= uint(y), "length %d > available space %d", length, uint(y))
+	if h > i || i > j || (j-h) > n {
+		return fmt.Errorf("%w: expected h %d <= i %d <= j %d <= h + len %d", ErrInvariant, h, i, j, n)
+	}
+	if h < lz77.org || (h-lz77.org) >= n {
+		return fmt.Errorf("%w: h %d lies outside of the lap beginning at %d", ErrInvariant, h, lz77.org)
+	}
+	if (i - h) > lz77.maxDist {
+		return fmt.Errorf("%w: window length %d > maxDist %d", ErrInvariant, i-h, lz77.maxDist)
+	}
+	if (j - i) > lz77.bsize {
+		return fmt.Errorf("%w: buffer length %d > bsize %d", ErrInvariant, j-i, lz77.bsize)
+	}
 
-	lz77.j = j + uint32(length)
-	lz77.windowUpdateRegion(j - hashLenSubOne)
-}
+	if lz77.htLastByHash.isNil() || lz77.noMatch {
+		return nil
+	}
 
-// WriteByte writes a single byte to the LZ77's Buffer.
-func (lz77 *LZ77) WriteByte(ch byte) error {
-	bsize := lz77.bsize
-	i := lz77.i
-	j := lz77.j
-	x := (j - i)
-	y := bsize - x
+	end := lz77.hashEnd()
 
-	if y == 0 {
-		return ErrFull
+	var total uint64
+	for index, length := uint64(0), lz77.htLastByHash.len(); index < length; index++ {
+		hash := uint32(index)
+		limitPlusOne := end + 1
+		currPlusOne := lz77.htLastByHash.get(index)
+		for currPlusOne > h {
+			curr := currPlusOne - 1
+			if currPlusOne >= limitPlusOne {
+				return fmt.Errorf("%w: bucket %#x contains %d out of order or beyond %d", ErrInvariant, hash, curr, end)
+			}
+			if actual := lz77.hashAt(curr); actual != hash {
+				return fmt.Errorf("%w: bucket %#x contains %d, which hashes to %#x", ErrInvariant, hash, curr, actual)
+			}
+			total++
+			limitPlusOne = currPlusOne
+			currPlusOne = lz77.htPrevByIndex.get(lz77.phys(curr))
+		}
 	}
 
-	lz77.shift(1)
-	j = lz77.j
-	lz77.slice[j] = ch
-	lz77.j = j + 1
-	lz77.windowUpdateRegion(j - hashLenSubOne)
+	if expect := (end - h); total > expect || (total != expect && lz77.stride <= 1) {
+		return fmt.Errorf("%w: hash chains contain %d positions, expected %d", ErrInvariant, total, expect)
+	}
 	return nil
 }
 
-// Write writes a slice of bytes to the LZ77's Buffer.
+// DebugString returns a detailed dump of the LZ77's internal state.  It is
+// equivalent to DumpTo with IncludeBytes and FullBuckets both set, and is only
+// practical for small LZ77s.
+func (lz77 LZ77) DebugString() string {
+	bb := bufferpool.Get()
+	defer bufferpool.Put(bb)
+	_ = lz77.DumpTo(bb, LZ77DumpOptions{IncludeBytes: true, FullBuckets: true})
+	return bb.String()
+}
+
+// DumpTo writes a dump of the LZ77's internal state to w, in the format used
+// by DebugString, subject to opts.  The dump is written incrementally, so it
+// is practical even for large LZ77s.  Returns the first error reported by w.
+func (lz77 LZ77) DumpTo(w io.Writer, opts LZ77DumpOptions) error {
+	bw := bufio.NewWriter(w)
+
+	bw.WriteString("LZ77(\n")
+
+	h := lz77.h
+	i := lz77.i
+	j := lz77.j
+	n := uint64(len(lz77.slice))
+
+	used := (j - i)
+
+	fmt.Fprintf(bw, "\tcapacity = %d\n", n)
+	fmt.Fprintf(bw, "\tbbits = %d\n", lz77.bbits)
+	fmt.Fprintf(bw, "\twbits = %d\n", lz77.wbits)
+	fmt.Fprintf(bw, "\thbits = %d\n", lz77.hbits)
+	fmt.Fprintf(bw, "\tminLen = %d\n", lz77.minLen)
+	fmt.Fprintf(bw, "\tmaxLen = %d\n", lz77.maxLen)
+	fmt.Fprintf(bw, "\tmaxDist = %d\n", lz77.maxDist)
+	fmt.Fprintf(bw, "\thashMask = %#08x\n", lz77.hashMask)
+	fmt.Fprintf(bw, "\tbCap = %d\n", lz77.bsize)
+	fmt.Fprintf(bw, "\twCap = %d\n", lz77.wsize)
+	fmt.Fprintf(bw, "\th = %d\n", h)
+	fmt.Fprintf(bw, "\ti = %d\n", i)
+	fmt.Fprintf(bw, "\tj = %d\n", j)
+	fmt.Fprintf(bw, "\tlength = %d\n", used)
+
+	if opts.IncludeBytes {
+		// With a limit, show the bytes nearest to the boundary between
+		// the Window and the Buffer.
+		start, end := h, j
+		if limit := opts.MaxBytesPerRegion; limit != 0 {
+			if uint(i-h) > limit {
+				start = i - uint64(limit)
+			}
+			if uint(j-i) > limit {
+				end = i + uint64(limit)
+			}
+		}
+
+		bw.WriteString("\tbytes = [")
+		if start != h {
+			bw.WriteString(" ...")
+		}
+		for index := start; index < end; index++ {
+			prefix := ""
+			if index == i {
+				prefix = " |"
+			}
+			ch := lz77.at(index)
+			fmt.Fprintf(bw, "%s %02x", prefix, ch)
+		}
+		if i == end {
+			bw.WriteString(" |")
+		}
+		if end != j {
+			bw.WriteString(" ...")
+		}
+		bw.WriteString(" ]\n")
+	}
+
+	if !lz77.htLastByHash.isNil() {
+		bw.WriteString("\thashtable = [")
+
+		for index, length := uint64(0), lz77.htLastByHash.len(); index < length; index++ {
+			lastPlusOne := lz77.htLastByHash.get(index)
+			if lastPlusOne > h && lastPlusOne <= i {
+				hash := uint32(index)
+				last := lastPlusOne - 1
+				if opts.FullBuckets {
+					fmt.Fprintf(bw, " %#02x:[%d", hash, last)
+				}
+				newest, oldest, count := last, last, 1
+				prevPlusOne := lz77.htPrevByIndex.get(lz77.phys(last))
+				for prevPlusOne > h && prevPlusOne < lastPlusOne {
+					prev := prevPlusOne - 1
+					if opts.FullBuckets {
+						fmt.Fprintf(bw, " %d", prev)
+					}
+					oldest = prev
+					count++
+					lastPlusOne = prevPlusOne
+					prevPlusOne = lz77.htPrevByIndex.get(lz77.phys(prev))
+				}
+				if opts.FullBuckets {
+					bw.WriteString("]")
+				} else {
+					fmt.Fprintf(bw, " %#02x:{count=%d newest=%d oldest=%d}", hash, count, newest, oldest)
+				}
+			}
+		}
+
+		bw.WriteString(" ]\n")
+	}
+
+	bw.WriteString(")\n")
+	return bw.Flush()
+}
+
+// MarshalBinary encodes the LZ77's options and the contents of its Window and
+// Buffer.  The hash chains are not encoded, as UnmarshalBinary rebuilds them,
+// but if HashInsertStride is greater than 1 then the set of positions in the
+// Window which they hold is encoded, as a bitmap, along with the phase of the
+// positions.  Token statistics are not encoded.
+func (lz77 LZ77) MarshalBinary() ([]byte, error) {
+	if lz77.score != nil {
+		return nil, LZ77OptionsError{Problems: []string{"ScoreMatch functions cannot be marshaled"}}
+	}
+
+	window := lz77.WindowBytesView()
+	buffer := lz77.BufferBytesView()
+
+	var flags byte
+	if lz77.backExt {
+		flags |= lz77FlagBackExt
+	}
+	if lz77.noMatch {
+		flags |= lz77FlagNoMatch
+	}
+	if lz77.notFinal {
+		flags |= lz77FlagNotFinal
+	}
+
+	var hashed []byte
+	if lz77.sparseHashState() {
+		hashed = lz77.hashedBitmap()
+	}
+
+	out := make([]byte, 5, 5+14*binary.MaxVarintLen64+len(window)+len(buffer)+len(hashed))
+	out[0] = lz77BinaryVersion
+	out[1] = lz77.bbits
+	out[2] = lz77.wbits
+	out[3] = lz77.hbits
+	out[4] = flags
+	out = appendUvarint(out, lz77.minLen)
+	out = appendUvarint(out, lz77.maxLen)
+	out = appendUvarint(out, lz77.maxDist)
+	out = appendUvarint(out, lz77.maxChain)
+	out = appendUvarint(out, lz77.minDist)
+	out = appendUvarint(out, lz77.tailLen)
+	out = appendUvarint(out, lz77.repBias)
+	out = appendUvarint(out, lz77.niceLen)
+	out = appendUvarint(out, lz77.stride)
+	out = appendUvarint(out, lz77.litRun)
+	out = appendUvarint(out, lz77.lastDist)
+	out = appendUvarint(out, uint64(len(window)))
+	out = appendUvarint(out, uint64(len(buffer)))
+	if lz77.stride > 1 {
+		out = appendUvarint(out, lz77.h%lz77.stride)
+	}
+	out = append(out, window...)
+	out = append(out, buffer...)
+	out = append(out, hashed...)
+	return out, nil
+}
+
+// UnmarshalBinary replaces the LZ77 with one decoded from the output of
+// MarshalBinary.  The restored LZ77 produces exactly the same sequence of
+// Advance results as the original would have.  If the data is malformed,
+// ErrCorrupt is returned and the LZ77 is left untouched.
+//
+// The LZ77's storage and hash table are allocated at the sizes recorded in the
+// data, however few bytes the data holds, so UnmarshalBinary returns a
+// NumBitsError if BufferNumBits, WindowNumBits, or HashNumBits exceeds 30,
+// which still allows several GiB to be allocated.  Use UnmarshalBinaryLimit to
+// decode larger LZ77s, or to decode untrusted data with a tighter limit.
+func (lz77 *LZ77) UnmarshalBinary(data []byte) error {
+	return lz77.UnmarshalBinaryLimit(data, lz77UnmarshalNumBits)
+}
+
+// lz77UnmarshalNumBits is the largest BufferNumBits, WindowNumBits, or
+// HashNumBits which UnmarshalBinary accepts.
+const lz77UnmarshalNumBits = 30
+
+// UnmarshalBinaryLimit is like UnmarshalBinary, but returns a NumBitsError
+// without allocating if the decoded LZ77's BufferNumBits, WindowNumBits, or
+// HashNumBits would exceed maxNumBits.
+func (lz77 *LZ77) UnmarshalBinaryLimit(data []byte, maxNumBits uint) error {
+	if len(data) < 5 || data[0] != lz77BinaryVersion {
+		return ErrCorrupt
+	}
+	bbits := uint(data[1])
+	wbits := uint(data[2])
+	hbits := uint(data[3])
+	flags := data[4]
+	data = data[5:]
+
+	if bbits < 2 || bbits > lz77MaxBufferNumBits || wbits > lz77MaxWindowNumBits || hbits > 32 || (flags&^(lz77FlagBackExt|lz77FlagNoMatch|lz77FlagNotFinal)) != 0 {
+		return ErrCorrupt
+	}
+
+	var fields [13]uint64
+	for index := range fields {
+		value, n := binary.Uvarint(data)
+		if n <= 0 {
+			return ErrCorrupt
+		}
+		fields[index] = value
+		data = data[n:]
+	}
+	minLen, maxLen, maxDist, maxChain := fields[0], fields[1], fields[2], fields[3]
+	minDist, tailLen, repBias, niceLen := fields[4], fields[5], fields[6], fields[7]
+	stride, litRun, lastDist := fields[8], fields[9], fields[10]
+	windowLen, bufferLen := fields[11], fields[12]
+
+	var phase uint64
+	if stride > 1 {
+		value, n := binary.Uvarint(data)
+		if n <= 0 || value >= stride {
+			return ErrCorrupt
+		}
+		phase = value
+		data = data[n:]
+	}
+
+	bsize := (uint64(1) << bbits)
+	wsize := (uint64(1) << wbits)
+	ok := true
+	ok = ok && (maxDist <= wsize && windowLen <= maxDist)
+	ok = ok && (bufferLen <= bsize && litRun <= wsize && lastDist <= wsize)
+	ok = ok && (uint64(len(data)) >= windowLen+bufferLen)
+	if !ok {
+		return ErrCorrupt
+	}
+	payload := windowLen + bufferLen
+
+	// The bitmap has one bit for each position in the Window which is
+	// followed by enough data to be hashed.
+	var hashed []byte
+	var hashedLen uint64
+	sparse := (stride > 1 && hbits != 0 && (flags&lz77FlagNoMatch) == 0)
+	if sparse {
+		hashedLen = windowLen
+		if bufferLen < hashLenSubOne {
+			short := hashLenSubOne - bufferLen
+			if hashedLen < short {
+				short = hashedLen
+			}
+			hashedLen -= short
+		}
+		hashed = data[payload:]
+		if uint64(len(hashed)) != (hashedLen+7)/8 {
+			return ErrCorrupt
+		}
+		if rem := hashedLen % 8; rem != 0 && (hashed[len(hashed)-1]>>rem) != 0 {
+			return ErrCorrupt
+		}
+	} else if uint64(len(data)) != payload {
+		return ErrCorrupt
+	}
+
+	opts := LZ77Options{
+		BufferNumBits:          bbits,
+		WindowNumBits:          wbits,
+		HashNumBits:            hbits,
+		MinMatchLength:         uint(minLen),
+		MaxMatchLength:         uint(maxLen),
+		MaxMatchDistance:       uint(maxDist),
+		MaxChainLength:         uint(maxChain),
+		MinMatchDistance:       uint(minDist),
+		TailLiteralBytes:       uint(tailLen),
+		RepeatOffsetBias:       uint(repBias),
+		NiceMatchLength:        uint(niceLen),
+		HashInsertStride:       uint(stride),
+		MinMatchScore:          minInt,
+		HasMinMatchLength:      true,
+		HasMaxMatchLength:      true,
+		HasMaxMatchDistance:    true,
+		HasMaxChainLength:      true,
+		HasMinMatchDistance:    true,
+		HasMinMatchScore:       true,
+		BackwardMatchExtension: (flags & lz77FlagBackExt) != 0,
+	}
+	if opts.Validate() != nil || !opts.Normalize().Equal(opts) {
+		return ErrCorrupt
+	}
+	for _, numBits := range [...]uint{bbits, wbits, hbits} {
+		if numBits > maxNumBits {
+			return NumBitsError{NumBits: numBits, Max: maxNumBits}
+		}
+	}
+
+	var tmp LZ77
+	tmp.Init(opts)
+
+	// As after SetWindow, the Window is stored just before the Buffer,
+	// which begins at index wsize.  The positions are offset from the
+	// indices as needed to restore their phase, which determines the
+	// positions that HashInsertStride selects for hashing.
+	h := wsize - windowLen
+	if stride > 1 {
+		tmp.org = (phase + stride - h%stride) % stride
+	}
+	copy(tmp.slice[h:], data[:payload])
+	tmp.h = h + tmp.org
+	tmp.i = wsize + tmp.org
+	tmp.j = tmp.i + bufferLen
+	tmp.noMatch = (flags & lz77FlagNoMatch) != 0
+	tmp.notFinal = (flags & lz77FlagNotFinal) != 0
+	tmp.litRun = litRun
+	tmp.lastDist = lastDist
+
+	if sparse {
+		for k := uint64(0); k < hashedLen; k++ {
+			if (hashed[k/8]>>(k%8))&1 != 0 {
+				tmp.hashInsert(tmp.h + k)
+			}
+		}
+	} else {
+		tmp.windowUpdateRegion(tmp.h)
+	}
+	*lz77 = tmp
+	return nil
+}
+
+// sparseHashState returns true iff the hash chains may hold only some of the
+// positions in the Window, so that MarshalBinary must encode which ones.
+func (lz77 LZ77) sparseHashState() bool {
+	return lz77.stride > 1 && !lz77.htLastByHash.isNil() && !lz77.noMatch
+}
+
+// hashedBitmap returns a bitmap of the positions in the Window which are in
+// the hash chains, with bit k (in little-endian bit order) standing for
+// position h + k, up to hashEnd.
+func (lz77 LZ77) hashedBitmap() []byte {
+	h := lz77.h
+	end := lz77.hashEnd()
+	out := make([]byte, (end-h+7)/8)
+	for index, length := uint64(0), lz77.htLastByHash.len(); index < length; index++ {
+		limitPlusOne := end + 1
+		currPlusOne := lz77.htLastByHash.get(index)
+		for currPlusOne > h && currPlusOne < limitPlusOne {
+			k := currPlusOne - 1 - h
+			out[k/8] |= 1 << (k % 8)
+			limitPlusOne = currPlusOne
+			currPlusOne = lz77.htPrevByIndex.get(lz77.phys(currPlusOne - 1))
+		}
+	}
+	return out
+}
+
+// GoString returns a brief dump of the LZ77's internal state.
+func (lz77 LZ77) GoString() string {
+	bb := bufferpool.Get()
+	defer bufferpool.Put(bb)
+
+	bb.WriteString("LZ77(")
+	fmt.Fprintf(bb, "bbits=%d, ", lz77.bbits)
+	fmt.Fprintf(bb, "wbits=%d, ", lz77.wbits)
+	fmt.Fprintf(bb, "hbits=%d, ", lz77.hbits)
+	fmt.Fprintf(bb, "minLen=%d, ", lz77.minLen)
+	fmt.Fprintf(bb, "maxLen=%d, ", lz77.maxLen)
+	fmt.Fprintf(bb, "maxDist=%d, ", lz77.maxDist)
+	fmt.Fprintf(bb, "bsize=%d, ", lz77.bsize)
+	fmt.Fprintf(bb, "wsize=%d, ", lz77.wsize)
+	fmt.Fprintf(bb, "h=%d, ", lz77.h)
+	fmt.Fprintf(bb, "i=%d, ", lz77.i)
+	fmt.Fprintf(bb, "j=%d", lz77.j)
+	bb.WriteString(")")
+
+	return bb.String()
+}
+
+// String returns the contents of the LZ77's Buffer as a string.
+func (lz77 LZ77) String() string {
+	return string(lz77.BufferBytesView())
+}
+
+// PrepareBulkWrite obtains a slice into which the caller can write bytes.  See
+// Buffer.PrepareBulkWrite for more details.
+//
+func (lz77 *LZ77) PrepareBulkWrite(length uint) []byte {
+	bsize := lz77.bsize
+	i := lz77.i
+	j := lz77.j
+	x := (j - i)
+	y := bsize - x
+
+	if length > uint(y) {
+		length = uint(y)
+	}
+
+	lz77.rebase()
+	p := lz77.phys(lz77.j)
+	if z := uint(len(lz77.slice)) - uint(p); length > z {
+		length = z
+	}
+	return lz77.slice[p : p+uint64(length)]
+}
+
+// CommitBulkWrite completes the bulk write begun by the previous call to
+// PrepareBulkWrite.  The argument must be between 0 and the length of the
+// slice returned by PrepareBulkWrite.
+//
+func (lz77 *LZ77) CommitBulkWrite(length uint) {
+	bsize := lz77.bsize
+	i := lz77.i
+	j := lz77.j
+	x := (j - i)
+	y := bsize - x
+
+	assert.Assertf(length <= uint(y), "length %d > available space %d", length, uint(y))
+
+	start := lz77.hashEnd()
+	lz77.j = j + uint64(length)
+	lz77.windowUpdateRegion(start)
+}
+
+// WriteByte writes a single byte to the LZ77's Buffer.
+func (lz77 *LZ77) WriteByte(ch byte) error {
+	bsize := lz77.bsize
+	i := lz77.i
+	j := lz77.j
+	x := (j - i)
+	y := bsize - x
+
+	if y == 0 {
+		return ErrFull
+	}
+
+	lz77.rebase()
+	start := lz77.hashEnd()
+	j = lz77.j
+	lz77.slice[lz77.phys(j)] = ch
+	lz77.j = j + 1
+	lz77.windowUpdateRegion(start)
+	return nil
+}
+
+// Write writes a slice of bytes to the LZ77's Buffer.
 func (lz77 *LZ77) Write(data []byte) (int, error) {
 	bsize := lz77.bsize
 	i := lz77.i
@@ -417,15 +1501,129 @@ func (lz77 *LZ77) Write(data []byte) (int, error) {
 		err = ErrFull
 	}
 
-	lz77.shift(uint32(length))
+	lz77.rebase()
+	start := lz77.hashEnd()
+	j = lz77.j
+	jPrime := j + uint64(length)
+	head, tail := lz77.span(j, jPrime)
+	copy(tail, data[copy(head, data):])
+	lz77.j = jPrime
+	lz77.windowUpdateRegion(start)
+	return int(length), err
+}
+
+// WriteString writes a string to the LZ77's Buffer.  It behaves identically to
+// Write, but avoids the cost of converting the string to a byte slice.
+func (lz77 *LZ77) WriteString(str string) (int, error) {
+	bsize := lz77.bsize
+	i := lz77.i
+	j := lz77.j
+	x := (j - i)
+	y := bsize - x
+
+	length := uint(len(str))
+	var err error
+	if length > uint(y) {
+		length = uint(y)
+		str = str[:length]
+		err = ErrFull
+	}
+
+	lz77.rebase()
+	start := lz77.hashEnd()
+	j = lz77.j
+	jPrime := j + uint64(length)
+	head, tail := lz77.span(j, jPrime)
+	copy(tail, str[copy(head, str):])
+	lz77.j = jPrime
+	lz77.windowUpdateRegion(start)
+	return int(length), err
+}
+
+// WriteMatch appends a copy of previously seen bytes to the LZ77's Buffer, as
+// when decoding an LZ77 back-reference.  The copy begins distance bytes before
+// the end of the Buffer, spanning both the Window and the Buffer, and is length
+// bytes long.  If length exceeds distance, the copy overlaps itself and the
+// most recent distance bytes are repeated.  If the distance exceeds the
+// number of bytes in the Window and Buffer combined, ErrBadDistance is
+// returned and nothing is written.  If the Buffer does not have room for
+// length bytes, as many bytes as possible are written and ErrFull is returned.
+func (lz77 *LZ77) WriteMatch(distance uint, length uint) (int, error) {
+	bsize := lz77.bsize
+	h := lz77.h
+	i := lz77.i
+	j := lz77.j
+	x := (j - i)
+	y := bsize - x
+
+	if distance == 0 || distance > uint(j-h) {
+		return 0, ErrBadDistance
+	}
+
+	var err error
+	if length > uint(y) {
+		length = uint(y)
+		err = ErrFull
+	}
+
+	lz77.rebase()
+	start := lz77.hashEnd()
+	slice := lz77.slice
+	n := uint64(len(slice))
 	j = lz77.j
-	jPrime := j + uint32(length)
-	copy(lz77.slice[j:jPrime], data)
+	jPrime := j + uint64(length)
+
+	// Copy in chunks which neither wrap around the end of storage nor
+	// read bytes which have not yet been written.
+	for k := j; k < jPrime; {
+		dst := lz77.phys(k)
+		src := lz77.phys(k - uint64(distance))
+		chunk := jPrime - k
+		if chunk > uint64(distance) {
+			chunk = uint64(distance)
+		}
+		if x := n - dst; chunk > x {
+			chunk = x
+		}
+		if x := n - src; chunk > x {
+			chunk = x
+		}
+		copy(slice[dst:dst+chunk], slice[src:src+chunk])
+		k += chunk
+	}
 	lz77.j = jPrime
-	lz77.windowUpdateRegion(j - hashLenSubOne)
+	lz77.windowUpdateRegion(start)
 	return int(length), err
 }
 
+// ReadFrom attempts to fill the LZ77's Buffer by reading from the provided
+// Reader.  Unlike Buffer.ReadFrom, io.EOF is never returned: reading stops
+// without error when the Reader is exhausted.  If a nil error is returned,
+// then either the Buffer is now full or the Reader has reached EOF.
+func (lz77 *LZ77) ReadFrom(r io.Reader) (int64, error) {
+	var total int64
+	var err error
+
+	bsize := uint(lz77.bsize)
+	for err == nil {
+		buf := lz77.PrepareBulkWrite(bsize)
+		if len(buf) == 0 {
+			break
+		}
+
+		var nn int
+		nn, err = r.Read(buf)
+		assert.Assertf(nn >= 0, "Read() returned %d, which is < 0", nn)
+		assert.Assertf(nn <= len(buf), "Read() returned %d, which is > len(buffer) %d", nn, len(buf))
+		lz77.CommitBulkWrite(uint(nn))
+		total += int64(nn)
+	}
+	if err == io.EOF {
+		err = nil
+	}
+	return total, err
+}
+
 // PrepareBulkRead obtains a slice from which the caller can read bytes.  See
 // Buffer.PrepareBulkRead for more details.
 //
@@ -435,408 +1633,1462 @@ func (lz77 *LZ77) PrepareBulkRead(length uint) []byte {
 		length = uint(bsize)
 	}
 
-	i := lz77.i
-	j := lz77.j
-	iPrime := i + uint32(length)
-	if iPrime > j {
-		iPrime = j
+	i := lz77.i
+	j := lz77.j
+	if x := uint(j - i); length > x {
+		length = x
+	}
+
+	p := lz77.phys(i)
+	if z := uint(len(lz77.slice)) - uint(p); length > z {
+		length = z
+	}
+	return lz77.slice[p : p+uint64(length)]
+}
+
+// CommitBulkRead completes the bulk read begun by the previous call to
+// PrepareBulkRead.  The argument must be between 0 and the length of the
+// slice returned by PrepareBulkRead.
+//
+func (lz77 *LZ77) CommitBulkRead(length uint) {
+	bsize := lz77.bsize
+	if length > uint(bsize) {
+		length = uint(bsize)
+	}
+
+	i := lz77.i
+	j := lz77.j
+	iPrime := i + uint64(length)
+	assert.Assertf(iPrime <= j, "length %d exceeds %d bytes of available data", length, j-i)
+
+	lz77.slide(iPrime)
+	lz77.litRun = 0
+	lz77.windowUpdateRegion(i)
+}
+
+// ReadByte reads a single byte, or returns ErrEmpty if the buffer is empty.
+func (lz77 *LZ77) ReadByte() (byte, error) {
+	i := lz77.i
+	j := lz77.j
+	iPrime := i + 1
+	if iPrime > j {
+		return 0, ErrEmpty
+	}
+
+	ch := lz77.at(i)
+	lz77.slide(iPrime)
+	lz77.litRun = 0
+	lz77.windowUpdateRegion(i)
+	return ch, nil
+}
+
+// Read reads a slice of bytes from the LZ77's Buffer.  If the buffer is
+// empty, ErrEmpty is returned.
+func (lz77 *LZ77) Read(data []byte) (int, error) {
+	length, err := lz77.read(data, uint(len(data)))
+	return int(length), err
+}
+
+// Discard is like Read, but discards the bytes instead of copying them.  The
+// bytes still enter the Window and are hashed.  Returns the number of bytes
+// discarded.  If the buffer is empty and n is non-zero, ErrEmpty is returned.
+func (lz77 *LZ77) Discard(n uint) (uint, error) {
+	return lz77.read(nil, n)
+}
+
+// Peek copies bytes from the LZ77's Buffer into data without consuming them.
+// If the buffer is empty, ErrEmpty is returned.
+func (lz77 LZ77) Peek(data []byte) (int, error) {
+	if len(data) == 0 {
+		return 0, nil
+	}
+
+	i := lz77.i
+	j := lz77.j
+	if i == j {
+		return 0, ErrEmpty
+	}
+
+	length := uint(j - i)
+	if length > uint(len(data)) {
+		length = uint(len(data))
+	}
+
+	head, tail := lz77.span(i, i+uint64(length))
+	copy(data[copy(data, head):], tail)
+	return int(length), nil
+}
+
+// read implements Read and Discard.  If data is nil, the bytes are discarded
+// instead of being copied into data.
+func (lz77 *LZ77) read(data []byte, length uint) (uint, error) {
+	if length == 0 {
+		return 0, nil
+	}
+
+	bsize := lz77.bsize
+	if length > uint(bsize) {
+		length = uint(bsize)
+	}
+
+	i := lz77.i
+	j := lz77.j
+	iPrime := i + uint64(length)
+	if iPrime > j {
+		iPrime = j
+		length = uint(iPrime - i)
+		if length == 0 {
+			return 0, ErrEmpty
+		}
+	}
+
+	if data != nil {
+		head, tail := lz77.span(i, iPrime)
+		copy(data[copy(data, head):], tail)
+	}
+	lz77.slide(iPrime)
+	lz77.litRun = 0
+	lz77.windowUpdateRegion(i)
+	return length, nil
+}
+
+// WriteTo attempts to drain the LZ77's Buffer by writing to the provided
+// Writer.  As with Read, the drained bytes are moved into the Window, so that
+// later matches may refer to them.  May return any error returned by the
+// Writer, or io.ErrShortWrite if the Writer accepts fewer bytes than offered
+// without returning an error.  If a nil error is returned, then the Buffer is
+// now empty.
+func (lz77 *LZ77) WriteTo(w io.Writer) (int64, error) {
+	var total int64
+	var err error
+
+	bsize := uint(lz77.bsize)
+	for err == nil {
+		buf := lz77.PrepareBulkRead(bsize)
+		if len(buf) == 0 {
+			break
+		}
+
+		var nn int
+		nn, err = w.Write(buf)
+		assert.Assertf(nn >= 0, "Write() returned %d, which is < 0", nn)
+		assert.Assertf(nn <= len(buf), "Write() returned %d, which is > len(buffer) %d", nn, len(buf))
+		lz77.CommitBulkRead(uint(nn))
+		total += int64(nn)
+		if err == nil && nn < len(buf) {
+			err = io.ErrShortWrite
+		}
+	}
+	return total, err
+}
+
+// Advance moves a slice of bytes from the LZ77's Buffer to its Window.  The
+// nature of the slice depends on the LZ77's prefix match settings, the
+// contents of the LZ77's Window, and the contents of the LZ77's Buffer.
+//
+// If BackwardMatchExtension is enabled, a match may also absorb some of the
+// literal bytes returned by the immediately preceding calls to Advance, when
+// those bytes are equal to the bytes preceding the match source.  In that
+// case matchLength exceeds len(buf), and the caller should retract the last
+// (matchLength - len(buf)) literals it emitted; the match then begins that many
+// bytes before buf, at the same matchDistance.
+//
+// The returned slice is a view into the LZ77's storage, unless its bytes wrap
+// around the end of the circular buffer, in which case it is a copy.
+func (lz77 *LZ77) Advance() (buf []byte, matchDistance uint, matchLength uint, matchFound bool) {
+	lz77.advanceAssertions()
+	return lz77.advanceOne()
+}
+
+// AdvanceToken is like Advance, but returns its results as a LZ77Token,
+// which also reports whether a match reuses the distance of the previous
+// match.  This is useful for formats such as zstd which encode such repeat
+// offsets specially; see also RepeatOffsetBias.
+func (lz77 *LZ77) AdvanceToken() LZ77Token {
+	lastDist := lz77.lastDist
+	buf, matchDistance, matchLength, matchFound := lz77.Advance()
+	return LZ77Token{
+		Bytes:          buf,
+		Distance:       matchDistance,
+		Length:         matchLength,
+		IsMatch:        matchFound,
+		IsRepeatOffset: matchFound && lastDist != 0 && uint64(matchDistance) == lastDist,
+	}
+}
+
+// AdvanceAll fills tokens with the results of successive calls to
+// AdvanceToken, stopping when tokens is full or when the Buffer is empty (or
+// NeedsInput returns true), and returns the number of tokens filled.  The
+// tokens are identical to those which AdvanceToken would have returned, but
+// the per-call overhead is paid only once.  The Bytes of each token remain
+// valid until the next call which writes to the Buffer or otherwise modifies
+// the LZ77's storage.
+func (lz77 *LZ77) AdvanceAll(tokens []LZ77Token) int {
+	lz77.advanceAssertions()
+	for index := range tokens {
+		lastDist := lz77.lastDist
+		buf, matchDistance, matchLength, matchFound := lz77.advanceOne()
+		if buf == nil {
+			return index
+		}
+		tokens[index] = LZ77Token{
+			Bytes:          buf,
+			Distance:       matchDistance,
+			Length:         matchLength,
+			IsMatch:        matchFound,
+			IsRepeatOffset: matchFound && lastDist != 0 && uint64(matchDistance) == lastDist,
+		}
+	}
+	return len(tokens)
+}
+
+func (lz77 *LZ77) advanceAssertions() {
+	hbits := lz77.hbits
+	minLen := lz77.minLen
+	maxLen := lz77.maxLen
+	maxDist := lz77.maxDist
+	bsize := lz77.bsize
+	wsize := lz77.wsize
+	h := lz77.h
+	i := lz77.i
+	j := lz77.j
+	n := uint64(len(lz77.slice))
+
+	// The arguments to Assertf are boxed even when the assertion holds,
+	// which allocates, so they are only evaluated once a check has failed.
+	if h > i || i > j || (j-h) > n {
+		assert.Assertf(h <= i, "h %d > i %d", h, i)
+		assert.Assertf(i <= j, "i %d > j %d", i, j)
+		assert.Assertf((j-h) <= n, "j %d - h %d > n %d", j, h, n)
+	}
+
+	if maxLen == 0 {
+		if minLen != 0 || maxDist != 0 || hbits != 0 {
+			assert.Assertf(minLen == 0, "minLen %d != 0", minLen)
+			assert.Assertf(maxDist == 0, "maxDist %d != 0", maxDist)
+			assert.Assertf(hbits == 0, "hbits %d != 0", hbits)
+		}
+	} else {
+		assert.Assert(minLen > 0, "minLen == 0")
+		assert.Assert(maxDist > 0, "maxDist == 0")
+		if minLen > maxLen || maxLen > bsize || maxDist > wsize {
+			assert.Assertf(minLen <= maxLen, "minLen %d > maxLen %d", minLen, maxLen)
+			assert.Assertf(maxLen <= bsize, "maxLen %d > bsize %d", maxLen, bsize)
+			assert.Assertf(maxDist <= wsize, "maxDist %d > wsize %d", maxDist, wsize)
+		}
+	}
+
+	if hbits == 0 {
+		assert.Assert(lz77.htLastByHash.isNil(), "htLastByHash is unexpectedly non-nil")
+		assert.Assert(lz77.htPrevByIndex.isNil(), "htPrevByIndex is unexpectedly non-nil")
+	} else {
+		if minLen < hashLen {
+			assert.Assertf(minLen >= hashLen, "minLen %d > hashLen %d", minLen, hashLen)
+		}
+		assert.Assert(!lz77.htLastByHash.isNil(), "htLastByHash is unexpectedly nil")
+		assert.Assert(!lz77.htPrevByIndex.isNil(), "htPrevByIndex is unexpectedly nil")
+	}
+}
+
+func (lz77 *LZ77) advanceOne() (buf []byte, matchDistance uint, matchLength uint, matchFound bool) {
+	if lz77.notFinal && lz77.needsInput() {
+		return
+	}
+
+	switch {
+	case lz77.maxLen == 0 || lz77.noMatch:
+		buf, matchDistance, matchLength, matchFound = lz77.advanceByte()
+	case lz77.hbits == 0:
+		buf, matchDistance, matchLength, matchFound = lz77.advanceNoHash()
+	default:
+		buf, matchDistance, matchLength, matchFound = lz77.advanceStandard()
+	}
+
+	if matchFound {
+		lz77.lastDist = uint64(matchDistance)
+	}
+	if stats := lz77.stats; stats != nil {
+		stats.count(uint(len(buf)), matchDistance, matchLength, matchFound)
+	}
+	return
+}
+
+// MatchCandidates fills dst with the candidates in the hash chain for the
+// current position, in the order in which Advance would examine them, and
+// returns the number of candidates filled.  It does not modify the LZ77.  If
+// the chain leads to a candidate which precedes the start of the Window, it
+// is reported last, with TooOld set.  Advance may examine fewer candidates
+// than are reported, due to MaxChainLength or upon finding a match of the
+// maximum length.  Returns 0 if hashing is disabled, if matching is disabled,
+// or if the Buffer holds too few bytes to hash.
+func (lz77 LZ77) MatchCandidates(dst []LZ77Candidate) int {
+	h := lz77.h
+	i := lz77.i
+	j := lz77.j
+	if lz77.htLastByHash.isNil() || lz77.noMatch || (j-i) < hashLen {
+		return 0
+	}
+
+	maxLen := lz77.maxLen
+	if used := lz77.usable(); maxLen > used {
+		maxLen = used
+	}
+
+	count := 0
+	lastPlusOne := i + 1
+	currPlusOne := lz77.htLastByHash.get(uint64(lz77.hashAt(i)))
+	for count < len(dst) && currPlusOne != 0 && currPlusOne < lastPlusOne {
+		curr := currPlusOne - 1
+		distance := (i - curr)
+		if currPlusOne <= h {
+			dst[count] = LZ77Candidate{Distance: uint(distance), TooOld: true}
+			count++
+			break
+		}
+		dst[count] = LZ77Candidate{
+			Distance: uint(distance),
+			Length:   uint(lz77.matchLen(curr, i, maxLen)),
+			TooClose: distance < lz77.minDist,
+		}
+		count++
+		lastPlusOne = currPlusOne
+		currPlusOne = lz77.htPrevByIndex.get(lz77.phys(curr))
+	}
+	return count
+}
+
+// LastMatchDistance returns the distance of the most recent match returned
+// by Advance, or 0 if there has been no match since Init, Reset, or Clear.
+func (lz77 LZ77) LastMatchDistance() uint {
+	return uint(lz77.lastDist)
+}
+
+// Skip consumes up to n bytes from the Buffer as literals in a single step,
+// as if by that many calls to Advance which found no match, and returns a
+// view of the consumed bytes (or a copy, if they wrap around the end of the
+// circular buffer).  This is much faster than calling Advance in a
+// loop, and is intended for regions which are known to be incompressible.
+// The skipped bytes still enter the Window and are hashed, so later matches
+// can refer to them.  If the Buffer is empty and n is non-zero, ErrEmpty is
+// returned.
+func (lz77 *LZ77) Skip(n uint) ([]byte, error) {
+	if n == 0 {
+		return nil, nil
+	}
+
+	i := lz77.i
+	j := lz77.j
+	if i == j {
+		return nil, ErrEmpty
+	}
+
+	if used := uint(j - i); n > used {
+		n = used
+	}
+	iPrime := i + uint64(n)
+
+	// Advance would hash the first few bytes of a run densely, even with
+	// a HashInsertStride, so consume those separately.
+	litRun := lz77.litRun
+	mid := i
+	if stride := lz77.stride; stride > 1 && litRun+1 < stride {
+		mid = i + (stride - 1 - litRun)
+		if mid > iPrime {
+			mid = iPrime
+		}
+	}
+
+	x, y := lz77.span(i, iPrime)
+	for _, next := range [2]uint64{mid, iPrime} {
+		curr := lz77.i
+		if next == curr {
+			continue
+		}
+		lz77.slide(next)
+		lz77.countLiterals(next - curr)
+		lz77.windowUpdateRegion(curr)
+	}
+	buf := joinBytes(x, y)
+	if stats := lz77.stats; stats != nil {
+		stats.count(n, 0, 0, false)
+	}
+	return buf, nil
+}
+
+// AdvanceLiteralRun consumes up to n bytes from the Buffer as literals, so
+// long as Advance would have returned each of them as a literal, and returns
+// a view of the consumed bytes (or a copy, if they wrap around the end of the
+// circular buffer).  The run stops early at the first position which might
+// begin a match, leaving it for Advance; if that is the current position, nil
+// is returned.  Afterward, the LZ77 is in exactly the state it would have
+// reached by calling Advance once per byte.
+//
+// This is much faster than calling Advance on incompressible input, because
+// a position with an empty hash chain is rejected without a search.  Without
+// hashing, every position with a non-empty Window might begin a match, so
+// the run ends as soon as the Window fills past MinMatchDistance.
+func (lz77 *LZ77) AdvanceLiteralRun(n uint) []byte {
+	i := lz77.i
+	j := lz77.j
+	if used := uint(j - i); n > used {
+		n = used
+	}
+
+	// The storage for the run must be located before sliding the Window,
+	// as doing so may begin a new pass through the circular buffer.
+	iEnd := i + uint64(n)
+	x, y := lz77.span(i, iEnd)
+	for lz77.i < iEnd && !lz77.needsInput() && !lz77.mayMatch() {
+		curr := lz77.i
+		lz77.slide(curr + 1)
+		lz77.countLiteral()
+		lz77.windowUpdateRegion(curr)
+	}
+
+	if lz77.i == i {
+		return nil
+	}
+	count := uint(lz77.i - i)
+	if stats := lz77.stats; stats != nil {
+		stats.count(count, 0, 0, false)
+	}
+	if count <= uint(len(x)) {
+		return x[:count]
+	}
+	return joinBytes(x, y[:count-uint(len(x))])
+}
+
+// mayMatch returns false if Advance would certainly return a literal at the
+// current position.
+func (lz77 *LZ77) mayMatch() bool {
+	if lz77.maxLen == 0 || lz77.noMatch {
+		return false
+	}
+
+	maxLen := lz77.maxLen
+	if used := lz77.usable(); maxLen > used {
+		maxLen = used
+	}
+	if lz77.minLen > maxLen {
+		return false
+	}
+
+	h := lz77.h
+	i := lz77.i
+	if lz77.score == nil {
+		var found bool
+		var distance, length uint64
+		lz77.advanceCheckRepeat(maxLen, &found, &distance, &length)
+		if found {
+			return true
+		}
+	}
+
+	if lz77.htLastByHash.isNil() {
+		return (i - h) >= lz77.minDist
+	}
+
+	currPlusOne := lz77.htLastByHash.get(uint64(lz77.hashAt(i)))
+	return currPlusOne > h && currPlusOne <= i
+}
+
+func (stats *LZ77Stats) count(bufLen uint, matchDistance uint, matchLength uint, matchFound bool) {
+	if !matchFound {
+		stats.Literals += uint64(bufLen)
+		return
+	}
+
+	// Any bytes of the match beyond buf were absorbed from earlier
+	// literals by backward extension.  Those literals may have been
+	// counted before the statistics were last reset.
+	absorbed := uint64(matchLength - bufLen)
+	if absorbed > stats.Literals {
+		absorbed = stats.Literals
+	}
+	stats.Literals -= absorbed
+	stats.Matches++
+	stats.MatchBytes += uint64(matchLength)
+	stats.LengthHistogram[bits.Len(matchLength)]++
+	stats.DistanceHistogram[bits.Len(matchDistance)]++
+}
+
+// WindowBytesView returns a slice into the LZ77's Window's contents.  If the
+// Window wraps around the end of the LZ77's circular buffer, a copy is
+// returned instead.
+func (lz77 LZ77) WindowBytesView() []byte {
+	return lz77.view(lz77.h, lz77.i)
+}
+
+// WindowBytes allocates and returns a copy of the LZ77's Window's contents.
+func (lz77 LZ77) WindowBytes() []byte {
+	shared := lz77.WindowBytesView()
+	result := make([]byte, len(shared))
+	copy(result, shared)
+	return result
+}
+
+// BufferBytesView returns a slice into the LZ77's Buffer's contents.  If the
+// Buffer wraps around the end of the LZ77's circular buffer, a copy is
+// returned instead.
+func (lz77 LZ77) BufferBytesView() []byte {
+	return lz77.view(lz77.i, lz77.j)
+}
+
+// BufferBytes allocates and returns a copy of the LZ77's Buffer's contents.
+func (lz77 LZ77) BufferBytes() []byte {
+	shared := lz77.BufferBytesView()
+	result := make([]byte, len(shared))
+	copy(result, shared)
+	return result
+}
+
+func (lz77 *LZ77) advanceByte() (buf []byte, matchDistance uint, matchLength uint, matchFound bool) {
+	i := lz77.i
+	j := lz77.j
+	iPrime := i + 1
+	if iPrime > j {
+		return
+	}
+
+	buf = lz77.consume(iPrime)
+	lz77.countLiteral()
+	return
+}
+
+func (lz77 *LZ77) advanceNoHash() (buf []byte, matchDistance uint, matchLength uint, matchFound bool) {
+	return lz77.advanceSearch(false)
+}
+
+func (lz77 *LZ77) advanceStandard() (buf []byte, matchDistance uint, matchLength uint, matchFound bool) {
+	return lz77.advanceSearch(true)
+}
+
+// advanceSearch implements Advance using either searchHashed or searchNoHash,
+// which find the best match at the current position without modifying the
+// LZ77.
+func (lz77 *LZ77) advanceSearch(hashed bool) (buf []byte, matchDistance uint, matchLength uint, matchFound bool) {
+	maxLen := lz77.maxLen
+	i := lz77.i
+	j := lz77.j
+
+	iPrime := i + 1
+	if iPrime > j {
+		return
+	}
+
+	if used := lz77.usable(); maxLen > used {
+		maxLen = used
+	}
+
+	var bestFound bool
+	var bestDistance, bestLength uint64
+	var bestScore int
+	switch {
+	case !hashed:
+		bestFound, bestDistance, bestLength, bestScore = lz77.searchNoHash(maxLen)
+	case lz77.selfCheck:
+		bestFound, bestDistance, bestLength, bestScore = lz77.searchSelfCheck(maxLen)
+	default:
+		bestFound, bestDistance, bestLength, bestScore = lz77.searchHashed(maxLen)
+	}
+
+	scored := (lz77.score != nil)
+	if !scored {
+		lz77.advanceCheckRepeat(maxLen, &bestFound, &bestDistance, &bestLength)
+	}
+
+	if scored && bestFound && bestScore < lz77.minScore {
+		bestFound = false
+	}
+
+	if bestFound {
+		matchFound = true
+		matchDistance = uint(bestDistance)
+		matchLength = uint(bestLength + lz77.extendBackward(bestDistance, bestLength))
+		iPrime = i + bestLength
+		lz77.litRun = 0
+	} else {
+		lz77.countLiteral()
+	}
+
+	buf = lz77.consume(iPrime)
+	return
+}
+
+// searchNoHash finds the best match by examining every candidate in the
+// Window, newest first.
+func (lz77 *LZ77) searchNoHash(maxLen uint64) (bestFound bool, bestDistance uint64, bestLength uint64, bestScore int) {
+	h := lz77.h
+	i := lz77.i
+	scored := (lz77.score != nil)
+
+	if skip := lz77.minDist - 1; lz77.minLen <= maxLen && (i-h) > skip {
+		chain := lz77.maxChain
+		curr := i - skip
+		for curr > h {
+			curr--
+			if scored {
+				lz77.advanceCheckScored(curr, maxLen, &bestFound, &bestDistance, &bestLength, &bestScore)
+			} else if lz77.advanceCheckMatch(curr, maxLen, &bestFound, &bestDistance, &bestLength) {
+				break
+			}
+			// A limit of 0 wraps around here to 2**64 - 1, which exceeds
+			// the number of positions in any Window.
+			if chain--; chain == 0 {
+				break
+			}
+		}
+	}
+	return
+}
+
+// searchHashed finds the best match by examining the candidates in the hash
+// chain for the current position, newest first.
+func (lz77 *LZ77) searchHashed(maxLen uint64) (bestFound bool, bestDistance uint64, bestLength uint64, bestScore int) {
+	h := lz77.h
+	i := lz77.i
+	scored := (lz77.score != nil)
+
+	if lz77.minLen <= maxLen {
+		hash := lz77.hashAt(i)
+		lastPlusOne := i + 1
+		currPlusOne := lz77.htLastByHash.get(uint64(hash))
+		chain := lz77.maxChain
+		for currPlusOne > h && currPlusOne < lastPlusOne {
+			curr := currPlusOne - 1
+			if scored {
+				lz77.advanceCheckScored(curr, maxLen, &bestFound, &bestDistance, &bestLength, &bestScore)
+			} else if lz77.advanceCheckMatch(curr, maxLen, &bestFound, &bestDistance, &bestLength) {
+				break
+			}
+			if chain--; chain == 0 {
+				break
+			}
+			lastPlusOne = currPlusOne
+			currPlusOne = lz77.htPrevByIndex.get(lz77.phys(curr))
+		}
+	}
+	return
+}
+
+// searchSelfCheck is like searchHashed, but also performs the search which
+// searchNoHash would have performed, and panics if the hashed search found
+// an invalid match or missed a longer one.
+func (lz77 *LZ77) searchSelfCheck(maxLen uint64) (bestFound bool, bestDistance uint64, bestLength uint64, bestScore int) {
+	bestFound, bestDistance, bestLength, bestScore = lz77.searchHashed(maxLen)
+	if err := lz77.checkSearch(maxLen, bestFound, bestDistance, bestLength); err != nil {
+		panic(fmt.Errorf("%w\n%s", err, lz77.DebugString()))
+	}
+	return
+}
+
+// checkSearch verifies the result of searchHashed against searchNoHash.
+func (lz77 *LZ77) checkSearch(maxLen uint64, found bool, distance uint64, length uint64) error {
+	h := lz77.h
+	i := lz77.i
+
+	if found {
+		if distance < lz77.minDist || distance > (i-h) {
+			return fmt.Errorf("%w: hashed search at position %d returned distance %d outside of [%d, %d]", ErrInvariant, i, distance, lz77.minDist, i-h)
+		}
+		if length < lz77.minLen || length > maxLen {
+			return fmt.Errorf("%w: hashed search at position %d returned length %d outside of [%d, %d]", ErrInvariant, i, length, lz77.minLen, maxLen)
+		}
+		if actual := lz77.matchLen(i-distance, i, length); actual != length {
+			return fmt.Errorf("%w: hashed search at position %d returned match (%d, %d), but only %d bytes match", ErrInvariant, i, distance, length, actual)
+		}
+	}
+
+	// With a chain limit, a nice length, sparse hashing, or a ScoreMatch
+	// function, the two searches may legitimately disagree about which
+	// candidate is best.
+	if lz77.maxChain != 0 || lz77.niceLen < lz77.maxLen || lz77.stride > 1 || lz77.score != nil {
+		return nil
+	}
+
+	expectFound, expectDistance, expectLength, _ := lz77.searchNoHash(maxLen)
+	if expectFound && (!found || length < expectLength) {
+		return fmt.Errorf("%w: hashed search at position %d returned match (%d, %d) found=%t, but exhaustive search found (%d, %d)", ErrInvariant, i, distance, length, found, expectDistance, expectLength)
+	}
+	return nil
+}
+
+func (lz77 *LZ77) advanceCheckMatch(curr uint64, maxLen uint64, bestFoundPtr *bool, bestDistancePtr *uint64, bestLengthPtr *uint64) bool {
+	bestFound := *bestFoundPtr
+	bestLength := *bestLengthPtr
+	i := lz77.i
+
+	distance := (i - curr)
+	if distance < lz77.minDist {
+		return false
+	}
+
+	if bestFound && lz77.at(curr+bestLength) != lz77.at(i+bestLength) {
+		return false
+	}
+
+	length := lz77.matchLen(curr, i, maxLen)
+	if length >= lz77.minLen && (!bestFound || length > bestLength) {
+		bestFound = true
+		bestLength = length
+		*bestFoundPtr = true
+		*bestDistancePtr = distance
+		*bestLengthPtr = length
+	}
+
+	return (bestFound && (bestLength >= maxLen || bestLength >= lz77.niceLen))
+}
+
+func (lz77 *LZ77) advanceCheckScored(curr uint64, maxLen uint64, bestFoundPtr *bool, bestDistancePtr *uint64, bestLengthPtr *uint64, bestScorePtr *int) {
+	i := lz77.i
+
+	distance := (i - curr)
+	if distance < lz77.minDist {
+		return
+	}
+
+	length := lz77.matchLen(curr, i, maxLen)
+	if length < lz77.minLen {
+		return
+	}
+
+	score := lz77.score(uint(distance), uint(length))
+	if *bestFoundPtr && score <= *bestScorePtr {
+		return
+	}
+
+	*bestFoundPtr = true
+	*bestDistancePtr = distance
+	*bestLengthPtr = length
+	*bestScorePtr = score
+}
+
+// advanceCheckRepeat applies RepeatOffsetBias, replacing the best match with
+// the match at the previous match's distance if the latter is nearly as long.
+func (lz77 *LZ77) advanceCheckRepeat(maxLen uint64, bestFoundPtr *bool, bestDistancePtr *uint64, bestLengthPtr *uint64) {
+	bias := lz77.repBias
+	distance := lz77.lastDist
+	if bias == 0 || distance == 0 || distance < lz77.minDist || distance > (lz77.i-lz77.h) {
+		return
+	}
+	if *bestFoundPtr && *bestDistancePtr == distance {
+		return
+	}
+
+	i := lz77.i
+	length := lz77.matchLen(i-distance, i, maxLen)
+	if length < lz77.minLen || (*bestFoundPtr && length+bias <= *bestLengthPtr) {
+		return
+	}
+
+	*bestFoundPtr = true
+	*bestDistancePtr = distance
+	*bestLengthPtr = length
+}
+
+const minInt = -int(^uint(0)>>1) - 1
+
+const lz77BinaryVersion = 2
+
+const (
+	lz77SumNone = iota
+	lz77SumCRC32
+	lz77SumAdler32
+)
+
+const (
+	lz77FlagBackExt  = 0x01
+	lz77FlagNoMatch  = 0x02
+	lz77FlagNotFinal = 0x04
+)
+
+func cloneBytes(in []byte) []byte {
+	if in == nil {
+		return nil
+	}
+	out := make([]byte, len(in))
+	copy(out, in)
+	return out
+}
+
+func reverseBytes(slice []byte) {
+	for a, b := 0, len(slice)-1; a < b; a, b = a+1, b-1 {
+		slice[a], slice[b] = slice[b], slice[a]
+	}
+}
+
+// rotateBytes rotates slice left by n elements.
+func rotateBytes(slice []byte, n uint64) {
+	reverseBytes(slice[:n])
+	reverseBytes(slice[n:])
+	reverseBytes(slice)
+}
+
+// lz77Table is a hash table or hash chain array of positions plus one.  The
+// entries are 32 bits wide if every position fits, halving the memory used,
+// and 64 bits wide otherwise; see lz77WideTables.
+type lz77Table struct {
+	narrow []uint32
+	wide   []uint64
+}
+
+// lz77WideTables returns true iff an LZ77 with n bytes of storage needs 64-bit
+// hash tables.  With 32-bit tables, rebase must renumber every position each
+// time the origin passes 2**32 - 2n, so they are reserved for LZ77s small
+// enough that this happens no more often than every 2**31 bytes.
+func lz77WideTables(n uint64) bool {
+	return n > lz77NarrowMax
+}
+
+const lz77NarrowMax = 1 << 30
+
+func makeLZ77Table(length uint64, wide bool) lz77Table {
+	if wide {
+		return lz77Table{wide: make([]uint64, length)}
+	}
+	return lz77Table{narrow: make([]uint32, length)}
+}
+
+func (table lz77Table) isNil() bool {
+	return table.narrow == nil && table.wide == nil
+}
+
+func (table lz77Table) isWide() bool {
+	return table.wide != nil
+}
+
+func (table lz77Table) len() uint64 {
+	if table.wide != nil {
+		return uint64(len(table.wide))
+	}
+	return uint64(len(table.narrow))
+}
+
+func (table lz77Table) get(index uint64) uint64 {
+	if table.wide != nil {
+		return table.wide[index]
+	}
+	return uint64(table.narrow[index])
+}
+
+func (table lz77Table) set(index uint64, value uint64) {
+	if table.wide != nil {
+		table.wide[index] = value
+		return
+	}
+	table.narrow[index] = uint32(value)
+}
+
+func (table lz77Table) zero() {
+	bzero.Uint32(table.narrow)
+	bzero.Uint64(table.wide)
+}
+
+func (table lz77Table) clone() lz77Table {
+	var out lz77Table
+	if table.narrow != nil {
+		out.narrow = make([]uint32, len(table.narrow))
+		copy(out.narrow, table.narrow)
+	}
+	if table.wide != nil {
+		out.wide = make([]uint64, len(table.wide))
+		copy(out.wide, table.wide)
+	}
+	return out
+}
+
+// usable returns the number of bytes in the Buffer which a match may cover.
+func (lz77 LZ77) usable() uint64 {
+	used := (lz77.j - lz77.i)
+	if tailLen := lz77.tailLen; used > tailLen {
+		return used - tailLen
+	}
+	return 0
+}
+
+func (lz77 *LZ77) countLiteral() {
+	if lz77.litRun < lz77.wsize {
+		lz77.litRun++
+	}
+}
+
+func (lz77 *LZ77) countLiterals(count uint64) {
+	if room := lz77.wsize - lz77.litRun; count > room {
+		count = room
+	}
+	lz77.litRun += count
+}
+
+func (lz77 *LZ77) extendBackward(distance uint64, length uint64) uint64 {
+	if !lz77.backExt {
+		return 0
+	}
+
+	h := lz77.h
+	i := lz77.i
+	curr := i - distance
+
+	limit := lz77.litRun
+	if x := lz77.maxLen - length; limit > x {
+		limit = x
+	}
+	if x := curr - h; limit > x {
+		limit = x
+	}
+
+	n := uint64(0)
+	for n < limit && lz77.at(curr-n-1) == lz77.at(i-n-1) {
+		n++
+	}
+	return n
+}
+
+func (lz77 *LZ77) windowUpdateRegion(index uint64) {
+	if lz77.htLastByHash.isNil() || lz77.noMatch {
+		return
+	}
+
+	slice := lz77.slice
+	n := uint64(len(slice))
+	h := lz77.h
+	end := lz77.hashEnd()
+
+	if index < h {
+		index = h
+	}
+
+	if stride := lz77.stride; stride > 1 && lz77.litRun >= stride {
+		lz77.windowUpdateSparse(index, end, stride)
+		return
+	}
+
+	p := lz77.phys(index)
+	for index < end {
+		var hash uint32
+		if p+hashLen <= n {
+			hash = hash4(slice[p:p+hashLen], lz77.hashMask)
+		} else {
+			hash = lz77.hashAt(index)
+		}
+		prevPlusOne := lz77.htLastByHash.get(uint64(hash))
+		indexPlusOne := index + 1
+		lz77.htLastByHash.set(uint64(hash), indexPlusOne)
+		lz77.htPrevByIndex.set(p, prevPlusOne)
+		index++
+		if p++; p == n {
+			p = 0
+		}
+	}
+}
+
+// windowUpdateSparse is like windowUpdateRegion, but hashes only those
+// positions which are multiples of stride.
+func (lz77 *LZ77) windowUpdateSparse(index uint64, end uint64, stride uint64) {
+	if rem := index % stride; rem != 0 {
+		index += stride - rem
+	}
+	slice := lz77.slice
+	n := uint64(len(slice))
+	for index < end {
+		var hash uint32
+		p := lz77.phys(index)
+		if p+hashLen <= n {
+			hash = hash4(slice[p:p+hashLen], lz77.hashMask)
+		} else {
+			hash = lz77.hashAt(index)
+		}
+		prevPlusOne := lz77.htLastByHash.get(uint64(hash))
+		lz77.htLastByHash.set(uint64(hash), index+1)
+		lz77.htPrevByIndex.set(p, prevPlusOne)
+		if index += stride; index < stride {
+			break
+		}
+	}
+}
+
+// windowUnhashRegion removes positions index through end from the hash
+// chains.  They must be the positions most recently added, so that each lies
+// at the head of its hash chain once all later positions are removed.
+func (lz77 *LZ77) windowUnhashRegion(index uint64, end uint64) {
+	if lz77.htLastByHash.isNil() || lz77.noMatch {
+		return
 	}
 
-	return lz77.slice[i:iPrime]
-}
-
-// CommitBulkRead completes the bulk read begun by the previous call to
-// PrepareBulkRead.  The argument must be between 0 and the length of the
-// slice returned by PrepareBulkRead.
-//
-func (lz77 *LZ77) CommitBulkRead(length uint) {
-	bsize := lz77.bsize
-	if length > uint(bsize) {
-		length = uint(bsize)
+	for end > index {
+		end--
+		hash := lz77.hashAt(end)
+		if lz77.htLastByHash.get(uint64(hash)) == end+1 {
+			lz77.htLastByHash.set(uint64(hash), lz77.htPrevByIndex.get(lz77.phys(end)))
+		}
 	}
+}
 
-	i := lz77.i
-	j := lz77.j
-	iPrime := i + uint32(length)
-	assert.Assertf(iPrime <= j, "length %d exceeds %d bytes of available data", length, j-i)
+// hashInsert adds position index to the head of its hash chain.
+func (lz77 *LZ77) hashInsert(index uint64) {
+	hash := lz77.hashAt(index)
+	lz77.htPrevByIndex.set(lz77.phys(index), lz77.htLastByHash.get(uint64(hash)))
+	lz77.htLastByHash.set(uint64(hash), index+1)
+}
 
-	hPrime := lz77.h
-	if hMin := (iPrime - lz77.maxDist); hPrime < hMin {
-		hPrime = hMin
+// hashEnd returns the position just past the last position in the Window
+// which is followed by enough data to be hashed.  All positions in the
+// Window before hashEnd are in the hash chains.
+func (lz77 *LZ77) hashEnd() uint64 {
+	h := lz77.h
+	end := lz77.i
+	if avail := (lz77.j - end); avail < hashLenSubOne {
+		short := hashLenSubOne - avail
+		if (end - h) < short {
+			return h
+		}
+		end -= short
 	}
+	return end
+}
 
-	lz77.h = hPrime
+// slide moves the boundary between the Window and the Buffer forward to
+// iPrime, discarding the oldest bytes from the Window as needed to keep its
+// length within MaxMatchDistance.
+func (lz77 *LZ77) slide(iPrime uint64) {
+	if lz77.sumKind != lz77SumNone {
+		lz77.updateChecksum(iPrime)
+	}
+	if (iPrime - lz77.h) > lz77.maxDist {
+		lz77.h = iPrime - lz77.maxDist
+		lz77.advanceOrigin()
+	}
 	lz77.i = iPrime
-	lz77.windowUpdateRegion(i)
 }
 
-// ReadByte reads a single byte, or returns ErrEmpty if the buffer is empty.
-func (lz77 *LZ77) ReadByte() (byte, error) {
-	i := lz77.i
-	j := lz77.j
-	iPrime := i + 1
-	if iPrime > j {
-		return 0, ErrEmpty
+// updateChecksum folds the bytes at positions i through iPrime into the
+// running checksum.
+func (lz77 *LZ77) updateChecksum(iPrime uint64) {
+	x, y := lz77.span(lz77.i, iPrime)
+	switch lz77.sumKind {
+	case lz77SumCRC32:
+		lz77.sum = crc32.Update(crc32.Update(lz77.sum, lz77.sumTable, x), lz77.sumTable, y)
+	case lz77SumAdler32:
+		lz77.sum = updateAdler32(updateAdler32(lz77.sum, x), y)
 	}
+}
 
-	hPrime := lz77.h
-	if hMin := (iPrime - lz77.maxDist); hPrime < hMin {
-		hPrime = hMin
+// updateAdler32 returns the result of adding the bytes of p to the Adler-32
+// checksum adler.  The hash/adler32 package offers no equivalent of
+// crc32.Update.
+func updateAdler32(adler uint32, p []byte) uint32 {
+	const mod = 65521
+
+	// nmax is the largest n such that 255n(n+1)/2 + (n+1)(mod-1) fits in a
+	// uint32, so that s2 cannot overflow between reductions.
+	const nmax = 5552
+
+	s1, s2 := adler&0xffff, adler>>16
+	for len(p) != 0 {
+		q := p
+		if len(q) > nmax {
+			q = q[:nmax]
+		}
+		p = p[len(q):]
+		for _, ch := range q {
+			s1 += uint32(ch)
+			s2 += s1
+		}
+		s1 %= mod
+		s2 %= mod
 	}
+	return s2<<16 | s1
+}
 
-	ch := lz77.slice[i]
-	lz77.h = hPrime
-	lz77.i = iPrime
+// consume is like slide, but also hashes the bytes which entered the Window
+// and returns a view of them.  The view is a copy iff the bytes wrap around
+// the end of the circular buffer, which happens at most once per pass.
+func (lz77 *LZ77) consume(iPrime uint64) []byte {
+	i := lz77.i
+	buf := lz77.view(i, iPrime)
+	lz77.slide(iPrime)
 	lz77.windowUpdateRegion(i)
-	return ch, nil
+	return buf
 }
 
-// Read reads a slice of bytes from the LZ77's Buffer.  If the buffer is
-// empty, ErrEmpty is returned.
-func (lz77 *LZ77) Read(data []byte) (int, error) {
-	length := uint(len(data))
-	if length == 0 {
-		return 0, nil
+// Positions
+// ---------
+//
+// The h, i, and j fields, as well as the entries in the hash chains, are
+// positions in the data stream, not indices into slice.  The org field holds
+// the position stored at index 0 during the current pass through the
+// circular buffer, so position pos is stored at index (pos - org) mod
+// len(slice).  As h always lies within the current pass, and j never leads h
+// by more than len(slice), phys needs at most one subtraction.
+
+// phys returns the index into slice which holds position pos.
+func (lz77 *LZ77) phys(pos uint64) uint64 {
+	index := pos - lz77.org
+	if n := uint64(len(lz77.slice)); index >= n {
+		index -= n
 	}
+	return index
+}
 
-	bsize := lz77.bsize
-	if length > uint(bsize) {
-		length = uint(bsize)
-		data = data[:length]
+// advanceOrigin begins a new pass through the circular buffer, if h has left
+// the current one.  It must be called whenever h moves forward.
+func (lz77 *LZ77) advanceOrigin() {
+	n := uint64(len(lz77.slice))
+	for (lz77.h - lz77.org) >= n {
+		lz77.org += n
 	}
+}
 
-	i := lz77.i
-	j := lz77.j
-	iPrime := i + uint32(length)
-	if iPrime > j {
-		iPrime = j
-		length = uint(iPrime - i)
-		data = data[:length]
-		if length == 0 {
-			return 0, ErrEmpty
+// moveRange copies the bytes at positions a through b to positions a+delta
+// through b+delta.  It works backward, in chunks which wrap around the end of
+// the circular buffer at neither the source nor the destination, so that the
+// ranges may overlap.
+func (lz77 *LZ77) moveRange(a uint64, b uint64, delta uint64) {
+	slice := lz77.slice
+	for b > a {
+		src := lz77.phys(b-1) + 1
+		dst := lz77.phys(b-1+delta) + 1
+		chunk := b - a
+		if chunk > src {
+			chunk = src
 		}
+		if chunk > dst {
+			chunk = dst
+		}
+		copy(slice[dst-chunk:dst], slice[src-chunk:src])
+		b -= chunk
 	}
-
-	hPrime := lz77.h
-	if hMin := (iPrime - lz77.maxDist); hPrime < hMin {
-		hPrime = hMin
-	}
-
-	lz77.h = hPrime
-	lz77.i = iPrime
-	copy(data, lz77.slice[i:iPrime])
-	lz77.windowUpdateRegion(i)
-	return int(length), nil
 }
 
-// Advance moves a slice of bytes from the LZ77's Buffer to its Window.  The
-// nature of the slice depends on the LZ77's prefix match settings, the
-// contents of the LZ77's Window, and the contents of the LZ77's Buffer.
-func (lz77 *LZ77) Advance() (buf []byte, matchDistance uint, matchLength uint, matchFound bool) {
-	hbits := lz77.hbits
-	minLen := lz77.minLen
-	maxLen := lz77.maxLen
-	maxDist := lz77.maxDist
-	bsize := lz77.bsize
-	wsize := lz77.wsize
-	h := lz77.h
-	i := lz77.i
-	j := lz77.j
-	n := uint32(len(lz77.slice))
-
-	assert.Assertf(h <= i, "h %d > i %d", h, i)
-	assert.Assertf(i <= j, "i %d > j %d", i, j)
-	assert.Assertf(j <= n, "j %d > n %d", j, n)
+// at returns the byte at position pos.
+func (lz77 *LZ77) at(pos uint64) byte {
+	return lz77.slice[lz77.phys(pos)]
+}
 
-	if maxLen == 0 {
-		assert.Assertf(minLen == 0, "minLen %d != 0", minLen)
-		assert.Assertf(maxDist == 0, "maxDist %d != 0", maxDist)
-		assert.Assertf(hbits == 0, "hbits %d != 0", hbits)
-	} else {
-		assert.Assert(minLen > 0, "minLen == 0")
-		assert.Assert(maxDist > 0, "maxDist == 0")
-		assert.Assertf(minLen <= maxLen, "minLen %d > maxLen %d", minLen, maxLen)
-		assert.Assertf(maxLen <= bsize, "maxLen %d > bsize %d", maxLen, bsize)
-		assert.Assertf(maxDist <= wsize, "maxDist %d > wsize %d", maxDist, wsize)
+// span returns the bytes at positions a through b as one or two slices,
+// depending on whether they wrap around the end of the circular buffer.
+func (lz77 *LZ77) span(a uint64, b uint64) ([]byte, []byte) {
+	slice := lz77.slice
+	n := uint64(len(slice))
+	p := lz77.phys(a)
+	q := p + (b - a)
+	if q <= n {
+		return slice[p:q], nil
 	}
+	return slice[p:], slice[:q-n]
+}
 
-	if hbits == 0 {
-		assert.Assert(lz77.htLastByHash == nil, "htLastByHash is unexpectedly non-nil")
-		assert.Assert(lz77.htPrevByIndex == nil, "htPrevByIndex is unexpectedly non-nil")
-	} else {
-		assert.Assertf(minLen >= hashLen, "minLen %d > hashLen %d", minLen, hashLen)
-		assert.NotNil(&lz77.htLastByHash)
-		assert.NotNil(&lz77.htPrevByIndex)
-	}
+// view is like span, but returns a single slice, allocating a copy iff the
+// bytes wrap around the end of the circular buffer.
+func (lz77 *LZ77) view(a uint64, b uint64) []byte {
+	return joinBytes(lz77.span(a, b))
+}
 
-	switch {
-	case lz77.maxLen == 0:
-		return lz77.advanceByte()
-	case lz77.hbits == 0:
-		return lz77.advanceNoHash()
-	default:
-		return lz77.advanceStandard()
+// joinBytes returns the concatenation of x and y, allocating only if y is
+// non-empty.
+func joinBytes(x []byte, y []byte) []byte {
+	if len(y) == 0 {
+		return x
 	}
+	out := make([]byte, len(x)+len(y))
+	copy(out[copy(out, x):], y)
+	return out
 }
 
-// WindowBytesView returns a slice into the Hybrid's Window's contents.
-func (lz77 LZ77) WindowBytesView() []byte {
-	return lz77.slice[lz77.h:lz77.i]
+// zeroOutside zeroes every byte of storage which does not hold one of the
+// positions a through b.
+func (lz77 *LZ77) zeroOutside(a uint64, b uint64) {
+	n := uint64(len(lz77.slice))
+	x, y := lz77.span(b, b+(n-(b-a)))
+	bzero.Uint8(x)
+	bzero.Uint8(y)
 }
 
-// WindowBytes allocates and returns a copy of the Hybrid's Window's contents.
-func (lz77 LZ77) WindowBytes() []byte {
-	shared := lz77.WindowBytesView()
-	result := make([]byte, len(shared))
-	copy(result, shared)
-	return shared
+// hashAt returns the hash of the hashLen bytes starting at position pos.
+func (lz77 *LZ77) hashAt(pos uint64) uint32 {
+	var tmp [hashLen]byte
+	x, y := lz77.span(pos, pos+hashLen)
+	if y == nil {
+		return hash4(x, lz77.hashMask)
+	}
+	copy(tmp[copy(tmp[:], x):], y)
+	return hash4(tmp[:], lz77.hashMask)
 }
 
-// BufferBytesView returns a slice into the Hybrid's Buffer's contents.
-func (lz77 LZ77) BufferBytesView() []byte {
-	return lz77.slice[lz77.i:lz77.j]
+// matchLen returns the number of leading bytes, up to limit, which are equal
+// at positions a and b.
+func (lz77 *LZ77) matchLen(a uint64, b uint64, limit uint64) uint64 {
+	slice := lz77.slice
+	n := uint64(len(slice))
+	p := lz77.phys(a)
+	q := lz77.phys(b)
+
+	length := uint64(0)
+	for length < limit {
+		run := limit - length
+		if x := n - p; run > x {
+			run = x
+		}
+		if x := n - q; run > x {
+			run = x
+		}
+
+		x := slice[p : p+run]
+		y := slice[q : q+run]
+		k := uint64(0)
+		for k < run && x[k] == y[k] {
+			k++
+		}
+		length += k
+		if k < run {
+			break
+		}
+
+		if p += run; p == n {
+			p = 0
+		}
+		if q += run; q == n {
+			q = 0
+		}
+	}
+	return length
 }
 
-// BufferBytes allocates and returns a copy of the Hybrid's Buffer's contents.
-func (lz77 LZ77) BufferBytes() []byte {
-	shared := lz77.BufferBytesView()
-	result := make([]byte, len(shared))
-	copy(result, shared)
-	return shared
+// rebase renumbers all positions to begin again from the start of the
+// circular buffer, when necessary to keep them from overflowing.  It must be
+// called before writing to the Buffer.
+func (lz77 *LZ77) rebase() {
+	limit := ^uint64(0)
+	if lz77.htPrevByIndex.narrow != nil {
+		limit = uint64(^uint32(0))
+	}
+	org := lz77.org
+	if org != 0 && org > limit-2*uint64(len(lz77.slice)) {
+		lz77.renumber(org)
+		lz77.org = 0
+	}
 }
 
-func (lz77 *LZ77) advanceByte() (buf []byte, matchDistance uint, matchLength uint, matchFound bool) {
+// relocate rotates storage so that the Window and Buffer are contiguous, with
+// the Buffer beginning at index wsize, and renumbers positions to match.  The
+// hash chains are left inconsistent, so the caller must rebuild them, as
+// windowReplaced does.
+func (lz77 *LZ77) relocate() {
+	n := uint64(len(lz77.slice))
+	wsize := lz77.wsize
 	i := lz77.i
-	j := lz77.j
-	iPrime := i + 1
-	if iPrime > j {
-		return
-	}
 
-	hPrime := lz77.h
-	if hMin := (iPrime - lz77.maxDist); hPrime < hMin {
-		hPrime = hMin
+	rot := lz77.phys(i) + n - wsize
+	if rot >= n {
+		rot -= n
 	}
+	rotateBytes(lz77.slice, rot)
 
-	buf = lz77.slice[i:iPrime]
-	lz77.h = hPrime
-	lz77.i = iPrime
-	lz77.windowUpdateRegion(i)
-	return
+	delta := i - wsize
+	lz77.org = 0
+	lz77.h -= delta
+	lz77.i -= delta
+	lz77.j -= delta
 }
 
-func (lz77 *LZ77) advanceNoHash() (buf []byte, matchDistance uint, matchLength uint, matchFound bool) {
-	slice := lz77.slice
-	minLen := lz77.minLen
-	maxLen := lz77.maxLen
+// renumber subtracts delta from every position.  Hash chain entries which
+// refer to positions outside the Window are zeroed.
+func (lz77 *LZ77) renumber(delta uint64) {
 	h := lz77.h
-	i := lz77.i
-	j := lz77.j
+	lz77.h = h - delta
+	lz77.i -= delta
+	lz77.j -= delta
 
-	iPrime := i + 1
-	if iPrime > j {
+	// While matching is disabled, the hash chains are rebuilt from scratch
+	// when it is re-enabled, so there is no point in renumbering them.
+	if lz77.htLastByHash.isNil() || lz77.noMatch {
 		return
 	}
 
-	if used := (j - i); maxLen > used {
-		maxLen = used
-	}
-
-	var bestFound bool
-	var bestDistance, bestLength uint32
-
-	if minLen <= maxLen {
-		curr := i
-		for curr > h {
-			curr--
-			if lz77.advanceCheckMatch(curr, maxLen, &bestFound, &bestDistance, &bestLength) {
-				break
+	for _, table := range [2]lz77Table{lz77.htLastByHash, lz77.htPrevByIndex} {
+		for index, length := uint64(0), table.len(); index < length; index++ {
+			if posPlusOne := table.get(index); posPlusOne > h {
+				table.set(index, posPlusOne-delta)
+			} else {
+				table.set(index, 0)
 			}
 		}
 	}
+}
 
-	if bestFound {
-		matchFound = true
-		matchDistance = uint(bestDistance)
-		matchLength = uint(bestLength)
-		iPrime = i + bestLength
-	}
-
-	hPrime := h
-	if hMin := (iPrime - lz77.maxDist); hPrime < hMin {
-		hPrime = hMin
+// Validate checks whether the LZ77Options can be passed to Init, which panics
+// if they cannot.  If not, a LZ77OptionsError listing every problem found is
+// returned.  Options which Init merely adjusts, such as a MaxMatchLength which
+// exceeds the buffer size, are not problems; see Normalize.
+func (opts LZ77Options) Validate() error {
+	if _, problems := opts.normalize(); len(problems) != 0 {
+		return LZ77OptionsError{Problems: problems}
 	}
-
-	buf = slice[i:iPrime]
-	lz77.h = hPrime
-	lz77.i = iPrime
-	lz77.windowUpdateRegion(i)
-	return
+	return nil
 }
 
-func (lz77 *LZ77) advanceStandard() (buf []byte, matchDistance uint, matchLength uint, matchFound bool) {
-	slice := lz77.slice
-	minLen := lz77.minLen
-	maxLen := lz77.maxLen
-	h := lz77.h
-	i := lz77.i
-	j := lz77.j
+// Normalize returns the LZ77Options which Init would actually use, after
+// applying its defaults and clamping rules.  For any LZ77Options which pass
+// Validate, NewLZ77(opts).Options() is Equal to opts.Normalize().  The result
+// is unspecified if Validate would fail.
+func (opts LZ77Options) Normalize() LZ77Options {
+	out, _ := opts.normalize()
+	return out
+}
 
-	iPrime := i + 1
-	if iPrime > j {
-		return
+func (opts LZ77Options) normalize() (LZ77Options, []string) {
+	var problems []string
+	bbits := opts.BufferNumBits
+	wbits := opts.WindowNumBits
+	hbits := opts.HashNumBits
+
+	// Out-of-range bit counts are clamped, so that the remaining options
+	// can still be checked and every problem reported at once.
+	if bbits < 2 {
+		problems = append(problems, fmt.Sprintf("BufferNumBits %d must be at least 2", bbits))
+		bbits = 2
 	}
-
-	if used := (j - i); maxLen > used {
-		maxLen = used
+	if bbits > lz77MaxBufferNumBits {
+		problems = append(problems, fmt.Sprintf("BufferNumBits %d must not exceed %d", bbits, lz77MaxBufferNumBits))
+		bbits = lz77MaxBufferNumBits
+	}
+	if wbits > lz77MaxWindowNumBits {
+		problems = append(problems, fmt.Sprintf("WindowNumBits %d must not exceed %d", wbits, lz77MaxWindowNumBits))
+		wbits = lz77MaxWindowNumBits
+	}
+	if hbits > 32 {
+		problems = append(problems, fmt.Sprintf("HashNumBits %d must not exceed 32", hbits))
+		hbits = 32
 	}
 
-	var bestFound bool
-	var bestDistance, bestLength uint32
+	bsize := (uint(1) << bbits)
+	wsize := (uint(1) << wbits)
 
-	if minLen <= maxLen {
-		hash := hash4(slice[i:i+hashLen], lz77.hashMask)
-		lastPlusOne := i + 1
-		currPlusOne := lz77.htLastByHash[hash]
-		for currPlusOne > h && currPlusOne < lastPlusOne {
-			curr := currPlusOne - 1
-			if lz77.advanceCheckMatch(curr, maxLen, &bestFound, &bestDistance, &bestLength) {
-				break
-			}
-			lastPlusOne = currPlusOne
-			currPlusOne = lz77.htPrevByIndex[curr]
+	maxLen := bsize
+	if opts.HasMaxMatchLength {
+		maxLen = opts.MaxMatchLength
+		if maxLen > bsize {
+			maxLen = bsize
 		}
 	}
 
-	if bestFound {
-		matchFound = true
-		matchDistance = uint(bestDistance)
-		matchLength = uint(bestLength)
-		iPrime = i + bestLength
+	minLen := uint(hashLen)
+	if opts.HasMinMatchLength {
+		minLen = opts.MinMatchLength
+		if minLen > bsize {
+			problems = append(problems, fmt.Sprintf("MinMatchLength %d > buffer capacity %d", minLen, bsize))
+		}
 	}
 
-	hPrime := h
-	if hMin := (iPrime - lz77.maxDist); hPrime < hMin {
-		hPrime = hMin
+	maxDist := wsize
+	if opts.HasMaxMatchDistance {
+		maxDist = opts.MaxMatchDistance
+		if maxDist > wsize {
+			maxDist = wsize
+		}
 	}
 
-	buf = slice[i:iPrime]
-	lz77.h = hPrime
-	lz77.i = iPrime
-	lz77.windowUpdateRegion(i)
-	return
-}
-
-func (lz77 *LZ77) advanceCheckMatch(curr uint32, maxLen uint32, bestFoundPtr *bool, bestDistancePtr *uint32, bestLengthPtr *uint32) bool {
-	bestFound := *bestFoundPtr
-	bestDistance := *bestDistancePtr
-	bestLength := *bestLengthPtr
+	maxChain := uint(0)
+	if opts.HasMaxChainLength {
+		maxChain = opts.MaxChainLength
+	}
 
-	slice := lz77.slice
-	minLen := lz77.minLen
-	i := lz77.i
+	tailLen := opts.TailLiteralBytes
+	if tailLen > bsize {
+		tailLen = bsize
+	}
 
-	if bestFound && slice[curr+bestLength] != slice[i+bestLength] {
-		return false
+	repBias := opts.RepeatOffsetBias
+	if repBias > bsize {
+		repBias = bsize
 	}
 
-	for index := uint32(0); index < maxLen && slice[curr+index] == slice[i+index]; index++ {
-		lenSoFar := index + 1
-		if lenSoFar >= minLen && (!bestFound || lenSoFar > bestLength) {
-			bestDistance = (i - curr)
-			bestLength = lenSoFar
-			bestFound = true
-		}
+	minDist := uint(1)
+	if opts.HasMinMatchDistance && opts.MinMatchDistance != 0 {
+		minDist = opts.MinMatchDistance
 	}
 
-	*bestFoundPtr = bestFound
-	*bestDistancePtr = bestDistance
-	*bestLengthPtr = bestLength
+	minScore := minInt
+	if opts.ScoreMatch != nil && opts.HasMinMatchScore {
+		minScore = opts.MinMatchScore
+	}
 
-	return (bestFound && bestLength >= maxLen)
-}
+	if maxLen == 0 || maxDist == 0 {
+		minLen = 0
+		maxLen = 0
+		maxDist = 0
+		minDist = 0
+		hbits = 0
+	}
 
-func (lz77 *LZ77) windowUpdateRegion(index uint32) {
-	if lz77.htLastByHash == nil {
-		return
+	if minLen == 0 && maxLen != 0 {
+		minLen = 1
 	}
 
-	slice := lz77.slice
-	h := lz77.h
-	i := lz77.i
-	j := lz77.j
+	niceLen := opts.NiceMatchLength
+	if niceLen == 0 || niceLen > maxLen {
+		niceLen = maxLen
+	}
 
-	if index < h {
-		index = h
+	stride := opts.HashInsertStride
+	if stride == 0 {
+		stride = 1
+	}
+	if stride > uint(^uint32(0)) {
+		stride = uint(^uint32(0))
 	}
 
-	end := j - hashLenSubOne
-	if end > i {
-		end = i
+	if minDist > maxDist {
+		problems = append(problems, fmt.Sprintf("MinMatchDistance %d > MaxMatchDistance %d", minDist, maxDist))
 	}
 
-	for index < end {
-		hash := hash4(slice[index:index+hashLen], lz77.hashMask)
-		prevPlusOne := lz77.htLastByHash[hash]
-		indexPlusOne := index + 1
-		lz77.htLastByHash[hash] = indexPlusOne
-		lz77.htPrevByIndex[index] = prevPlusOne
-		index++
+	if minLen < hashLen {
+		hbits = 0
 	}
-}
 
-func (lz77 *LZ77) shift(n uint32) {
-	wsize := lz77.wsize
-	slice := lz77.slice
-	h := lz77.h
-	i := lz77.i
-	j := lz77.j
-	k := j + n
-	if k <= uint32(len(slice)) {
-		return
+	// A MinMatchLength beyond the buffer capacity has already been
+	// reported, and would otherwise be reported twice.
+	if minLen > maxLen && minLen <= bsize {
+		problems = append(problems, fmt.Sprintf("MinMatchLength %d > MaxMatchLength %d", minLen, maxLen))
 	}
 
-	windowLen := (i - h)
-	bufferLen := (j - i)
+	out := LZ77Options{
+		BufferNumBits:       bbits,
+		WindowNumBits:       wbits,
+		HashNumBits:         hbits,
+		MinMatchLength:      minLen,
+		MaxMatchLength:      maxLen,
+		MaxMatchDistance:    maxDist,
+		HasMinMatchLength:   true,
+		HasMaxMatchLength:   true,
+		HasMaxMatchDistance: true,
+
+		MaxChainLength:    maxChain,
+		HasMaxChainLength: true,
 
-	iPrime := wsize
-	hPrime := (iPrime - windowLen)
-	jPrime := (iPrime + bufferLen)
+		MinMatchDistance:    minDist,
+		HasMinMatchDistance: true,
 
-	copy(slice[hPrime:jPrime], slice[h:j])
-	bzero.Uint8(slice[:hPrime])
-	bzero.Uint8(slice[jPrime:])
+		TailLiteralBytes: tailLen,
 
-	lz77.h = hPrime
-	lz77.i = iPrime
-	lz77.j = jPrime
+		ScoreMatch:       opts.ScoreMatch,
+		MinMatchScore:    minScore,
+		HasMinMatchScore: true,
 
-	if lz77.htLastByHash == nil {
-		return
-	}
+		RepeatOffsetBias: repBias,
 
-	delta := h - hPrime
-	for hash, lastPlusOne := range lz77.htLastByHash {
-		if lastPlusOne > h && lastPlusOne <= i {
-			lz77.htLastByHash[hash] = (lastPlusOne - delta)
-		} else {
-			lz77.htLastByHash[hash] = 0
-		}
-	}
+		NiceMatchLength: niceLen,
 
-	bzero.Uint32(lz77.htPrevByIndex[0:hPrime])
-	for index := hPrime; index < iPrime; index++ {
-		prevPlusOne := lz77.htPrevByIndex[index]
-		if prevPlusOne > h && prevPlusOne <= i {
-			lz77.htPrevByIndex[index] = prevPlusOne - delta
-		} else {
-			lz77.htPrevByIndex[index] = 0
-		}
+		HashInsertStride: stride,
+
+		BackwardMatchExtension: opts.BackwardMatchExtension,
 	}
-	bzero.Uint32(lz77.htPrevByIndex[iPrime:])
+	return out, problems
 }
 
 // Equal returns true iff the given LZ77Options is semantically equal to this one.
+// As Go cannot compare functions, Equal checks only whether ScoreMatch is set
+// in both or neither: any two non-nil ScoreMatch functions are considered
+// equal, even if they score matches differently.
 func (opts LZ77Options) Equal(other LZ77Options) bool {
 	ok := true
 	ok = ok && (opts.BufferNumBits == other.BufferNumBits)
@@ -845,6 +3097,15 @@ func (opts LZ77Options) Equal(other LZ77Options) bool {
 	ok = ok && (opts.HasMinMatchLength == other.HasMinMatchLength)
 	ok = ok && (opts.HasMaxMatchLength == other.HasMaxMatchLength)
 	ok = ok && (opts.HasMaxMatchDistance == other.HasMaxMatchDistance)
+	ok = ok && (opts.HasMaxChainLength == other.HasMaxChainLength)
+	ok = ok && (opts.HasMinMatchDistance == other.HasMinMatchDistance)
+	ok = ok && (opts.TailLiteralBytes == other.TailLiteralBytes)
+	ok = ok && ((opts.ScoreMatch == nil) == (other.ScoreMatch == nil))
+	ok = ok && (opts.HasMinMatchScore == other.HasMinMatchScore)
+	ok = ok && (opts.RepeatOffsetBias == other.RepeatOffsetBias)
+	ok = ok && (opts.NiceMatchLength == other.NiceMatchLength)
+	ok = ok && (opts.HashInsertStride == other.HashInsertStride)
+	ok = ok && (opts.BackwardMatchExtension == other.BackwardMatchExtension)
 	ok = ok && opts.equalPartTwo(other)
 	return ok
 }
@@ -860,9 +3121,33 @@ func (opts LZ77Options) equalPartTwo(other LZ77Options) bool {
 	if opts.HasMaxMatchDistance && other.HasMaxMatchDistance {
 		ok = ok && (opts.MaxMatchDistance == other.MaxMatchDistance)
 	}
+	if opts.HasMaxChainLength && other.HasMaxChainLength {
+		ok = ok && (opts.MaxChainLength == other.MaxChainLength)
+	}
+	if opts.HasMinMatchDistance && other.HasMinMatchDistance {
+		ok = ok && (opts.MinMatchDistance == other.MinMatchDistance)
+	}
+	if opts.HasMinMatchScore && other.HasMinMatchScore {
+		ok = ok && (opts.MinMatchScore == other.MinMatchScore)
+	}
 	return ok
 }
 
+var (
+	_ io.Reader       = (*LZ77)(nil)
+	_ io.Writer       = (*LZ77)(nil)
+	_ io.ByteReader   = (*LZ77)(nil)
+	_ io.ByteWriter   = (*LZ77)(nil)
+	_ io.StringWriter = (*LZ77)(nil)
+	_ io.WriterTo     = (*LZ77)(nil)
+	_ io.ReaderFrom   = (*LZ77)(nil)
+	_ fmt.GoStringer  = LZ77{}
+	_ fmt.Stringer    = LZ77{}
+
+	_ encoding.BinaryMarshaler   = LZ77{}
+	_ encoding.BinaryUnmarshaler = (*LZ77)(nil)
+)
+
 // hash4 returns a hash of the first 4 bytes of slice.
 //
 // It is *very* loosely inspired by Murmur3-32 and CityHash32.  Reference:
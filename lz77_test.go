@@ -1,8 +1,21 @@
 package buffer
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/adler32"
+	"hash/crc32"
+	"io"
+	"math/bits"
+	"math/rand"
+	"os"
+	"reflect"
+	"runtime"
 	"strings"
+	"sync"
 	"testing"
+	"testing/iotest"
 )
 
 //nolint:gocyclo
@@ -28,7 +41,7 @@ func TestLZ77(t *testing.T) {
 
 	expectDebug := strings.Join([]string{
 		"LZ77(\n",
-		"\tcapacity = 40\n",
+		"\tcapacity = 24\n",
 		"\tbbits = 4\n",
 		"\twbits = 3\n",
 		"\thbits = 8\n",
@@ -63,7 +76,7 @@ func TestLZ77(t *testing.T) {
 
 	expectDebug = strings.Join([]string{
 		"LZ77(\n",
-		"\tcapacity = 40\n",
+		"\tcapacity = 24\n",
 		"\tbbits = 4\n",
 		"\twbits = 3\n",
 		"\thbits = 8\n",
@@ -97,7 +110,7 @@ func TestLZ77(t *testing.T) {
 
 	expectDebug = strings.Join([]string{
 		"LZ77(\n",
-		"\tcapacity = 40\n",
+		"\tcapacity = 24\n",
 		"\tbbits = 4\n",
 		"\twbits = 3\n",
 		"\thbits = 8\n",
@@ -162,7 +175,7 @@ func TestLZ77(t *testing.T) {
 
 	expectDebug = strings.Join([]string{
 		"LZ77(\n",
-		"\tcapacity = 40\n",
+		"\tcapacity = 24\n",
 		"\tbbits = 4\n",
 		"\twbits = 3\n",
 		"\thbits = 8\n",
@@ -197,7 +210,7 @@ func TestLZ77(t *testing.T) {
 
 	expectDebug = strings.Join([]string{
 		"LZ77(\n",
-		"\tcapacity = 40\n",
+		"\tcapacity = 24\n",
 		"\tbbits = 4\n",
 		"\twbits = 3\n",
 		"\thbits = 8\n",
@@ -221,6 +234,2828 @@ func TestLZ77(t *testing.T) {
 	}
 }
 
+func TestLZ77_BackwardMatchExtension(t *testing.T) {
+	type testRow struct {
+		Name       string
+		HashBits   uint
+		Enabled    bool
+		ExpectBuf  string
+		ExpectDist uint
+		ExpectLen  uint
+	}
+
+	testData := [...]testRow{
+		{"hash/disabled", 8, false, "abcd", 7, 4},
+		{"hash/enabled", 8, true, "abcd", 7, 7},
+		{"nohash/disabled", 0, false, "abcd", 7, 4},
+		{"nohash/enabled", 0, true, "abcd", 7, 7},
+	}
+
+	for _, row := range testData {
+		var lz77 LZ77
+		lz77.Init(LZ77Options{
+			WindowNumBits:          4,
+			BufferNumBits:          4,
+			HashNumBits:            row.HashBits,
+			MinMatchLength:         4,
+			HasMinMatchLength:      true,
+			BackwardMatchExtension: row.Enabled,
+		})
+		lz77.SetWindow([]byte("123abcd"))
+
+		// Stream the input in two pieces, so that "123" must be emitted
+		// as literals before the rest of the match has arrived.
+		_, _ = lz77.Write([]byte("123"))
+		for index := 0; index < 3; index++ {
+			buf, _, _, found := lz77.Advance()
+			if len(buf) != 1 || found {
+				t.Errorf("%s: Advance #%d returned unexpected data: %q, %t", row.Name, index, buf, found)
+			}
+		}
+		_, _ = lz77.Write([]byte("abcd"))
+
+		buf, dist, length, found := lz77.Advance()
+		if string(buf) != row.ExpectBuf || dist != row.ExpectDist || length != row.ExpectLen || !found {
+			t.Errorf(
+				"%s: Advance returned unexpected data.\n\tExpect: %q, %d, %d, %t\n\tActual: %q, %d, %d, %t",
+				row.Name,
+				row.ExpectBuf, row.ExpectDist, row.ExpectLen, true,
+				string(buf), dist, length, found,
+			)
+		}
+	}
+}
+
+func TestLZ77_MaxChainLength(t *testing.T) {
+	rng := rand.New(rand.NewSource(42))
+	input := make([]byte, 1<<14)
+	for index := range input {
+		input[index] = "aaaabbc"[rng.Intn(7)]
+	}
+
+	for _, hashBits := range []uint{0, 12} {
+		for _, chainLen := range []uint{0, 1, 2, 8} {
+			var lz77 LZ77
+			lz77.Init(LZ77Options{
+				BufferNumBits:       8,
+				WindowNumBits:       10,
+				HashNumBits:         hashBits,
+				MinMatchLength:      4,
+				MaxMatchLength:      64,
+				MaxMatchDistance:    700,
+				MaxChainLength:      chainLen,
+				HasMinMatchLength:   true,
+				HasMaxMatchLength:   true,
+				HasMaxMatchDistance: true,
+				HasMaxChainLength:   true,
+			})
+
+			var output []byte
+			remaining := input
+			for len(remaining) != 0 || !lz77.IsEmpty() {
+				nn, _ := lz77.Write(remaining)
+				remaining = remaining[nn:]
+				for !lz77.IsEmpty() {
+					buf, dist, length, found := lz77.Advance()
+					if !found {
+						output = append(output, buf...)
+						continue
+					}
+					if length < 4 || length > 64 || dist == 0 || dist > 700 || dist > uint(len(output)) {
+						t.Fatalf("hbits=%d chain=%d: Advance returned invalid match: dist=%d length=%d", hashBits, chainLen, dist, length)
+					}
+					for k := uint(0); k < length; k++ {
+						output = append(output, output[uint(len(output))-dist])
+					}
+					if tail := output[uint(len(output))-length:]; !bytes.Equal(tail, buf) {
+						t.Fatalf("hbits=%d chain=%d: Advance returned match that does not reproduce its bytes:\n\texpect: %q\n\tactual: %q", hashBits, chainLen, buf, tail)
+					}
+				}
+			}
+
+			if !bytes.Equal(input, output) {
+				t.Errorf("hbits=%d chain=%d: decoded output does not match input", hashBits, chainLen)
+			}
+		}
+	}
+}
+
+func TestLZ77_WriteMatch(t *testing.T) {
+	opts := LZ77Options{
+		BufferNumBits:     8,
+		WindowNumBits:     10,
+		HashNumBits:       12,
+		MinMatchLength:    4,
+		MaxMatchLength:    64,
+		HasMinMatchLength: true,
+		HasMaxMatchLength: true,
+	}
+
+	rng := rand.New(rand.NewSource(42))
+	words := strings.Fields("the quick brown fox jumps over the lazy dog aaaaaaaa abababab")
+	var sb strings.Builder
+	for sb.Len() < 1<<14 {
+		sb.WriteString(words[rng.Intn(len(words))])
+		sb.WriteByte(' ')
+	}
+	input := []byte(sb.String())
+
+	var enc, dec LZ77
+	enc.Init(opts)
+	dec.Init(opts)
+
+	var output []byte
+	drain := func() {
+		buf := make([]byte, dec.Len())
+		nn, _ := dec.Read(buf)
+		output = append(output, buf[:nn]...)
+	}
+
+	remaining := input
+	for len(remaining) != 0 || !enc.IsEmpty() {
+		nn, _ := enc.Write(remaining)
+		remaining = remaining[nn:]
+		for !enc.IsEmpty() {
+			buf, dist, length, found := enc.Advance()
+			if found {
+				nn, err := dec.WriteMatch(dist, length)
+				if err != nil || uint(nn) != length {
+					t.Fatalf("WriteMatch(%d, %d) failed unexpectedly: %d, %v", dist, length, nn, err)
+				}
+			} else {
+				for _, ch := range buf {
+					if err := dec.WriteByte(ch); err != nil {
+						t.Fatalf("WriteByte failed unexpectedly: %v", err)
+					}
+				}
+			}
+			drain()
+		}
+	}
+
+	if !bytes.Equal(input, output) {
+		t.Errorf("decoded output does not match input")
+	}
+
+	dec.Clear()
+	_, _ = dec.Write([]byte("ab"))
+	if nn, err := dec.WriteMatch(3, 1); nn != 0 || err != ErrBadDistance {
+		t.Errorf("WriteMatch returned wrong result:\n\texpect: %d, %v\n\tactual: %d, %v", 0, ErrBadDistance, nn, err)
+	}
+	if nn, err := dec.WriteMatch(2, 300); nn != 254 || err != ErrFull {
+		t.Errorf("WriteMatch returned wrong result:\n\texpect: %d, %v\n\tactual: %d, %v", 254, ErrFull, nn, err)
+	}
+	if expect, actual := strings.Repeat("ab", 128), dec.String(); expect != actual {
+		t.Errorf("WriteMatch produced wrong data:\n\texpect: %q\n\tactual: %q", expect, actual)
+	}
+}
+
+type lz77Token struct {
+	Buf    string
+	Dist   uint
+	Length uint
+	Found  bool
+}
+
+func TestLZ77_ReadFrom(t *testing.T) {
+	opts := LZ77Options{
+		BufferNumBits: 6,
+		WindowNumBits: 8,
+		HashNumBits:   10,
+	}
+	input := strings.Repeat("abracadabra, alakazam! ", 40)
+
+	var expect []lz77Token
+	var lz77 LZ77
+	lz77.Init(opts)
+	remaining := input
+	for len(remaining) != 0 || !lz77.IsEmpty() {
+		nn, _ := lz77.Write([]byte(remaining))
+		remaining = remaining[nn:]
+		for index := 0; index < 5 && !lz77.IsEmpty(); index++ {
+			buf, dist, length, found := lz77.Advance()
+			expect = append(expect, lz77Token{string(buf), dist, length, found})
+		}
+	}
+
+	var actual []lz77Token
+	lz77.Init(opts)
+	r := iotest.OneByteReader(strings.NewReader(input))
+	for {
+		nn, err := lz77.ReadFrom(r)
+		if err != nil {
+			t.Fatalf("ReadFrom failed unexpectedly: %v", err)
+		}
+		if nn == 0 && lz77.IsEmpty() {
+			break
+		}
+		for index := 0; index < 5 && !lz77.IsEmpty(); index++ {
+			buf, dist, length, found := lz77.Advance()
+			actual = append(actual, lz77Token{string(buf), dist, length, found})
+		}
+	}
+
+	if len(expect) != len(actual) {
+		t.Fatalf("ReadFrom path produced wrong number of tokens:\n\texpect: %d\n\tactual: %d", len(expect), len(actual))
+	}
+	for index := range expect {
+		if expect[index] != actual[index] {
+			t.Errorf("ReadFrom path produced wrong token #%d:\n\texpect: %+v\n\tactual: %+v", index, expect[index], actual[index])
+		}
+	}
+}
+
+type shortWriter struct {
+	max int
+}
+
+func (w *shortWriter) Write(p []byte) (int, error) {
+	if len(p) > w.max {
+		return w.max, nil
+	}
+	return len(p), nil
+}
+
+func TestLZ77_WriteTo(t *testing.T) {
+	var lz77 LZ77
+	lz77.Init(LZ77Options{
+		BufferNumBits:       5,
+		WindowNumBits:       6,
+		HashNumBits:         8,
+		MaxMatchDistance:    40,
+		HasMaxMatchDistance: true,
+	})
+
+	const phrase = "stored block, sent verbatim"
+	_, _ = lz77.Write([]byte(phrase))
+
+	var bb bytes.Buffer
+	nn, err := lz77.WriteTo(&bb)
+	if err != nil || nn != int64(len(phrase)) {
+		t.Errorf("WriteTo returned wrong result:\n\texpect: %d, %v\n\tactual: %d, %v", len(phrase), error(nil), nn, err)
+	}
+	if expect, actual := phrase, bb.String(); expect != actual {
+		t.Errorf("WriteTo wrote wrong data:\n\texpect: %q\n\tactual: %q", expect, actual)
+	}
+	if !lz77.IsEmpty() {
+		t.Errorf("WriteTo did not drain the Buffer")
+	}
+
+	_, _ = lz77.Write([]byte(phrase))
+	buf, dist, length, found := lz77.Advance()
+	if string(buf) != phrase || dist != uint(len(phrase)) || length != uint(len(phrase)) || !found {
+		t.Errorf(
+			"Advance returned unexpected data.\n\tExpect: %q, %d, %d, %t\n\tActual: %q, %d, %d, %t",
+			phrase, len(phrase), len(phrase), true,
+			string(buf), dist, length, found,
+		)
+	}
+
+	_, _ = lz77.Write([]byte("0123456789"))
+	nn, err = lz77.WriteTo(&shortWriter{max: 4})
+	if err != io.ErrShortWrite || nn != 4 {
+		t.Errorf("WriteTo returned wrong result:\n\texpect: %d, %v\n\tactual: %d, %v", 4, io.ErrShortWrite, nn, err)
+	}
+	if expect, actual := "456789", lz77.String(); expect != actual {
+		t.Errorf("WriteTo left wrong data in the Buffer:\n\texpect: %q\n\tactual: %q", expect, actual)
+	}
+}
+
+func TestLZ77_WriteString(t *testing.T) {
+	opts := LZ77Options{
+		BufferNumBits: 4,
+		WindowNumBits: 4,
+		HashNumBits:   8,
+	}
+
+	var expect, actual LZ77
+	expect.Init(opts)
+	actual.Init(opts)
+
+	for _, str := range []string{"abcdabcd", "efghefghXYZ", "more than fits"} {
+		n1, err1 := expect.Write([]byte(str))
+		n2, err2 := actual.WriteString(str)
+		if n1 != n2 || err1 != err2 {
+			t.Errorf("WriteString(%q) returned wrong result:\n\texpect: %d, %v\n\tactual: %d, %v", str, n1, err1, n2, err2)
+		}
+		if e, a := expect.DebugString(), actual.DebugString(); e != a {
+			t.Errorf("WriteString(%q) produced wrong state:\n\texpect: %s\n\tactual: %s", str, e, a)
+		}
+		_, _, _, _ = expect.Advance()
+		_, _, _, _ = actual.Advance()
+	}
+}
+
+func TestLZ77_Clone(t *testing.T) {
+	var lz77 LZ77
+	lz77.Init(LZ77Options{
+		BufferNumBits: 4,
+		WindowNumBits: 4,
+		HashNumBits:   8,
+	})
+	_, _ = lz77.WriteString("abcdabcdabcd")
+	_, _, _, _ = lz77.Advance()
+	_, _, _, _ = lz77.Advance()
+
+	expect := lz77.DebugString()
+	dupe := lz77.Clone()
+	if actual := dupe.DebugString(); expect != actual {
+		t.Errorf("Clone produced wrong state:\n\texpect: %s\n\tactual: %s", expect, actual)
+	}
+
+	_, _ = lz77.WriteString("wxyz")
+	_, _ = dupe.WriteString("0123")
+	for !lz77.IsEmpty() {
+		_, _, _, _ = lz77.Advance()
+	}
+	for !dupe.IsEmpty() {
+		_, _, _, _ = dupe.Advance()
+	}
+
+	if a, b := lz77.DebugString(), dupe.DebugString(); a == b {
+		t.Errorf("Clone shares state with the original:\n\t%s", a)
+	}
+	if expect, actual := "abcdwxyz", string(lz77.WindowBytesView()[8:]); expect != actual {
+		t.Errorf("original has wrong Window contents:\n\texpect: %q\n\tactual: %q", expect, actual)
+	}
+	if expect, actual := "abcd0123", string(dupe.WindowBytesView()[8:]); expect != actual {
+		t.Errorf("Clone has wrong Window contents:\n\texpect: %q\n\tactual: %q", expect, actual)
+	}
+
+	var replay LZ77
+	replay.Init(lz77.Options())
+	_, _ = replay.WriteString("abcdabcdabcd")
+	_, _, _, _ = replay.Advance()
+	_, _, _, _ = replay.Advance()
+	_, _ = replay.WriteString("0123")
+	for !replay.IsEmpty() {
+		_, _, _, _ = replay.Advance()
+	}
+	if expect, actual := replay.DebugString(), dupe.DebugString(); expect != actual {
+		t.Errorf("Clone diverged from an equivalent fresh LZ77:\n\texpect: %s\n\tactual: %s", expect, actual)
+	}
+}
+
+func TestLZ77_Reset(t *testing.T) {
+	opts := LZ77Options{
+		BufferNumBits: 6,
+		WindowNumBits: 8,
+		HashNumBits:   10,
+	}
+	input := strings.Repeat("abracadabra, alakazam! ", 40)
+
+	run := func(lz77 *LZ77) []lz77Token {
+		var tokens []lz77Token
+		remaining := input
+		for len(remaining) != 0 || !lz77.IsEmpty() {
+			nn, _ := lz77.WriteString(remaining)
+			remaining = remaining[nn:]
+			for index := 0; index < 5 && !lz77.IsEmpty(); index++ {
+				buf, dist, length, found := lz77.Advance()
+				tokens = append(tokens, lz77Token{string(buf), dist, length, found})
+			}
+		}
+		return tokens
+	}
+
+	compare := func(name string, expect []lz77Token, actual []lz77Token) {
+		t.Helper()
+		if len(expect) != len(actual) {
+			t.Errorf("%s: wrong number of tokens:\n\texpect: %d\n\tactual: %d", name, len(expect), len(actual))
+			return
+		}
+		for index := range expect {
+			if expect[index] != actual[index] {
+				t.Errorf("%s: wrong token #%d:\n\texpect: %+v\n\tactual: %+v", name, index, expect[index], actual[index])
+				return
+			}
+		}
+	}
+
+	expect := run(NewLZ77(opts))
+
+	lz77 := NewLZ77(opts)
+	_, _ = lz77.WriteString("some unrelated garbage to dirty the state")
+	_, _, _, _ = lz77.Advance()
+	lz77.Reset()
+	compare("Reset", expect, run(lz77))
+
+	before := &lz77.slice[0]
+	lz77.ResetWithOptions(opts)
+	if after := &lz77.slice[0]; after != before {
+		t.Errorf("ResetWithOptions reallocated storage even though its size was unchanged")
+	}
+	compare("ResetWithOptions", expect, run(lz77))
+
+	other := opts
+	other.BufferNumBits = 5
+	lz77.ResetWithOptions(other)
+	compare("ResetWithOptions(other)", run(NewLZ77(other)), run(lz77))
+}
+
+func TestLZ77_MarshalBinary(t *testing.T) {
+	opts := LZ77Options{
+		BufferNumBits:          6,
+		WindowNumBits:          8,
+		HashNumBits:            10,
+		MaxMatchDistance:       200,
+		MaxChainLength:         4,
+		RepeatOffsetBias:       2,
+		NiceMatchLength:        16,
+		HashInsertStride:       3,
+		HasMaxMatchDistance:    true,
+		HasMaxChainLength:      true,
+		BackwardMatchExtension: true,
+	}
+
+	// Runs of random bytes between the words make HashInsertStride switch
+	// between sparse and dense hashing.
+	rng := rand.New(rand.NewSource(42))
+	words := strings.Fields("abra cadabra alakazam hocus pocus presto")
+	var sb strings.Builder
+	for sb.Len() < 1<<12 {
+		if rng.Intn(4) == 0 {
+			for n := rng.Intn(24); n != 0; n-- {
+				sb.WriteByte(byte(rng.Intn(256)))
+			}
+		}
+		sb.WriteString(words[rng.Intn(len(words))])
+		sb.WriteByte(' ')
+	}
+	input := sb.String()
+
+	// Each step writes a few bytes and then advances a few times, so that
+	// the Buffer is rarely full or empty when serialized.
+	run := func(lz77 *LZ77, split func(step int, lz77 *LZ77) *LZ77) []lz77Token {
+		var tokens []lz77Token
+		remaining := input
+		for step := 0; len(remaining) != 0 || !lz77.IsEmpty(); step++ {
+			chunk := remaining
+			if len(chunk) > 7 {
+				chunk = chunk[:7]
+			}
+			nn, _ := lz77.WriteString(chunk)
+			remaining = remaining[nn:]
+			for index := 0; index < 2 && !lz77.IsEmpty(); index++ {
+				buf, dist, length, found := lz77.Advance()
+				tokens = append(tokens, lz77Token{string(buf), dist, length, found})
+			}
+			lz77 = split(step, lz77)
+		}
+		return tokens
+	}
+
+	for _, stride := range []uint{1, 2, 3, 5} {
+		opts := opts
+		opts.HashInsertStride = stride
+		expect := run(NewLZ77(opts), func(step int, lz77 *LZ77) *LZ77 { return lz77 })
+
+		for trial := 0; trial < 50; trial++ {
+			splits := make(map[int]bool)
+			for len(splits) < 8 {
+				splits[rng.Intn(600)] = true
+			}
+			actual := run(NewLZ77(opts), func(step int, lz77 *LZ77) *LZ77 {
+				if !splits[step] {
+					return lz77
+				}
+				data, err := lz77.MarshalBinary()
+				if err != nil {
+					t.Fatalf("MarshalBinary failed unexpectedly: %v", err)
+				}
+				restored := new(LZ77)
+				if err := restored.UnmarshalBinary(data); err != nil {
+					t.Fatalf("UnmarshalBinary failed unexpectedly: %v", err)
+				}
+				if err := restored.CheckInvariants(); err != nil {
+					t.Fatalf("restored LZ77 failed CheckInvariants: %v", err)
+				}
+				return restored
+			})
+
+			if len(expect) != len(actual) {
+				t.Fatalf("stride %d: restored LZ77 produced wrong number of tokens:\n\texpect: %d\n\tactual: %d", stride, len(expect), len(actual))
+			}
+			for index := range expect {
+				if expect[index] != actual[index] {
+					t.Fatalf("stride %d: restored LZ77 produced wrong token #%d:\n\texpect: %+v\n\tactual: %+v", stride, index, expect[index], actual[index])
+				}
+			}
+		}
+	}
+
+	data, _ := NewLZ77(opts).MarshalBinary()
+	patch := func(index int, value byte) []byte {
+		out := append([]byte(nil), data...)
+		out[index] = value
+		return out
+	}
+	for _, bad := range [][]byte{
+		nil,
+		{2},
+		data[:len(data)-1],
+		append(append([]byte(nil), data...), 'x'),
+		patch(0, lz77BinaryVersion-1),
+		patch(0, lz77BinaryVersion+1),
+		patch(1, 1),
+		patch(2, lz77MaxWindowNumBits+1),
+		patch(3, 33),
+	} {
+		var lz77 LZ77
+		if err := lz77.UnmarshalBinary(bad); err != ErrCorrupt {
+			t.Errorf("UnmarshalBinary(%q) returned wrong error:\n\texpect: %v\n\tactual: %v", bad, ErrCorrupt, err)
+		}
+	}
+
+	var lz77 LZ77
+	if err := lz77.UnmarshalBinaryLimit(data, 9); err != (NumBitsError{NumBits: 10, Max: 9}) {
+		t.Errorf("UnmarshalBinaryLimit returned wrong error:\n\texpect: %v\n\tactual: %v", NumBitsError{NumBits: 10, Max: 9}, err)
+	}
+	if lz77.slice != nil {
+		t.Errorf("UnmarshalBinaryLimit allocated storage before rejecting the data")
+	}
+
+	// UnmarshalBinary applies a default limit, as a few bytes of data could
+	// otherwise demand a 1 TiB Window.
+	if bits.UintSize >= 64 {
+		if err := lz77.UnmarshalBinary(patch(2, 40)); err != (NumBitsError{NumBits: 40, Max: 30}) {
+			t.Errorf("UnmarshalBinary returned wrong error:\n\texpect: %v\n\tactual: %v", NumBitsError{NumBits: 40, Max: 30}, err)
+		}
+		if lz77.slice != nil {
+			t.Errorf("UnmarshalBinary allocated storage before rejecting the data")
+		}
+	}
+}
+
+func TestLZ77_MarshalBinary_Large(t *testing.T) {
+	roundTrip := func(lz77 *LZ77) *LZ77 {
+		t.Helper()
+		data, err := lz77.MarshalBinary()
+		if err != nil {
+			t.Fatalf("MarshalBinary failed unexpectedly: %v", err)
+		}
+		restored := new(LZ77)
+		if err := restored.UnmarshalBinary(data); err != nil {
+			t.Fatalf("UnmarshalBinary failed unexpectedly: %v", err)
+		}
+		if err := restored.CheckInvariants(); err != nil {
+			t.Fatalf("restored LZ77 failed CheckInvariants: %v", err)
+		}
+		if expect, actual := lz77.Options(), restored.Options(); !expect.Equal(actual) {
+			t.Fatalf("restored LZ77 has wrong options:\n\texpect: %+v\n\tactual: %+v", expect, actual)
+		}
+		return restored
+	}
+
+	// An empty LZ77 with a large hash table.
+	roundTrip(NewLZ77(LZ77Options{
+		BufferNumBits: 8,
+		WindowNumBits: 8,
+		HashNumBits:   24,
+	}))
+
+	// A large Window early in a stream, when it holds only a few bytes.
+	opts := LZ77Options{
+		BufferNumBits: 8,
+		WindowNumBits: 22,
+		HashNumBits:   12,
+	}
+	input := strings.Repeat("abcabd", 8)
+	run := func(split bool) []lz77Token {
+		lz77 := NewLZ77(opts)
+		_, _ = lz77.WriteString(input)
+		var tokens []lz77Token
+		for !lz77.IsEmpty() {
+			buf, dist, length, found := lz77.Advance()
+			tokens = append(tokens, lz77Token{string(buf), dist, length, found})
+			if split && len(tokens) == 4 {
+				lz77 = roundTrip(lz77)
+			}
+		}
+		return tokens
+	}
+	expect, actual := run(false), run(true)
+	if len(expect) != len(actual) {
+		t.Fatalf("restored LZ77 produced wrong number of tokens:\n\texpect: %d\n\tactual: %d", len(expect), len(actual))
+	}
+	for index := range expect {
+		if expect[index] != actual[index] {
+			t.Errorf("restored LZ77 produced wrong token #%d:\n\texpect: %+v\n\tactual: %+v", index, expect[index], actual[index])
+		}
+	}
+}
+
+func TestLZ77_MinMatchDistance(t *testing.T) {
+	type testRow struct {
+		Input   string
+		MinDist uint
+		Expect  string
+	}
+
+	testData := [...]testRow{
+		{"abcdabcd", 0, "a b c d (4,4)"},
+		{"abcdabcd", 4, "a b c d (4,4)"},
+		{"abcdabcd", 5, "a b c d a b c d"},
+		{"abcdXabcdabcd", 0, "a b c d X (5,4) (4,4)"},
+		{"abcdXabcdabcd", 5, "a b c d X (5,4) (9,4)"},
+		{"abcdXabcdabcd", 6, "a b c d X a b c d (9,4)"},
+	}
+
+	for _, hashBits := range []uint{0, 8} {
+		for _, row := range testData {
+			var lz77 LZ77
+			lz77.Init(LZ77Options{
+				BufferNumBits:       4,
+				WindowNumBits:       4,
+				HashNumBits:         hashBits,
+				MinMatchDistance:    row.MinDist,
+				HasMinMatchDistance: true,
+			})
+			_, _ = lz77.WriteString(row.Input)
+
+			var tokens []string
+			for !lz77.IsEmpty() {
+				buf, dist, length, found := lz77.Advance()
+				if found {
+					tokens = append(tokens, fmt.Sprintf("(%d,%d)", dist, length))
+				} else {
+					tokens = append(tokens, string(buf))
+				}
+			}
+			if actual := strings.Join(tokens, " "); row.Expect != actual {
+				t.Errorf("hbits=%d MinMatchDistance=%d input=%q: Advance produced wrong tokens:\n\texpect: %s\n\tactual: %s", hashBits, row.MinDist, row.Input, row.Expect, actual)
+			}
+		}
+	}
+}
+
+func TestLZ77_TailLiteralBytes(t *testing.T) {
+	type testRow struct {
+		Input   string
+		TailLen uint
+		Expect  string
+	}
+
+	testData := [...]testRow{
+		{"abcdabcd", 0, "a b c d (4,4)"},
+		{"abcdabcd", 1, "a b c d (4,3) d"},
+		{"abcdabcd", 2, "a b c d a b c d"},
+		{"abcdabcdXYZ", 3, "a b c d (4,4) X Y Z"},
+		{"abcdabcdXYZ", 5, "a b c d a b c d X Y Z"},
+		{"abcdefabcdef", 5, "a b c d e f a b c d e f"},
+		{"abcdefabcdef", 3, "a b c d e f (6,3) d e f"},
+	}
+
+	for _, hashBits := range []uint{0, 8} {
+		for _, row := range testData {
+			var lz77 LZ77
+			lz77.Init(LZ77Options{
+				BufferNumBits:     4,
+				WindowNumBits:     4,
+				HashNumBits:       hashBits,
+				MinMatchLength:    3,
+				HasMinMatchLength: true,
+				TailLiteralBytes:  row.TailLen,
+			})
+			_, _ = lz77.WriteString(row.Input)
+
+			var tokens []string
+			for !lz77.IsEmpty() {
+				buf, dist, length, found := lz77.Advance()
+				if found {
+					tokens = append(tokens, fmt.Sprintf("(%d,%d)", dist, length))
+				} else {
+					tokens = append(tokens, string(buf))
+				}
+			}
+			if actual := strings.Join(tokens, " "); row.Expect != actual {
+				t.Errorf("hbits=%d TailLiteralBytes=%d input=%q: Advance produced wrong tokens:\n\texpect: %s\n\tactual: %s", hashBits, row.TailLen, row.Input, row.Expect, actual)
+			}
+		}
+	}
+
+	rng := rand.New(rand.NewSource(11))
+	input := make([]byte, 4096)
+	for index := range input {
+		input[index] = "ab"[rng.Intn(2)]
+	}
+
+	const tailLen = 12
+	var lz77 LZ77
+	lz77.Init(LZ77Options{
+		BufferNumBits:    6,
+		WindowNumBits:    8,
+		HashNumBits:      10,
+		TailLiteralBytes: tailLen,
+	})
+
+	var consumed, written uint
+	for consumed < uint(len(input)) || !lz77.IsEmpty() {
+		if consumed < uint(len(input)) && !lz77.IsFull() {
+			chunk := 1 + uint(rng.Intn(48))
+			if max := uint(len(input)) - consumed; chunk > max {
+				chunk = max
+			}
+			n, _ := lz77.Write(input[consumed : consumed+chunk])
+			consumed += uint(n)
+			continue
+		}
+
+		_, _, length, found := lz77.Advance()
+		if !found {
+			written++
+			continue
+		}
+		written += length
+		if limit := consumed - tailLen; written > limit {
+			t.Errorf("match ending at %d intrudes on the last %d bytes of %d buffered bytes", written, tailLen, consumed)
+		}
+	}
+}
+
+func TestLZ77_Stats(t *testing.T) {
+	const input = "abcdabcdabcdXYZabcdabcdXYZ-0123456789-0123456789"
+
+	run := func(lz77 *LZ77) string {
+		var tokens []string
+		str := input
+		for len(str) != 0 || !lz77.IsEmpty() {
+			if len(str) != 0 && !lz77.IsFull() {
+				n, _ := lz77.WriteString(str)
+				str = str[n:]
+				continue
+			}
+			buf, dist, length, found := lz77.Advance()
+			if found {
+				tokens = append(tokens, fmt.Sprintf("(%d,%d)", dist, length))
+			} else {
+				tokens = append(tokens, string(buf))
+			}
+		}
+		return strings.Join(tokens, " ")
+	}
+
+	var lz77 LZ77
+	lz77.Init(LZ77Options{
+		BufferNumBits: 4,
+		WindowNumBits: 6,
+		HashNumBits:   8,
+	})
+
+	if actual := lz77.Stats(); actual != (LZ77Stats{}) {
+		t.Errorf("Stats returned wrong result before EnableStats:\n\texpect: %+v\n\tactual: %+v", LZ77Stats{}, actual)
+	}
+
+	lz77.EnableStats()
+	expectTokens := "a b c d (4,8) X Y Z (11,11) - 0 1 2 3 4 5 6 7 8 9 (11,11)"
+	if actual := run(&lz77); expectTokens != actual {
+		t.Errorf("Advance produced wrong tokens:\n\texpect: %s\n\tactual: %s", expectTokens, actual)
+	}
+
+	expect := LZ77Stats{
+		Literals:   18,
+		Matches:    3,
+		MatchBytes: 30,
+	}
+	expect.LengthHistogram[4] = 3
+	expect.DistanceHistogram[3] = 1
+	expect.DistanceHistogram[4] = 2
+	if actual := lz77.Stats(); expect != actual {
+		t.Errorf("Stats returned wrong result:\n\texpect: %+v\n\tactual: %+v", expect, actual)
+	}
+
+	dupe := lz77.Clone()
+	lz77.ResetStats()
+	if actual := lz77.Stats(); actual != (LZ77Stats{}) {
+		t.Errorf("Stats returned wrong result after ResetStats:\n\texpect: %+v\n\tactual: %+v", LZ77Stats{}, actual)
+	}
+	if actual := dupe.Stats(); expect != actual {
+		t.Errorf("Stats returned wrong result for Clone after ResetStats on original:\n\texpect: %+v\n\tactual: %+v", expect, actual)
+	}
+
+	lz77.DisableStats()
+	lz77.Reset()
+	_ = run(&lz77)
+	if actual := lz77.Stats(); actual != (LZ77Stats{}) {
+		t.Errorf("Stats returned wrong result after DisableStats:\n\texpect: %+v\n\tactual: %+v", LZ77Stats{}, actual)
+	}
+
+	// With backward extension, literals which are absorbed into a later
+	// match must no longer be counted as literals.
+	lz77.Init(LZ77Options{
+		BufferNumBits:          4,
+		WindowNumBits:          4,
+		HashNumBits:            8,
+		BackwardMatchExtension: true,
+	})
+	lz77.EnableStats()
+	lz77.SetWindow([]byte("123abcd"))
+	_, _ = lz77.WriteString("123")
+	for !lz77.IsEmpty() {
+		_, _, _, _ = lz77.Advance()
+	}
+	_, _ = lz77.WriteString("abcd")
+	_, _, _, _ = lz77.Advance()
+
+	expect = LZ77Stats{
+		Literals:   0,
+		Matches:    1,
+		MatchBytes: 7,
+	}
+	expect.LengthHistogram[3] = 1
+	expect.DistanceHistogram[3] = 1
+	if actual := lz77.Stats(); expect != actual {
+		t.Errorf("Stats returned wrong result with BackwardMatchExtension:\n\texpect: %+v\n\tactual: %+v", expect, actual)
+	}
+
+	// Literals absorbed after ResetStats were counted before it, so they
+	// must not be subtracted again.
+	lz77.Reset()
+	lz77.SetWindow([]byte("123abcd"))
+	_, _ = lz77.WriteString("123")
+	for !lz77.IsEmpty() {
+		_, _, _, _ = lz77.Advance()
+	}
+	lz77.ResetStats()
+	_, _ = lz77.WriteString("abcd")
+	_, _, _, _ = lz77.Advance()
+	if actual := lz77.Stats(); expect != actual {
+		t.Errorf("Stats returned wrong result with BackwardMatchExtension after ResetStats:\n\texpect: %+v\n\tactual: %+v", expect, actual)
+	}
+}
+
+func TestLZ77_Skip(t *testing.T) {
+	rng := rand.New(rand.NewSource(7))
+	noise := make([]byte, 40)
+	_, _ = rng.Read(noise)
+
+	var lz77 LZ77
+	lz77.Init(LZ77Options{
+		BufferNumBits:       6,
+		WindowNumBits:       6,
+		HashNumBits:         8,
+		MaxMatchDistance:    48,
+		HasMaxMatchDistance: true,
+	})
+
+	if buf, err := lz77.Skip(1); buf != nil || err != ErrEmpty {
+		t.Errorf("Skip on empty LZ77 returned wrong result:\n\texpect: [], %v\n\tactual: %q, %v", ErrEmpty, buf, err)
+	}
+
+	_, _ = lz77.Write(noise)
+	if buf, err := lz77.Skip(0); buf != nil || err != nil {
+		t.Errorf("Skip(0) returned wrong result:\n\texpect: [], <nil>\n\tactual: %q, %v", buf, err)
+	}
+	buf, err := lz77.Skip(30)
+	if err != nil || !bytes.Equal(buf, noise[:30]) {
+		t.Errorf("Skip(30) returned wrong result:\n\texpect: %q, <nil>\n\tactual: %q, %v", noise[:30], buf, err)
+	}
+	buf, err = lz77.Skip(100)
+	if err != nil || !bytes.Equal(buf, noise[30:]) {
+		t.Errorf("Skip(100) returned wrong result:\n\texpect: %q, <nil>\n\tactual: %q, %v", noise[30:], buf, err)
+	}
+	if expect, actual := uint(40), lz77.WindowLen(); expect != actual {
+		t.Errorf("WindowLen returned wrong result after Skip:\n\texpect: %d\n\tactual: %d", expect, actual)
+	}
+
+	// The skipped bytes are hashed, so they can be matched in full.
+	_, _ = lz77.Write(noise[4:36])
+	_, dist, length, found := lz77.Advance()
+	if !found || dist != 36 || length != 32 {
+		t.Errorf("Advance after Skip returned wrong match:\n\texpect: (36,32)\n\tactual: (%d,%d) found=%t", dist, length, found)
+	}
+
+	// Bytes skipped right before a match are also available to it, and
+	// the Window is trimmed to MaxMatchDistance.
+	_, _ = lz77.Write(noise[:8])
+	_, _ = lz77.Skip(8)
+	if expect, actual := uint(48), lz77.WindowLen(); expect != actual {
+		t.Errorf("WindowLen returned wrong result after Skip:\n\texpect: %d\n\tactual: %d", expect, actual)
+	}
+	_, _ = lz77.Write(noise[:8])
+	_, dist, length, found = lz77.Advance()
+	if !found || dist != 8 || length != 8 {
+		t.Errorf("Advance after Skip returned wrong match:\n\texpect: (8,8)\n\tactual: (%d,%d) found=%t", dist, length, found)
+	}
+}
+
+func TestLZ77_AdvanceLiteralRun(t *testing.T) {
+	rng := rand.New(rand.NewSource(11))
+	words := strings.Fields("abra cadabra alakazam hocus pocus presto")
+	input := make([]byte, 0, 4096)
+	for len(input) < cap(input)-16 {
+		if rng.Intn(3) == 0 {
+			input = append(input, words[rng.Intn(len(words))]...)
+		} else {
+			var noise [16]byte
+			_, _ = rng.Read(noise[:1+rng.Intn(15)])
+			input = append(input, noise[:1+rng.Intn(15)]...)
+		}
+	}
+
+	optsList := [...]LZ77Options{
+		{BufferNumBits: 6, WindowNumBits: 8, HashNumBits: 8},
+		{BufferNumBits: 6, WindowNumBits: 8, HashNumBits: 0},
+		{BufferNumBits: 6, WindowNumBits: 8, HashNumBits: 4, RepeatOffsetBias: 2, BackwardMatchExtension: true},
+		{BufferNumBits: 6, WindowNumBits: 8, HashNumBits: 8, TailLiteralBytes: 5, MinMatchDistance: 3, HasMinMatchDistance: true},
+		{BufferNumBits: 6, WindowNumBits: 8, MaxMatchLength: 0, HasMaxMatchLength: true},
+		{BufferNumBits: 6, WindowNumBits: 8, HashNumBits: 8, HashInsertStride: 4},
+	}
+
+	type token struct {
+		Literal  byte
+		Distance uint
+		Length   uint
+	}
+
+	for index, opts := range optsList {
+		bulk := NewLZ77(opts)
+		bulk.EnableStats()
+		single := NewLZ77(opts)
+		single.EnableStats()
+
+		var expect, actual []token
+		remaining := input
+		for len(remaining) != 0 || !single.IsEmpty() {
+			written, _ := single.Write(remaining)
+			_, _ = bulk.Write(remaining[:written])
+			remaining = remaining[written:]
+
+			for single.Len() > uint(rng.Intn(16)) {
+				buf, distance, length, found := single.Advance()
+				if found {
+					expect = append(expect, token{Distance: distance, Length: length})
+				} else {
+					expect = append(expect, token{Literal: buf[0]})
+				}
+			}
+			for bulk.Len() > single.Len() {
+				limit := bulk.Len() - single.Len()
+				if buf := bulk.AdvanceLiteralRun(uint(rng.Intn(int(limit) + 1))); buf != nil {
+					for _, ch := range buf {
+						actual = append(actual, token{Literal: ch})
+					}
+					continue
+				}
+				buf, distance, length, found := bulk.Advance()
+				if found {
+					actual = append(actual, token{Distance: distance, Length: length})
+				} else {
+					actual = append(actual, token{Literal: buf[0]})
+				}
+			}
+		}
+
+		if !reflect.DeepEqual(expect, actual) {
+			t.Errorf("opts[%d]: AdvanceLiteralRun produced different tokens than Advance", index)
+		}
+		if expect, actual := single.DebugString(), bulk.DebugString(); expect != actual {
+			t.Errorf("opts[%d]: AdvanceLiteralRun left different state than Advance:\n\texpect: %s\n\tactual: %s", index, expect, actual)
+		}
+		if expect, actual := single.Stats(), bulk.Stats(); expect != actual {
+			t.Errorf("opts[%d]: AdvanceLiteralRun left different stats than Advance:\n\texpect: %+v\n\tactual: %+v", index, expect, actual)
+		}
+	}
+}
+
+func TestLZ77_AdvanceAll(t *testing.T) {
+	rng := rand.New(rand.NewSource(13))
+	words := strings.Fields("abra cadabra alakazam hocus pocus presto")
+	input := make([]byte, 0, 4096)
+	for len(input) < cap(input)-16 {
+		if rng.Intn(4) == 0 {
+			input = append(input, byte(rng.Intn(256)))
+		} else {
+			input = append(input, words[rng.Intn(len(words))]...)
+		}
+	}
+
+	optsList := [...]LZ77Options{
+		{BufferNumBits: 6, WindowNumBits: 8, HashNumBits: 8},
+		{BufferNumBits: 6, WindowNumBits: 8, HashNumBits: 0},
+		{BufferNumBits: 6, WindowNumBits: 8, HashNumBits: 4, RepeatOffsetBias: 3, BackwardMatchExtension: true},
+		{BufferNumBits: 6, WindowNumBits: 8, MaxMatchLength: 0, HasMaxMatchLength: true},
+	}
+
+	for index, opts := range optsList {
+		batch := NewLZ77(opts)
+		single := NewLZ77(opts)
+
+		var expect, actual []LZ77Token
+		var tokens [7]LZ77Token
+		remaining := input
+		for len(remaining) != 0 {
+			written, _ := single.Write(remaining)
+			_, _ = batch.Write(remaining[:written])
+			remaining = remaining[written:]
+
+			for !single.IsEmpty() {
+				tok := single.AdvanceToken()
+				tok.Bytes = append([]byte(nil), tok.Bytes...)
+				expect = append(expect, tok)
+			}
+			for {
+				count := batch.AdvanceAll(tokens[:rng.Intn(len(tokens)+1)])
+				if count == 0 && batch.IsEmpty() {
+					break
+				}
+				for _, tok := range tokens[:count] {
+					tok.Bytes = append([]byte(nil), tok.Bytes...)
+					actual = append(actual, tok)
+				}
+			}
+		}
+
+		if !reflect.DeepEqual(expect, actual) {
+			t.Errorf("opts[%d]: AdvanceAll produced different tokens than AdvanceToken", index)
+		}
+		if expect, actual := single.DebugString(), batch.DebugString(); expect != actual {
+			t.Errorf("opts[%d]: AdvanceAll left different state than AdvanceToken:\n\texpect: %s\n\tactual: %s", index, expect, actual)
+		}
+	}
+
+	lz77 := NewLZ77(LZ77Options{BufferNumBits: 4, WindowNumBits: 4})
+	if count := lz77.AdvanceAll(make([]LZ77Token, 4)); count != 0 {
+		t.Errorf("AdvanceAll on empty LZ77 returned %d, expected 0", count)
+	}
+}
+
+func TestLZ77_MatchCandidates(t *testing.T) {
+	if count := NewLZ77(LZ77Options{BufferNumBits: 4, WindowNumBits: 4}).MatchCandidates(make([]LZ77Candidate, 4)); count != 0 {
+		t.Errorf("MatchCandidates without hashing returned %d, expected 0", count)
+	}
+
+	lz77 := NewLZ77(LZ77Options{
+		BufferNumBits:       5,
+		WindowNumBits:       6,
+		HashNumBits:         8,
+		MaxMatchDistance:    12,
+		MinMatchDistance:    2,
+		HasMaxMatchDistance: true,
+		HasMinMatchDistance: true,
+		TailLiteralBytes:    2,
+	})
+	_, _ = lz77.WriteString("aaaaaaaa")
+	_, _ = lz77.Skip(3)
+
+	var candidates [64]LZ77Candidate
+	count := lz77.MatchCandidates(candidates[:])
+	expect := []LZ77Candidate{
+		{Distance: 1, Length: 3, TooClose: true},
+		{Distance: 2, Length: 3},
+		{Distance: 3, Length: 3},
+	}
+	if actual := candidates[:count]; !reflect.DeepEqual(expect, actual) {
+		t.Errorf("MatchCandidates returned wrong result:\n\texpect: %+v\n\tactual: %+v", expect, actual)
+	}
+
+	lz77.Reset()
+	_, _ = lz77.WriteString("abcdabcdabcdabcXabcd")
+	_, _ = lz77.Skip(12)
+	_, _ = lz77.Skip(4)
+
+	count = lz77.MatchCandidates(candidates[:])
+	expect = []LZ77Candidate{
+		{Distance: 8, Length: 2},
+		{Distance: 12, Length: 2},
+		{Distance: 16, TooOld: true},
+	}
+	if actual := candidates[:count]; !reflect.DeepEqual(expect, actual) {
+		t.Errorf("MatchCandidates returned wrong result:\n\texpect: %+v\n\tactual: %+v", expect, actual)
+	}
+	if count := lz77.MatchCandidates(candidates[:1]); count != 1 {
+		t.Errorf("MatchCandidates with short dst returned %d, expected 1", count)
+	}
+
+	rng := rand.New(rand.NewSource(17))
+	words := strings.Fields("abra cadabra alakazam hocus pocus presto")
+	for step := 0; step < 2000; step++ {
+		if lz77.Len() < 8 {
+			_, _ = lz77.WriteString(words[rng.Intn(len(words))])
+		}
+
+		before := lz77.DebugString()
+		count = lz77.MatchCandidates(candidates[:])
+		if after := lz77.DebugString(); before != after {
+			t.Fatalf("step %d: MatchCandidates modified the LZ77", step)
+		}
+
+		var bestFound bool
+		var best LZ77Candidate
+		for index, cand := range candidates[:count] {
+			if cand.TooOld && index != count-1 {
+				t.Errorf("step %d: TooOld candidate is not last", step)
+			}
+			if cand.TooOld || cand.TooClose || cand.Length < lz77.Options().MinMatchLength {
+				continue
+			}
+			if !bestFound || cand.Length > best.Length {
+				bestFound = true
+				best = cand
+			}
+		}
+
+		_, distance, length, found := lz77.Advance()
+		if found != bestFound || (found && (distance != best.Distance || length != best.Length)) {
+			t.Fatalf("step %d: Advance disagrees with MatchCandidates:\n\texpect: (%d,%d) found=%t\n\tactual: (%d,%d) found=%t", step, best.Distance, best.Length, bestFound, distance, length, found)
+		}
+	}
+}
+
+func TestLZ77_PeekDiscard(t *testing.T) {
+	opts := LZ77Options{BufferNumBits: 4, WindowNumBits: 5, HashNumBits: 8}
+	lz77 := NewLZ77(opts)
+
+	var tmp [8]byte
+	if n, err := lz77.Peek(tmp[:]); n != 0 || err != ErrEmpty {
+		t.Errorf("Peek on empty LZ77 returned wrong result:\n\texpect: 0, %v\n\tactual: %d, %v", ErrEmpty, n, err)
+	}
+	if n, err := lz77.Discard(1); n != 0 || err != ErrEmpty {
+		t.Errorf("Discard on empty LZ77 returned wrong result:\n\texpect: 0, %v\n\tactual: %d, %v", ErrEmpty, n, err)
+	}
+
+	_, _ = lz77.WriteString("hello")
+	before := lz77.DebugString()
+	n, err := lz77.Peek(tmp[:])
+	if n != 5 || err != nil || string(tmp[:n]) != "hello" {
+		t.Errorf("Peek returned wrong result:\n\texpect: 5, <nil>, %q\n\tactual: %d, %v, %q", "hello", n, err, tmp[:n])
+	}
+	if after := lz77.DebugString(); before != after {
+		t.Errorf("Peek modified the LZ77:\n\tbefore: %s\n\tafter: %s", before, after)
+	}
+	if n, err := lz77.Peek(tmp[:2]); n != 2 || err != nil || string(tmp[:n]) != "he" {
+		t.Errorf("Peek with short buffer returned wrong result: %d, %v, %q", n, err, tmp[:n])
+	}
+
+	// Discard must leave the Window and hash chains exactly as Read does,
+	// including when the data wraps around the circular buffer.
+	rng := rand.New(rand.NewSource(19))
+	reader := NewLZ77(opts)
+	discarder := NewLZ77(opts)
+	for step := 0; step < 500; step++ {
+		var chunk [10]byte
+		for index := range chunk {
+			chunk[index] = byte('a' + rng.Intn(4))
+		}
+		written, _ := reader.Write(chunk[:rng.Intn(len(chunk))])
+		_, _ = discarder.Write(chunk[:written])
+
+		count := rng.Intn(12)
+		expectN, expectErr := reader.Read(make([]byte, count))
+		actualN, actualErr := discarder.Discard(uint(count))
+		if uint(expectN) != actualN || expectErr != actualErr {
+			t.Fatalf("step %d: Discard(%d) returned wrong result:\n\texpect: %d, %v\n\tactual: %d, %v", step, count, expectN, expectErr, actualN, actualErr)
+		}
+		if expect, actual := reader.DebugString(), discarder.DebugString(); expect != actual {
+			t.Fatalf("step %d: Discard left different state than Read:\n\texpect: %s\n\tactual: %s", step, expect, actual)
+		}
+	}
+}
+
+func TestLZ77_SetFinal(t *testing.T) {
+	rng := rand.New(rand.NewSource(23))
+	words := strings.Fields("abra cadabra alakazam hocus pocus presto")
+	var input []byte
+	for len(input) < 3000 {
+		input = append(input, words[rng.Intn(len(words))]...)
+	}
+
+	optsList := [...]LZ77Options{
+		{BufferNumBits: 6, WindowNumBits: 8, HashNumBits: 8, MaxMatchLength: 20, HasMaxMatchLength: true},
+		{BufferNumBits: 6, WindowNumBits: 8, HashNumBits: 0},
+		{BufferNumBits: 6, WindowNumBits: 8, HashNumBits: 8, TailLiteralBytes: 3, BackwardMatchExtension: true},
+	}
+
+	type token struct {
+		Bytes    string
+		Distance uint
+		Length   uint
+	}
+
+	tokenize := func(opts LZ77Options, chunkSize int) []token {
+		lz77 := NewLZ77(opts)
+		lz77.SetFinal(false)
+		var tokens []token
+		drain := func() {
+			for {
+				buf, distance, length, _ := lz77.Advance()
+				if buf == nil {
+					break
+				}
+				tokens = append(tokens, token{string(buf), distance, length})
+			}
+		}
+		for remaining := input; len(remaining) != 0; {
+			chunk := remaining
+			if len(chunk) > chunkSize {
+				chunk = chunk[:chunkSize]
+			}
+			written, _ := lz77.Write(chunk)
+			remaining = remaining[written:]
+			drain()
+			if !lz77.NeedsInput() {
+				t.Fatalf("Advance returned nil, but NeedsInput returned false")
+			}
+		}
+		lz77.SetFinal(true)
+		drain()
+		if !lz77.IsEmpty() || lz77.NeedsInput() {
+			t.Fatalf("LZ77 did not drain after SetFinal(true)")
+		}
+		return tokens
+	}
+
+	for index, opts := range optsList {
+		expect := tokenize(opts, len(input))
+		actual := tokenize(opts, 1)
+		if !reflect.DeepEqual(expect, actual) {
+			t.Errorf("opts[%d]: 1-byte writes produced different tokens than one big write", index)
+		}
+	}
+
+	lz77 := NewLZ77(optsList[0])
+	if !lz77.IsFinal() || lz77.NeedsInput() {
+		t.Errorf("new LZ77 is not final")
+	}
+	lz77.SetFinal(false)
+	_, _ = lz77.WriteString("abc")
+	if buf, _, _, _ := lz77.Advance(); buf != nil || !lz77.NeedsInput() {
+		t.Errorf("Advance consumed data within MaxMatchLength of the end while not final")
+	}
+
+	data, err := lz77.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary failed: %v", err)
+	}
+	var restored LZ77
+	if err := restored.UnmarshalBinary(data); err != nil {
+		t.Fatalf("UnmarshalBinary failed: %v", err)
+	}
+	if restored.IsFinal() {
+		t.Errorf("UnmarshalBinary did not preserve the final flag")
+	}
+
+	lz77.Reset()
+	if !lz77.IsFinal() {
+		t.Errorf("Reset did not make the LZ77 final")
+	}
+}
+
+func TestLZ77_NiceMatchLength(t *testing.T) {
+	// The newest candidate matches 6 bytes, and an older one matches 12.
+	const input = "abcdefghijklXabcdefYabcdefghijkl"
+
+	type testRow struct {
+		Nice   uint
+		Expect string
+	}
+
+	testData := [...]testRow{
+		{0, "(20,12)"},
+		{12, "(20,12)"},
+		{6, "(7,6)"},
+		{5, "(7,6)"},
+	}
+
+	for _, hashBits := range []uint{0, 8} {
+		for _, row := range testData {
+			lz77 := NewLZ77(LZ77Options{
+				BufferNumBits:   6,
+				WindowNumBits:   6,
+				HashNumBits:     hashBits,
+				NiceMatchLength: row.Nice,
+			})
+			_, _ = lz77.WriteString(input)
+			_, _ = lz77.Skip(20)
+			_, distance, length, found := lz77.Advance()
+			if actual := fmt.Sprintf("(%d,%d)", distance, length); !found || row.Expect != actual {
+				t.Errorf("hbits=%d NiceMatchLength=%d: Advance returned wrong match:\n\texpect: %s\n\tactual: %s found=%t", hashBits, row.Nice, row.Expect, actual, found)
+			}
+		}
+	}
+
+	// Every match must still respect the configured bounds.
+	rng := rand.New(rand.NewSource(29))
+	words := strings.Fields("abra cadabra alakazam hocus pocus presto")
+	lz77 := NewLZ77(LZ77Options{
+		BufferNumBits:       6,
+		WindowNumBits:       8,
+		HashNumBits:         8,
+		MinMatchLength:      5,
+		MaxMatchLength:      30,
+		MaxMatchDistance:    100,
+		HasMinMatchLength:   true,
+		HasMaxMatchLength:   true,
+		HasMaxMatchDistance: true,
+		NiceMatchLength:     8,
+	})
+	lz77.EnableSelfCheck()
+	var input2, output []byte
+	for step := 0; step < 1000; step++ {
+		word := words[rng.Intn(len(words))]
+		if written, _ := lz77.WriteString(word); written == len(word) {
+			input2 = append(input2, word...)
+		} else {
+			input2 = append(input2, word[:written]...)
+		}
+		for lz77.Len() > 16 {
+			buf, distance, length, found := lz77.Advance()
+			if !found {
+				output = append(output, buf...)
+				continue
+			}
+			if length < 5 || length > 30 || distance == 0 || distance > 100 {
+				t.Fatalf("step %d: match (%d,%d) violates bounds", step, distance, length)
+			}
+			for index := uint(0); index < length; index++ {
+				output = append(output, output[uint(len(output))-distance])
+			}
+		}
+	}
+	if !bytes.HasPrefix(input2, output) {
+		t.Errorf("decoded output does not match input")
+	}
+}
+
+func TestLZ77_HashInsertStride(t *testing.T) {
+	countHashed := func(lz77 *LZ77) int {
+		var total int
+		for index := uint64(0); index < lz77.htLastByHash.len(); index++ {
+			for currPlusOne := lz77.htLastByHash.get(index); currPlusOne > lz77.h; {
+				total++
+				currPlusOne = lz77.htPrevByIndex.get(lz77.phys(currPlusOne - 1))
+			}
+		}
+		return total
+	}
+
+	rng := rand.New(rand.NewSource(31))
+	noise := make([]byte, 200)
+	_, _ = rng.Read(noise)
+
+	// A long run of literals is hashed sparsely, but Skip still behaves
+	// exactly like the equivalent calls to Advance.
+	opts := LZ77Options{BufferNumBits: 8, WindowNumBits: 8, HashNumBits: 10, HashInsertStride: 4}
+	skipper := NewLZ77(opts)
+	advancer := NewLZ77(opts)
+	_, _ = skipper.Write(noise)
+	_, _ = advancer.Write(noise)
+	_, _ = skipper.Skip(2)
+	_, _ = skipper.Skip(150)
+	for step := 0; step < 152; step++ {
+		if _, _, _, found := advancer.Advance(); found {
+			t.Fatalf("step %d: unexpected match in noise", step)
+		}
+	}
+	if expect, actual := advancer.DebugString(), skipper.DebugString(); expect != actual {
+		t.Errorf("Skip left different state than Advance:\n\texpect: %s\n\tactual: %s", expect, actual)
+	}
+	if hashed, windowLen := countHashed(skipper), int(skipper.WindowLen()); hashed*2 > windowLen {
+		t.Errorf("expected sparse hashing, but %d of %d positions are hashed", hashed, windowLen)
+	}
+	if err := skipper.CheckInvariants(); err != nil {
+		t.Errorf("CheckInvariants failed: %v", err)
+	}
+
+	// Matches found with sparse hashing remain valid.
+	words := strings.Fields("abra cadabra alakazam hocus pocus presto")
+	lz77 := NewLZ77(LZ77Options{BufferNumBits: 6, WindowNumBits: 8, HashNumBits: 8, HashInsertStride: 4})
+	lz77.EnableSelfCheck()
+	var input, output []byte
+	for step := 0; step < 1000; step++ {
+		var chunk []byte
+		if rng.Intn(3) == 0 {
+			chunk = noise[:rng.Intn(32)]
+		} else {
+			chunk = []byte(words[rng.Intn(len(words))])
+		}
+		written, _ := lz77.Write(chunk)
+		input = append(input, chunk[:written]...)
+		for lz77.Len() > 16 {
+			buf, distance, length, found := lz77.Advance()
+			if !found {
+				output = append(output, buf...)
+				continue
+			}
+			for index := uint(0); index < length; index++ {
+				output = append(output, output[uint(len(output))-distance])
+			}
+		}
+		if err := lz77.CheckInvariants(); err != nil {
+			t.Fatalf("step %d: CheckInvariants failed: %v", step, err)
+		}
+	}
+	if !bytes.HasPrefix(input, output) {
+		t.Errorf("decoded output does not match input")
+	}
+}
+
+func TestLZ77_Checksum(t *testing.T) {
+	rng := rand.New(rand.NewSource(37))
+	words := strings.Fields("abra cadabra alakazam hocus pocus presto")
+	var input []byte
+	for len(input) < 20000 {
+		if rng.Intn(4) == 0 {
+			input = append(input, byte(rng.Intn(256)))
+		} else {
+			input = append(input, words[rng.Intn(len(words))]...)
+		}
+	}
+
+	castagnoli := crc32.MakeTable(crc32.Castagnoli)
+
+	type testRow struct {
+		Name   string
+		Enable func(*LZ77)
+		Sum    func([]byte) uint32
+	}
+
+	testData := [...]testRow{
+		{"crc32-ieee", func(lz77 *LZ77) { lz77.EnableChecksum(nil) }, crc32.ChecksumIEEE},
+		{"crc32-castagnoli", func(lz77 *LZ77) { lz77.EnableChecksum(castagnoli) }, func(p []byte) uint32 { return crc32.Checksum(p, castagnoli) }},
+		{"adler32", func(lz77 *LZ77) { lz77.EnableAdler32Checksum() }, adler32.Checksum},
+	}
+
+	for _, row := range testData {
+		lz77 := NewLZ77(LZ77Options{BufferNumBits: 6, WindowNumBits: 8, HashNumBits: 8})
+		lz77.SetWindow([]byte("dictionary bytes are not checksummed"))
+		row.Enable(lz77)
+
+		var tokens [4]LZ77Token
+		var tmp [8]byte
+		remaining := input
+		for len(remaining) != 0 || !lz77.IsEmpty() {
+			written, _ := lz77.Write(remaining)
+			remaining = remaining[written:]
+			for lz77.Len() > 8 || (len(remaining) == 0 && !lz77.IsEmpty()) {
+				switch rng.Intn(9) {
+				case 0:
+					_, _, _, _ = lz77.Advance()
+				case 1:
+					_ = lz77.AdvanceToken()
+				case 2:
+					_ = lz77.AdvanceAll(tokens[:rng.Intn(len(tokens))])
+				case 3:
+					_ = lz77.AdvanceLiteralRun(uint(rng.Intn(8)))
+				case 4:
+					_, _ = lz77.Skip(uint(rng.Intn(8)))
+				case 5:
+					_, _ = lz77.Read(tmp[:rng.Intn(len(tmp))])
+				case 6:
+					_, _ = lz77.ReadByte()
+				case 7:
+					_, _ = lz77.Discard(uint(rng.Intn(8)))
+				case 8:
+					buf := lz77.PrepareBulkRead(uint(rng.Intn(8)))
+					lz77.CommitBulkRead(uint(len(buf)))
+				}
+			}
+		}
+
+		if expect, actual := row.Sum(input), lz77.Checksum(); expect != actual {
+			t.Errorf("%s: Checksum returned wrong result:\n\texpect: %#08x\n\tactual: %#08x", row.Name, expect, actual)
+		}
+
+		lz77.ResetChecksum()
+		_, _ = lz77.WriteString("abc")
+		_, _ = lz77.Skip(3)
+		if expect, actual := row.Sum([]byte("abc")), lz77.Checksum(); expect != actual {
+			t.Errorf("%s: Checksum after ResetChecksum returned wrong result:\n\texpect: %#08x\n\tactual: %#08x", row.Name, expect, actual)
+		}
+
+		lz77.DisableChecksum()
+		if actual := lz77.Checksum(); actual != 0 {
+			t.Errorf("%s: Checksum after DisableChecksum returned %#08x, expected 0", row.Name, actual)
+		}
+	}
+}
+
+func TestLZ77_AppendWindow(t *testing.T) {
+	opts := LZ77Options{BufferNumBits: 6, WindowNumBits: 8, HashNumBits: 8}
+
+	lz77 := NewLZ77(opts)
+	lz77.SetWindow([]byte("hello world, "))
+	_, _ = lz77.WriteString("hello moon, goodbye world")
+	lz77.AppendWindow([]byte("goodbye moon, "))
+	if err := lz77.CheckInvariants(); err != nil {
+		t.Errorf("CheckInvariants failed after AppendWindow: %v", err)
+	}
+	if expect, actual := "hello world, goodbye moon, ", string(lz77.WindowBytes()); expect != actual {
+		t.Errorf("WindowBytes returned wrong result:\n\texpect: %q\n\tactual: %q", expect, actual)
+	}
+	if expect, actual := "hello moon, goodbye world", string(lz77.BufferBytes()); expect != actual {
+		t.Errorf("BufferBytes returned wrong result:\n\texpect: %q\n\tactual: %q", expect, actual)
+	}
+
+	// Appending must be indistinguishable from setting the whole dictionary
+	// at once.
+	ref := NewLZ77(opts)
+	ref.SetWindow([]byte("hello world, goodbye moon, "))
+	_, _ = ref.WriteString("hello moon, goodbye world")
+
+	var tokens []LZ77Token
+	for step := 0; !lz77.IsEmpty(); step++ {
+		expect := ref.AdvanceToken()
+		actual := lz77.AdvanceToken()
+		if !bytes.Equal(expect.Bytes, actual.Bytes) || expect.IsMatch != actual.IsMatch || expect.Distance != actual.Distance || expect.Length != actual.Length {
+			t.Errorf("step %d: tokens differ:\n\texpect: %+v\n\tactual: %+v", step, expect, actual)
+			break
+		}
+		tokens = append(tokens, actual)
+	}
+
+	// "hello " lies in the original Window, and "moon, " in the appended
+	// data.
+	if len(tokens) < 2 || tokens[0].Distance != 27 || tokens[0].Length != 6 || tokens[1].Distance != 12 || tokens[1].Length != 6 {
+		t.Errorf("wrong tokens: %+v", tokens)
+	}
+
+	type testRow struct {
+		Name    string
+		Options LZ77Options
+	}
+
+	testData := [...]testRow{
+		{"standard", LZ77Options{BufferNumBits: 4, WindowNumBits: 6, HashNumBits: 6, MaxMatchDistance: 40, HasMaxMatchDistance: true}},
+		{"stride", LZ77Options{BufferNumBits: 4, WindowNumBits: 6, HashNumBits: 6, HashInsertStride: 3}},
+		{"no-hash", LZ77Options{BufferNumBits: 4, WindowNumBits: 6, MinMatchLength: 2, HasMinMatchLength: true}},
+	}
+
+	rng := rand.New(rand.NewSource(47))
+	randomBytes := func(n int) []byte {
+		out := make([]byte, n)
+		for index := range out {
+			out[index] = "abc"[rng.Intn(3)]
+		}
+		return out
+	}
+
+	for _, row := range testData {
+		lz77 := NewLZ77(row.Options)
+		maxDist := int(lz77.Options().MaxMatchDistance)
+		for step := 0; step < 2000; step++ {
+			switch rng.Intn(3) {
+			case 0:
+				_, _ = lz77.Write(randomBytes(rng.Intn(8)))
+			case 1:
+				_, _, _, _ = lz77.Advance()
+			case 2:
+				data := randomBytes(rng.Intn(50))
+				expectWindow := append(lz77.WindowBytes(), data...)
+				if x := len(expectWindow) - maxDist; x > 0 {
+					expectWindow = expectWindow[x:]
+				}
+				expectBuffer := lz77.BufferBytes()
+				lz77.AppendWindow(data)
+				if actual := lz77.WindowBytes(); !bytes.Equal(expectWindow, actual) {
+					t.Fatalf("%s: step %d: WindowBytes returned wrong result:\n\texpect: %q\n\tactual: %q", row.Name, step, expectWindow, actual)
+				}
+				if actual := lz77.BufferBytes(); !bytes.Equal(expectBuffer, actual) {
+					t.Fatalf("%s: step %d: BufferBytes returned wrong result:\n\texpect: %q\n\tactual: %q", row.Name, step, expectBuffer, actual)
+				}
+			}
+			if err := lz77.CheckInvariants(); err != nil {
+				t.Fatalf("%s: step %d: CheckInvariants failed: %v\n%s", row.Name, step, err, lz77.DebugString())
+			}
+		}
+	}
+}
+
+func TestLZ77_GrowBuffer(t *testing.T) {
+	rng := rand.New(rand.NewSource(41))
+	words := strings.Fields("the quick brown fox jumps over the lazy dog again and again")
+	var input []byte
+	for len(input) < 8192 {
+		if rng.Intn(8) == 0 {
+			input = append(input, byte(rng.Intn(256)))
+		} else {
+			input = append(input, words[rng.Intn(len(words))]...)
+			input = append(input, ' ')
+		}
+	}
+
+	type testRow struct {
+		Name    string
+		Options LZ77Options
+	}
+
+	testData := [...]testRow{
+		{"standard", LZ77Options{BufferNumBits: 6, WindowNumBits: 10, HashNumBits: 10, MaxMatchLength: 32, HasMaxMatchLength: true}},
+		{"stride", LZ77Options{BufferNumBits: 6, WindowNumBits: 10, HashNumBits: 10, MaxMatchLength: 32, HasMaxMatchLength: true, HashInsertStride: 4}},
+		{"no-hash", LZ77Options{BufferNumBits: 6, WindowNumBits: 10, MinMatchLength: 3, HasMinMatchLength: true, MaxMatchLength: 32, HasMaxMatchLength: true}},
+	}
+
+	const split = 5000
+	const chunk = 40
+
+	for _, row := range testData {
+		small := NewLZ77(row.Options)
+		grown := NewLZ77(row.Options)
+
+		// Feed both the same prefix, leaving data pending in the Buffer.
+		for pos := 0; pos < split; pos += chunk {
+			for _, lz77 := range [2]*LZ77{small, grown} {
+				_, _ = lz77.Write(input[pos : pos+chunk])
+				for lz77.Len() > 8 {
+					_, _, _, _ = lz77.Advance()
+				}
+			}
+		}
+
+		if err := grown.GrowBuffer(12); err != nil {
+			t.Errorf("%s: GrowBuffer failed: %v", row.Name, err)
+			continue
+		}
+		if err := grown.CheckInvariants(); err != nil {
+			t.Errorf("%s: CheckInvariants failed after GrowBuffer: %v", row.Name, err)
+		}
+		if expect, actual := uint(4096), grown.BufferSize(); expect != actual {
+			t.Errorf("%s: BufferSize returned wrong result: expected %d, got %d", row.Name, expect, actual)
+		}
+		if expect, actual := small.WindowBytes(), grown.WindowBytes(); !bytes.Equal(expect, actual) {
+			t.Errorf("%s: Window differs after GrowBuffer", row.Name)
+		}
+		if expect, actual := small.BufferBytes(), grown.BufferBytes(); !bytes.Equal(expect, actual) {
+			t.Errorf("%s: Buffer differs after GrowBuffer", row.Name)
+		}
+
+		// The next chunk fits in both, so the tokens must not differ.
+		_, _ = small.Write(input[split : split+chunk])
+		_, _ = grown.Write(input[split : split+chunk])
+		for step := 0; !small.IsEmpty(); step++ {
+			expect := small.AdvanceToken()
+			actual := grown.AdvanceToken()
+			if !bytes.Equal(expect.Bytes, actual.Bytes) || expect.IsMatch != actual.IsMatch || expect.Distance != actual.Distance || expect.Length != actual.Length {
+				t.Errorf("%s: step %d: tokens differ after GrowBuffer:\n\texpect: %+v\n\tactual: %+v", row.Name, step, expect, actual)
+				break
+			}
+		}
+
+		// The grown LZ77 must keep working with its larger Buffer.
+		var output []byte
+		output = append(output, grown.WindowBytes()...)
+		_, _ = grown.Write(input[split+chunk:])
+		for !grown.IsEmpty() {
+			buf, _, _, _ := grown.Advance()
+			output = append(output, buf...)
+		}
+		if err := grown.CheckInvariants(); err != nil {
+			t.Errorf("%s: CheckInvariants failed: %v", row.Name, err)
+		}
+		if !bytes.HasSuffix(input, output) {
+			t.Errorf("%s: output after GrowBuffer is not a suffix of the input", row.Name)
+		}
+	}
+
+	lz77 := NewLZ77(LZ77Options{BufferNumBits: 6, WindowNumBits: 8, HashNumBits: 8})
+	_, _ = lz77.Write(input[:40])
+	if err := lz77.GrowBuffer(5); !errors.Is(err, ErrFull) {
+		t.Errorf("GrowBuffer to 32 bytes with 40 pending: expected ErrFull, got %v", err)
+	}
+	if err := lz77.GrowBuffer(1); !errors.Is(err, ErrBadOptions) {
+		t.Errorf("GrowBuffer to 2 bytes: expected ErrBadOptions, got %v", err)
+	}
+	if expect, actual := uint(64), lz77.BufferSize(); expect != actual {
+		t.Errorf("BufferSize changed after failed GrowBuffer: expected %d, got %d", expect, actual)
+	}
+	if err := lz77.GrowBuffer(8); err != nil {
+		t.Errorf("GrowBuffer failed: %v", err)
+	}
+	if expect, actual := uint(256), lz77.Options().MaxMatchLength; expect != actual {
+		t.Errorf("MaxMatchLength did not follow the buffer size: expected %d, got %d", expect, actual)
+	}
+	if expect, actual := input[:40], lz77.BufferBytes(); !bytes.Equal(expect, actual) {
+		t.Errorf("Buffer differs after GrowBuffer:\n\texpect: %q\n\tactual: %q", expect, actual)
+	}
+}
+
+func TestLZ77_SetWindowFromReader(t *testing.T) {
+	rng := rand.New(rand.NewSource(3))
+	dict := make([]byte, 300)
+	for index := range dict {
+		dict[index] = "abcdefgh"[rng.Intn(8)]
+	}
+
+	type testRow struct {
+		N       uint
+		MaxDist uint
+	}
+
+	testData := [...]testRow{
+		{0, 64},
+		{10, 64},
+		{64, 64},
+		{65, 64},
+		{200, 64},
+		{300, 64},
+		{400, 64},
+		{200, 50},
+		{200, 0},
+	}
+
+	// DataErrReader reads ahead, so it consumes more than it returns.
+	wrappers := [...]struct {
+		Name  string
+		Wrap  func(io.Reader) io.Reader
+		Exact bool
+	}{
+		{"plain", func(r io.Reader) io.Reader { return r }, true},
+		{"onebyte", iotest.OneByteReader, true},
+		{"half", iotest.HalfReader, true},
+		{"dataerr", iotest.DataErrReader, false},
+	}
+
+	for _, row := range testData {
+		for _, wrapper := range wrappers {
+			opts := LZ77Options{
+				BufferNumBits: 5,
+				WindowNumBits: 6,
+				HashNumBits:   8,
+			}
+			if row.MaxDist == 0 {
+				opts.MaxMatchLength = 0
+				opts.HasMaxMatchLength = true
+				opts.HashNumBits = 0
+			} else {
+				opts.MaxMatchDistance = row.MaxDist
+				opts.HasMaxMatchDistance = true
+			}
+
+			newLZ77 := func() *LZ77 {
+				lz77 := NewLZ77(opts)
+				_, _ = lz77.WriteString("0123456789abcdef")
+				_, _ = lz77.Skip(5)
+				return lz77
+			}
+
+			prefix := dict
+			if row.N < uint(len(dict)) {
+				prefix = dict[:row.N]
+			}
+			expect := newLZ77()
+			expect.SetWindow(prefix)
+
+			r := bytes.NewReader(dict)
+			actual := newLZ77()
+			err := actual.SetWindowFromReader(wrapper.Wrap(r), row.N)
+			if err != nil {
+				t.Errorf("n=%d maxDist=%d reader=%s: SetWindowFromReader returned unexpected error: %v", row.N, row.MaxDist, wrapper.Name, err)
+			}
+			if consumed := uint(len(dict) - r.Len()); wrapper.Exact && consumed != uint(len(prefix)) {
+				t.Errorf("n=%d maxDist=%d reader=%s: SetWindowFromReader consumed wrong number of bytes:\n\texpect: %d\n\tactual: %d", row.N, row.MaxDist, wrapper.Name, len(prefix), consumed)
+			}
+			if a, b := expect.DebugString(), actual.DebugString(); a != b {
+				t.Errorf("n=%d maxDist=%d reader=%s: SetWindowFromReader disagrees with SetWindow:\n\texpect: %s\n\tactual: %s", row.N, row.MaxDist, wrapper.Name, a, b)
+			}
+		}
+	}
+
+	errBoom := errors.New("boom")
+	lz77 := NewLZ77(LZ77Options{BufferNumBits: 5, WindowNumBits: 6, HashNumBits: 8})
+	lz77.SetWindow(dict[:40])
+	r := io.MultiReader(bytes.NewReader(dict[:20]), iotest.ErrReader(errBoom))
+	if err := lz77.SetWindowFromReader(r, 100); err != errBoom {
+		t.Errorf("SetWindowFromReader returned wrong error:\n\texpect: %v\n\tactual: %v", errBoom, err)
+	}
+	if !lz77.IsWindowEmpty() {
+		t.Errorf("SetWindowFromReader left %d bytes in the window after an error", lz77.WindowLen())
+	}
+
+	// The Reader overwrites all of its buffer, but returns only the first
+	// byte, so it must not be given the oldest bytes to keep.
+	opts := LZ77Options{BufferNumBits: 5, WindowNumBits: 6, HashNumBits: 8}
+	expect := NewLZ77(opts)
+	expect.SetWindow(bytes.Repeat([]byte("!"), 100))
+	actual := NewLZ77(opts)
+	if err := actual.SetWindowFromReader(&shortScribbleReader{remaining: 100}, 200); err != nil {
+		t.Errorf("SetWindowFromReader returned unexpected error: %v", err)
+	}
+	if a, b := expect.DebugString(), actual.DebugString(); a != b {
+		t.Errorf("SetWindowFromReader let the Reader scribble on the window:\n\texpect: %s\n\tactual: %s", a, b)
+	}
+}
+
+// shortScribbleReader is like scribbleReader, but reaches EOF once it has
+// returned the given number of bytes.
+type shortScribbleReader struct {
+	remaining int
+}
+
+func (r *shortScribbleReader) Read(p []byte) (int, error) {
+	nn, err := scribbleReader{}.Read(p)
+	if r.remaining == 0 {
+		return 0, io.EOF
+	}
+	r.remaining -= nn
+	return nn, err
+}
+
+func TestLZ77_ScoreMatch(t *testing.T) {
+	// Each unit of distance costs as much as a quarter byte of length.
+	closer := func(distance, length uint) int {
+		return 4*int(length) - int(distance)
+	}
+
+	type testRow struct {
+		Name     string
+		Score    func(distance, length uint) int
+		MinScore int
+		HasMin   bool
+		Expect   string
+	}
+
+	testData := [...]testRow{
+		{"longest", nil, 0, false, "(28,8)"},
+		{"closer", closer, 0, false, "(4,4) (28,4)"},
+		{"closer/floor-ok", closer, 12, true, "(4,4) e f g h"},
+		{"closer/floor-reject", closer, 13, true, "a b c d e f g h"},
+		{"longest/floor-ignored", nil, 1000, true, "(28,8)"},
+	}
+
+	for _, hashBits := range []uint{0, 8} {
+		for _, row := range testData {
+			var lz77 LZ77
+			lz77.Init(LZ77Options{
+				BufferNumBits:    4,
+				WindowNumBits:    5,
+				HashNumBits:      hashBits,
+				ScoreMatch:       row.Score,
+				MinMatchScore:    row.MinScore,
+				HasMinMatchScore: row.HasMin,
+			})
+			lz77.SetWindow([]byte("abcdefgh................abcd"))
+			_, _ = lz77.WriteString("abcdefgh")
+
+			var tokens []string
+			for !lz77.IsEmpty() {
+				buf, dist, length, found := lz77.Advance()
+				if found {
+					tokens = append(tokens, fmt.Sprintf("(%d,%d)", dist, length))
+				} else {
+					tokens = append(tokens, string(buf))
+				}
+			}
+			if actual := strings.Join(tokens, " "); row.Expect != actual {
+				t.Errorf("hbits=%d %s: Advance produced wrong tokens:\n\texpect: %s\n\tactual: %s", hashBits, row.Name, row.Expect, actual)
+			}
+		}
+	}
+
+	lz77 := NewLZ77(LZ77Options{BufferNumBits: 4, ScoreMatch: closer})
+	if !lz77.Options().Equal(LZ77Options{BufferNumBits: 4, ScoreMatch: closer}.Normalize()) {
+		t.Errorf("Options does not preserve ScoreMatch")
+	}
+	if lz77.Options().Equal(LZ77Options{BufferNumBits: 4}.Normalize()) {
+		t.Errorf("Equal ignores ScoreMatch")
+	}
+
+	penalty := func(k int) func(distance, length uint) int {
+		return func(distance, length uint) int {
+			return k*int(length) - int(distance)
+		}
+	}
+	two, three := penalty(2), penalty(3)
+	if !(LZ77Options{ScoreMatch: two}).Equal(LZ77Options{ScoreMatch: two}) {
+		t.Errorf("Equal does not match a ScoreMatch closure to itself")
+	}
+	if !(LZ77Options{ScoreMatch: two}).Equal(LZ77Options{ScoreMatch: three}) {
+		t.Errorf("Equal distinguishes non-nil ScoreMatch closures")
+	}
+	if _, err := lz77.MarshalBinary(); !errors.Is(err, ErrBadOptions) {
+		t.Errorf("MarshalBinary returned wrong error with ScoreMatch:\n\texpect: %v\n\tactual: %v", ErrBadOptions, err)
+	}
+}
+
+func TestLZ77_RepeatOffset(t *testing.T) {
+	type testRow struct {
+		Input  string
+		Bias   uint
+		Expect string
+	}
+
+	// Tokens marked with '*' reuse the previous match's distance.
+	testData := [...]testRow{
+		{"abcdeXabcdeYabcde", 0, "a b c d e X (6,5) Y (6,5)*"},
+		{"abcd1234abcd5678abcd1234", 0, "a b c d 1 2 3 4 (8,4) 5 6 7 8 (16,8)"},
+		{"abcd1234abcd5678abcd1234", 4, "a b c d 1 2 3 4 (8,4) 5 6 7 8 (16,8)"},
+		{"abcd1234abcd5678abcd1234", 5, "a b c d 1 2 3 4 (8,4) 5 6 7 8 (8,4)* (16,4)"},
+		{"abcd1234abcd5678abcd12", 2, "a b c d 1 2 3 4 (8,4) 5 6 7 8 (16,6)"},
+		{"abcd1234abcd5678abcd12", 3, "a b c d 1 2 3 4 (8,4) 5 6 7 8 (8,4)* 1 2"},
+	}
+
+	for _, hashBits := range []uint{0, 8} {
+		for _, row := range testData {
+			var lz77 LZ77
+			lz77.Init(LZ77Options{
+				BufferNumBits:    5,
+				WindowNumBits:    5,
+				HashNumBits:      hashBits,
+				RepeatOffsetBias: row.Bias,
+			})
+			_, _ = lz77.WriteString(row.Input)
+
+			var tokens []string
+			for !lz77.IsEmpty() {
+				token := lz77.AdvanceToken()
+				str := string(token.Bytes)
+				if token.IsMatch {
+					str = fmt.Sprintf("(%d,%d)", token.Distance, token.Length)
+				}
+				if token.IsRepeatOffset {
+					str += "*"
+				}
+				tokens = append(tokens, str)
+			}
+			if actual := strings.Join(tokens, " "); row.Expect != actual {
+				t.Errorf("hbits=%d RepeatOffsetBias=%d input=%q: AdvanceToken produced wrong tokens:\n\texpect: %s\n\tactual: %s", hashBits, row.Bias, row.Input, row.Expect, actual)
+			}
+		}
+	}
+
+	lz77 := NewLZ77(LZ77Options{BufferNumBits: 5, WindowNumBits: 5})
+	_, _ = lz77.WriteString("abcdXabcd")
+	for !lz77.IsEmpty() {
+		_, _, _, _ = lz77.Advance()
+	}
+	if actual := lz77.LastMatchDistance(); actual != 5 {
+		t.Errorf("LastMatchDistance returned wrong value:\n\texpect: %d\n\tactual: %d", 5, actual)
+	}
+	lz77.Reset()
+	if actual := lz77.LastMatchDistance(); actual != 0 {
+		t.Errorf("LastMatchDistance returned wrong value after Reset:\n\texpect: %d\n\tactual: %d", 0, actual)
+	}
+}
+
+func TestLZ77_SetMatchingEnabled(t *testing.T) {
+	opts := LZ77Options{
+		BufferNumBits: 6,
+		WindowNumBits: 8,
+		HashNumBits:   10,
+	}
+	input := strings.Repeat("abracadabra, alakazam! ", 20)
+
+	// The first drain bytes of the input are removed with Read, with
+	// matching either enabled throughout or disabled during the drain.
+	// Either way, the tokens which follow must be identical.
+	const drain = 300
+	run := func(disable bool) []lz77Token {
+		lz77 := NewLZ77(opts)
+		lz77.SetMatchingEnabled(!disable)
+		var tokens []lz77Token
+		var tmp [7]byte
+		remaining := input
+		drained := 0
+		for len(remaining) != 0 || !lz77.IsEmpty() {
+			nn, _ := lz77.WriteString(remaining)
+			remaining = remaining[nn:]
+			for drained < drain && !lz77.IsEmpty() {
+				want := drain - drained
+				if want > len(tmp) {
+					want = len(tmp)
+				}
+				nn, _ := lz77.Read(tmp[:want])
+				drained += nn
+			}
+			if drained < drain {
+				continue
+			}
+			lz77.SetMatchingEnabled(true)
+			for index := 0; index < 5 && !lz77.IsEmpty(); index++ {
+				buf, dist, length, found := lz77.Advance()
+				tokens = append(tokens, lz77Token{string(buf), dist, length, found})
+			}
+		}
+		return tokens
+	}
+
+	expect := run(false)
+	actual := run(true)
+	if len(expect) != len(actual) {
+		t.Fatalf("wrong number of tokens after re-enabling matching:\n\texpect: %d\n\tactual: %d", len(expect), len(actual))
+	}
+	for index := range expect {
+		if expect[index] != actual[index] {
+			t.Fatalf("wrong token #%d after re-enabling matching:\n\texpect: %+v\n\tactual: %+v", index, expect[index], actual[index])
+		}
+	}
+
+	lz77 := NewLZ77(opts)
+	lz77.SetMatchingEnabled(false)
+	_, _ = lz77.WriteString("abcdabcd")
+	for !lz77.IsEmpty() {
+		buf, _, _, found := lz77.Advance()
+		if found || len(buf) != 1 {
+			t.Errorf("Advance returned a match while matching was disabled: buf=%q found=%v", buf, found)
+		}
+	}
+
+	data, err := lz77.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary failed unexpectedly: %v", err)
+	}
+	restored := new(LZ77)
+	if err := restored.UnmarshalBinary(data); err != nil {
+		t.Fatalf("UnmarshalBinary failed unexpectedly: %v", err)
+	}
+	if restored.MatchingEnabled() {
+		t.Errorf("UnmarshalBinary did not preserve disabled matching")
+	}
+
+	lz77.Reset()
+	if !lz77.MatchingEnabled() {
+		t.Errorf("Reset did not re-enable matching")
+	}
+}
+
+func TestLZ77_InitE(t *testing.T) {
+	type testRow struct {
+		Name   string
+		Opts   LZ77Options
+		Expect string
+	}
+
+	testData := [...]testRow{
+		{"defaults", LZ77Options{BufferNumBits: 4}, ""},
+		{"buffer-too-small", LZ77Options{BufferNumBits: 1}, "invalid options: BufferNumBits 1 must be at least 2"},
+		{
+			"bits-too-large",
+			LZ77Options{BufferNumBits: lz77MaxBufferNumBits + 1, WindowNumBits: lz77MaxWindowNumBits + 1, HashNumBits: 33},
+			fmt.Sprintf("invalid options: BufferNumBits %d must not exceed %d; WindowNumBits %d must not exceed %d; HashNumBits 33 must not exceed 32", lz77MaxBufferNumBits+1, lz77MaxBufferNumBits, lz77MaxWindowNumBits+1, lz77MaxWindowNumBits),
+		},
+		{"minlen/unset", LZ77Options{BufferNumBits: 4, MinMatchLength: 17}, ""},
+		{
+			"minlen/set",
+			LZ77Options{BufferNumBits: 4, MinMatchLength: 17, HasMinMatchLength: true},
+			"invalid options: MinMatchLength 17 > buffer capacity 16",
+		},
+		{
+			"minlen/set/no-matching",
+			LZ77Options{BufferNumBits: 4, MinMatchLength: 17, MaxMatchLength: 0, HasMinMatchLength: true, HasMaxMatchLength: true},
+			"invalid options: MinMatchLength 17 > buffer capacity 16",
+		},
+		{"minlen>maxlen/unset", LZ77Options{BufferNumBits: 4, MinMatchLength: 9, MaxMatchLength: 8}, ""},
+		{
+			"minlen>maxlen/min-only",
+			LZ77Options{BufferNumBits: 4, MinMatchLength: 9, MaxMatchLength: 8, HasMinMatchLength: true},
+			"",
+		},
+		{
+			"minlen>maxlen/max-only",
+			LZ77Options{BufferNumBits: 4, MinMatchLength: 9, MaxMatchLength: 3, HasMaxMatchLength: true},
+			"invalid options: MinMatchLength 4 > MaxMatchLength 3",
+		},
+		{
+			"minlen>maxlen/both",
+			LZ77Options{BufferNumBits: 4, MinMatchLength: 9, MaxMatchLength: 8, HasMinMatchLength: true, HasMaxMatchLength: true},
+			"invalid options: MinMatchLength 9 > MaxMatchLength 8",
+		},
+		{
+			"minlen>maxlen/with-other-problems",
+			LZ77Options{BufferNumBits: 4, WindowNumBits: 3, MinMatchLength: 9, MaxMatchLength: 8, MinMatchDistance: 9, HashNumBits: 33, HasMinMatchLength: true, HasMaxMatchLength: true, HasMinMatchDistance: true},
+			"invalid options: HashNumBits 33 must not exceed 32; MinMatchDistance 9 > MaxMatchDistance 8; MinMatchLength 9 > MaxMatchLength 8",
+		},
+		{"mindist/unset", LZ77Options{BufferNumBits: 4, WindowNumBits: 3, MinMatchDistance: 9}, ""},
+		{
+			"mindist/set",
+			LZ77Options{BufferNumBits: 4, WindowNumBits: 3, MinMatchDistance: 9, HasMinMatchDistance: true},
+			"invalid options: MinMatchDistance 9 > MaxMatchDistance 8",
+		},
+		{
+			"mindist/set/maxdist-set",
+			LZ77Options{BufferNumBits: 4, WindowNumBits: 5, MinMatchDistance: 9, MaxMatchDistance: 8, HasMinMatchDistance: true, HasMaxMatchDistance: true},
+			"invalid options: MinMatchDistance 9 > MaxMatchDistance 8",
+		},
+		{
+			"mindist/set/no-matching",
+			LZ77Options{BufferNumBits: 4, WindowNumBits: 5, MinMatchDistance: 9, MaxMatchDistance: 0, HasMinMatchDistance: true, HasMaxMatchDistance: true},
+			"",
+		},
+	}
+
+	for _, row := range testData {
+		var lz77 LZ77
+		lz77.Init(LZ77Options{BufferNumBits: 3, WindowNumBits: 2})
+		_, _ = lz77.WriteString("abc")
+
+		err := lz77.InitE(row.Opts)
+		actual := ""
+		if err != nil {
+			actual = err.Error()
+			if !errors.Is(err, ErrBadOptions) {
+				t.Errorf("%s: InitE returned error which does not wrap ErrBadOptions: %v", row.Name, err)
+			}
+			if lz77.BufferNumBits() != 3 || lz77.WindowNumBits() != 2 || string(lz77.BufferBytesView()) != "abc" {
+				t.Errorf("%s: InitE modified the LZ77 on error: %#v", row.Name, lz77)
+			}
+		} else if !lz77.Options().Equal(row.Opts.Normalize()) || !lz77.IsEmpty() {
+			t.Errorf("%s: InitE did not initialize the LZ77: %#v", row.Name, lz77)
+		}
+		if row.Expect != actual {
+			t.Errorf("%s: InitE returned wrong error:\n\texpect: %q\n\tactual: %q", row.Name, row.Expect, actual)
+		}
+
+		if p, err := NewLZ77E(row.Opts); (err == nil) != (row.Expect == "") || (p == nil) != (err != nil) {
+			t.Errorf("%s: NewLZ77E returned wrong result: %v, %v", row.Name, p, err)
+		}
+	}
+}
+
+func TestLZ77_CheckInvariants(t *testing.T) {
+	rng := rand.New(rand.NewSource(42))
+	words := strings.Fields("abra cadabra alakazam hocus pocus presto")
+	randBytes := func() []byte {
+		var sb strings.Builder
+		for count := rng.Intn(4); count >= 0; count-- {
+			sb.WriteString(words[rng.Intn(len(words))])
+		}
+		return []byte(sb.String())
+	}
+
+	for _, hashBits := range []uint{0, 4, 10} {
+		lz77 := NewLZ77(LZ77Options{
+			BufferNumBits: 5,
+			WindowNumBits: 6,
+			HashNumBits:   hashBits,
+		})
+		var tmp [9]byte
+		for step := 0; step < 3000; step++ {
+			op := rng.Intn(12)
+			switch op {
+			case 0, 1, 2:
+				_, _ = lz77.Write(randBytes())
+			case 3:
+				_ = lz77.WriteByte(byte('a' + rng.Intn(3)))
+			case 4:
+				_, _ = lz77.WriteMatch(uint(1+rng.Intn(16)), uint(rng.Intn(12)))
+			case 5, 6, 7:
+				_, _, _, _ = lz77.Advance()
+			case 8:
+				_, _ = lz77.Read(tmp[:rng.Intn(len(tmp))])
+			case 9:
+				_, _ = lz77.Skip(uint(rng.Intn(6)))
+			case 10:
+				if rng.Intn(10) == 0 {
+					lz77.SetWindow(randBytes())
+				} else {
+					lz77.SetMatchingEnabled(rng.Intn(3) != 0)
+				}
+			case 11:
+				if rng.Intn(20) == 0 {
+					lz77.Reset()
+				} else {
+					buf := lz77.PrepareBulkRead(uint(rng.Intn(5)))
+					lz77.CommitBulkRead(uint(len(buf)))
+				}
+			}
+			if err := lz77.CheckInvariants(); err != nil {
+				t.Fatalf("hbits=%d step=%d op=%d: CheckInvariants failed: %v\n%s", hashBits, step, op, err, lz77.DebugString())
+			}
+		}
+	}
+
+	corrupt := func(name string, mutate func(lz77 *LZ77, last uint64)) {
+		t.Helper()
+		lz77 := NewLZ77(LZ77Options{BufferNumBits: 5, WindowNumBits: 6, HashNumBits: 8})
+		_, _ = lz77.WriteString("abcdXabcdYabcdZ")
+		for !lz77.IsEmpty() {
+			_, _, _, _ = lz77.Advance()
+		}
+		_, _ = lz77.WriteString("abcd")
+		if err := lz77.CheckInvariants(); err != nil {
+			t.Fatalf("%s: CheckInvariants failed before corruption: %v", name, err)
+		}
+		hash := hash4([]byte("abcd"), lz77.hashMask)
+		mutate(lz77, lz77.htLastByHash.get(uint64(hash))-1)
+		if err := lz77.CheckInvariants(); !errors.Is(err, ErrInvariant) {
+			t.Errorf("%s: CheckInvariants returned wrong error:\n\texpect: %v\n\tactual: %v", name, ErrInvariant, err)
+		}
+	}
+
+	corrupt("missing", func(lz77 *LZ77, last uint64) {
+		lz77.htLastByHash.set(uint64(hash4(lz77.slice[last:], lz77.hashMask)), lz77.htPrevByIndex.get(last))
+	})
+	corrupt("duplicate", func(lz77 *LZ77, last uint64) {
+		lz77.htPrevByIndex.set(last, last+1)
+	})
+	corrupt("wrong-bucket", func(lz77 *LZ77, last uint64) {
+		lz77.htPrevByIndex.set(last, last)
+	})
+	corrupt("beyond-end", func(lz77 *LZ77, last uint64) {
+		lz77.htLastByHash.set(uint64(hash4(lz77.slice[last:], lz77.hashMask)), lz77.i)
+	})
+	corrupt("bounds", func(lz77 *LZ77, last uint64) {
+		lz77.h = lz77.i + 1
+	})
+}
+
+func TestLZ77_NarrowRebase(t *testing.T) {
+	opts := LZ77Options{
+		BufferNumBits: 10,
+		WindowNumBits: 12,
+		HashNumBits:   12,
+	}
+
+	rng := rand.New(rand.NewSource(5))
+	words := strings.Fields("alpha beta gamma delta epsilon")
+	var sb strings.Builder
+	for sb.Len() < 1<<16 {
+		sb.WriteString(words[rng.Intn(len(words))])
+		sb.WriteByte(' ')
+	}
+	input := sb.String()
+
+	// Positions start just short of the point where 32-bit hash chains
+	// would overflow, so that rebase must renumber them partway through.
+	run := func(start uint64) []lz77Token {
+		lz77 := NewLZ77(opts)
+		if lz77.htPrevByIndex.isWide() {
+			t.Fatalf("LZ77 of %d bytes unexpectedly uses 64-bit hash chains", len(lz77.slice))
+		}
+		lz77.renumber(-start)
+		lz77.org += start
+
+		var tokens []lz77Token
+		remaining := input
+		for len(remaining) != 0 || !lz77.IsEmpty() {
+			nn, _ := lz77.WriteString(remaining)
+			remaining = remaining[nn:]
+			for !lz77.IsEmpty() {
+				buf, dist, length, found := lz77.Advance()
+				tokens = append(tokens, lz77Token{string(buf), dist, length, found})
+			}
+			if err := lz77.CheckInvariants(); err != nil {
+				t.Fatalf("start %d: CheckInvariants failed: %v", start, err)
+			}
+		}
+		if start != 0 && lz77.i >= start {
+			t.Errorf("start %d: positions were not renumbered: i=%d", start, lz77.i)
+		}
+		return tokens
+	}
+
+	expect := run(0)
+	actual := run((1 << 32) - (1 << 15))
+	if len(expect) != len(actual) {
+		t.Fatalf("renumbered LZ77 produced wrong number of tokens:\n\texpect: %d\n\tactual: %d", len(expect), len(actual))
+	}
+	for index := range expect {
+		if expect[index] != actual[index] {
+			t.Fatalf("renumbered LZ77 produced wrong token #%d:\n\texpect: %+v\n\tactual: %+v", index, expect[index], actual[index])
+		}
+	}
+}
+
+func TestLZ77_CircularStorage(t *testing.T) {
+	lz77 := NewLZ77(LZ77Options{
+		BufferNumBits:    4,
+		WindowNumBits:    5,
+		HashNumBits:      8,
+		MaxMatchDistance: 20,
+	})
+
+	n := lz77.WindowSize() + lz77.BufferSize()
+	if uint(len(lz77.slice)) != n || uint(lz77.htPrevByIndex.len()) != n {
+		t.Fatalf("wrong storage size: expected %d, got slice %d and htPrevByIndex %d", n, len(lz77.slice), lz77.htPrevByIndex.len())
+	}
+
+	rng := rand.New(rand.NewSource(7))
+	var input, output []byte
+	for len(input) < 50*int(n) {
+		var chunk [7]byte
+		for index := range chunk {
+			chunk[index] = byte('a' + rng.Intn(3))
+		}
+		written, _ := lz77.Write(chunk[:rng.Intn(len(chunk))])
+		input = append(input, chunk[:written]...)
+
+		for lz77.Len() > uint(rng.Intn(8)) {
+			buf, distance, bufLen, ok := lz77.Advance()
+			if !ok {
+				output = append(output, buf...)
+				continue
+			}
+			if uint(len(buf)) != bufLen || distance > uint(len(output)) {
+				t.Fatalf("bad match: len(buf) = %d, bufLen = %d, distance = %d, decoded %d bytes", len(buf), bufLen, distance, len(output))
+			}
+			for index := uint(0); index < bufLen; index++ {
+				output = append(output, output[uint(len(output))-distance])
+			}
+		}
+
+		if err := lz77.CheckInvariants(); err != nil {
+			t.Fatalf("CheckInvariants failed: %v", err)
+		}
+	}
+	for !lz77.IsEmpty() {
+		buf, _, _, _ := lz77.Advance()
+		output = append(output, buf...)
+	}
+
+	if !bytes.Equal(input, output) {
+		t.Errorf("wrong output:\n\texpect: %q\n\tactual: %q", input, output)
+	}
+}
+
+func TestLZ77_InitMemory(t *testing.T) {
+	opts := LZ77Options{
+		BufferNumBits: 8,
+		WindowNumBits: 22,
+		HashNumBits:   12,
+	}
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	lz77 := NewLZ77(opts)
+	runtime.ReadMemStats(&after)
+	runtime.KeepAlive(lz77)
+
+	// 1 byte of storage plus 8 bytes of hash chain per position, plus 8
+	// bytes per hash bucket.  Nothing scales with MaxMatchDistance.
+	n := uint64(lz77.WindowSize() + lz77.BufferSize())
+	expect := 9*n + 8*(uint64(1)<<opts.HashNumBits)
+	actual := after.TotalAlloc - before.TotalAlloc
+	if actual > expect+(expect/16) {
+		t.Errorf("NewLZ77 allocated too much memory:\n\texpect: ~%d bytes\n\tactual: %d bytes", expect, actual)
+	}
+}
+
+func TestLZ77_LargeWindow(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping 4 GiB test in short mode")
+	}
+	if bits.UintSize < 64 {
+		t.Skip("skipping 2 GiB Window on 32-bit platform")
+	}
+
+	// Hashing is disabled to keep memory use near 2 GiB, so a large
+	// MinMatchDistance keeps the brute force search short.
+	// The match lies at the far end of the Window, so that its distance
+	// of 2**31 falls in DistanceHistogram bucket 32.
+	const wsize = 1 << 31
+	const distance = wsize
+	lz77 := NewLZ77(LZ77Options{
+		BufferNumBits:       12,
+		WindowNumBits:       31,
+		MinMatchLength:      16,
+		HasMinMatchLength:   true,
+		MaxMatchLength:      64,
+		HasMaxMatchLength:   true,
+		MinMatchDistance:    wsize - 4096,
+		HasMinMatchDistance: true,
+	})
+
+	fill := func(n uint) {
+		for n != 0 {
+			buf := lz77.PrepareBulkWrite(n)
+			for k := range buf {
+				buf[k] = 0
+			}
+			lz77.CommitBulkWrite(uint(len(buf)))
+			n -= uint(len(buf))
+			_, _ = lz77.Skip(lz77.Len())
+		}
+	}
+
+	needle := make([]byte, 64)
+	rand.New(rand.NewSource(43)).Read(needle)
+
+	// Push positions past 2**32 before planting the needle twice.
+	fill(wsize)
+	_, _ = lz77.Write(needle)
+	_, _ = lz77.Skip(lz77.Len())
+	fill(distance - uint(len(needle)))
+	_, _ = lz77.Write(needle)
+
+	if lz77.i <= (1 << 32) {
+		t.Errorf("positions did not pass 2**32: i=%d", lz77.i)
+	}
+	if expect, actual := uint(wsize), lz77.WindowLen(); expect != actual {
+		t.Errorf("WindowLen returned wrong result: expected %d, got %d", expect, actual)
+	}
+
+	lz77.EnableStats()
+	buf, matchDistance, matchLength, matchFound := lz77.Advance()
+	if !matchFound || matchDistance != distance || matchLength != 64 || !bytes.Equal(buf, needle) {
+		t.Errorf("Advance returned wrong result:\n\texpect: distance=%d length=%d\n\tactual: found=%v distance=%d length=%d", distance, 64, matchFound, matchDistance, matchLength)
+	}
+	if stats := lz77.Stats(); stats.Matches != 1 || stats.DistanceHistogram[32] != 1 {
+		t.Errorf("Stats returned wrong result: expected 1 match in DistanceHistogram[32], got %+v", stats)
+	}
+}
+
+func TestLZ77_LargeBuffer(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping 2 GiB test in short mode")
+	}
+	if bits.UintSize < 64 {
+		t.Skip("skipping 2 GiB Buffer on 32-bit platform")
+	}
+
+	// A Buffer full of zeroes after a single literal holds a match of
+	// length 2**31, which falls in LengthHistogram bucket 32.
+	const bsize = 1 << 31
+	lz77 := NewLZ77(LZ77Options{
+		BufferNumBits: 31,
+		WindowNumBits: 4,
+	})
+	for !lz77.IsFull() {
+		buf := lz77.PrepareBulkWrite(bsize)
+		lz77.CommitBulkWrite(uint(len(buf)))
+	}
+
+	lz77.EnableStats()
+	if _, _, _, matchFound := lz77.Advance(); matchFound {
+		t.Errorf("Advance unexpectedly found a match for the first byte")
+	}
+	_ = lz77.WriteByte(0)
+	buf, matchDistance, matchLength, matchFound := lz77.Advance()
+	if !matchFound || matchDistance != 1 || matchLength != bsize || uint(len(buf)) != bsize {
+		t.Errorf("Advance returned wrong result:\n\texpect: distance=%d length=%d\n\tactual: found=%v distance=%d length=%d", 1, bsize, matchFound, matchDistance, matchLength)
+	}
+	if stats := lz77.Stats(); stats.Matches != 1 || stats.LengthHistogram[32] != 1 {
+		t.Errorf("Stats returned wrong result: expected 1 match in LengthHistogram[32], got %+v", stats)
+	}
+}
+
+func TestLZ77_Presets(t *testing.T) {
+	corpus, err := os.ReadFile("lz77.go")
+	if err != nil {
+		t.Fatalf("failed to read corpus: %v", err)
+	}
+
+	type testRow struct {
+		Name    string
+		New     func() *LZ77
+		Window  uint
+		MinLen  uint
+		MaxLen  uint
+		MaxDist uint
+		Tail    uint
+	}
+
+	testData := [...]testRow{
+		{"Deflate", NewLZ77Deflate, 32768, 3, 258, 32768, 0},
+		{"Snappy", NewLZ77Snappy, 65536, 4, 64, 65535, 0},
+		{"LZ4", NewLZ77LZ4, 65536, 4, ^uint(0), 65535, 12},
+	}
+
+	for _, row := range testData {
+		t.Run(row.Name, func(t *testing.T) {
+			lz77 := row.New()
+			if lz77.WindowSize() > row.Window {
+				t.Errorf("WindowSize %d exceeds format limit %d", lz77.WindowSize(), row.Window)
+			}
+
+			input := corpus
+			var output []byte
+			var matches int
+			lastMatchEnd := 0
+			for len(input) != 0 || !lz77.IsEmpty() {
+				written, _ := lz77.Write(input)
+				input = input[written:]
+
+				for !lz77.IsEmpty() && (len(input) == 0 || lz77.Len() >= lz77.BufferSize()/2) {
+					buf, distance, length, ok := lz77.Advance()
+					if !ok {
+						output = append(output, buf...)
+						continue
+					}
+					if length < row.MinLen || length > row.MaxLen || distance == 0 || distance > row.MaxDist || distance > uint(len(output)) {
+						t.Fatalf("match violates format limits: distance %d, length %d", distance, length)
+					}
+					for index := uint(0); index < length; index++ {
+						output = append(output, output[uint(len(output))-distance])
+					}
+					matches++
+					lastMatchEnd = len(output)
+				}
+			}
+
+			if !bytes.Equal(output, corpus) {
+				t.Fatalf("decoded output does not match corpus")
+			}
+			if matches == 0 {
+				t.Errorf("expected at least one match")
+			}
+			if tail := len(corpus) - lastMatchEnd; uint(tail) < row.Tail {
+				t.Errorf("last match ends %d bytes before end of data, expected at least %d", tail, row.Tail)
+			}
+		})
+	}
+}
+
+func TestLZ77_SelfCheck(t *testing.T) {
+	corpus, err := os.ReadFile("lz77.go")
+	if err != nil {
+		t.Fatalf("failed to read corpus: %v", err)
+	}
+
+	optsList := [...]LZ77Options{
+		{BufferNumBits: 8, WindowNumBits: 10, HashNumBits: 12},
+		{BufferNumBits: 8, WindowNumBits: 10, HashNumBits: 4},
+		{BufferNumBits: 8, WindowNumBits: 10, HashNumBits: 8, RepeatOffsetBias: 2, BackwardMatchExtension: true},
+		{BufferNumBits: 8, WindowNumBits: 10, HashNumBits: 8, TailLiteralBytes: 5, MinMatchDistance: 3, HasMinMatchDistance: true},
+		{BufferNumBits: 8, WindowNumBits: 10, HashNumBits: 8, MaxChainLength: 2, HasMaxChainLength: true},
+	}
+
+	for index, opts := range optsList {
+		lz77 := NewLZ77(opts)
+		lz77.EnableSelfCheck()
+		input := corpus
+		for len(input) != 0 || !lz77.IsEmpty() {
+			written, _ := lz77.Write(input)
+			input = input[written:]
+			for lz77.Len() > 16 || (len(input) == 0 && !lz77.IsEmpty()) {
+				_, _, _, _ = lz77.Advance()
+			}
+		}
+		if err := lz77.CheckInvariants(); err != nil {
+			t.Errorf("opts[%d]: CheckInvariants failed: %v", index, err)
+		}
+	}
+
+	lz77 := NewLZ77(LZ77Options{BufferNumBits: 5, WindowNumBits: 6, HashNumBits: 8})
+	lz77.EnableSelfCheck()
+	_, _ = lz77.WriteString("abcdXabcd")
+	for step := 0; step < 5; step++ {
+		_, _, _, _ = lz77.Advance()
+	}
+	lz77.htLastByHash.set(uint64(hash4([]byte("abcd"), lz77.hashMask)), 0)
+
+	err = func() (err error) {
+		defer func() {
+			if x := recover(); x != nil {
+				err, _ = x.(error)
+			}
+		}()
+		_, _, _, _ = lz77.Advance()
+		return nil
+	}()
+	if !errors.Is(err, ErrInvariant) {
+		t.Errorf("Advance with corrupted hash chains did not panic with ErrInvariant: %v", err)
+	}
+}
+
+func TestLZ77_DumpTo(t *testing.T) {
+	lz77 := NewLZ77(LZ77Options{BufferNumBits: 4, WindowNumBits: 4, HashNumBits: 4})
+	_, _ = lz77.WriteString("abcdabcdabcdwxyz")
+	_, _ = lz77.Skip(12)
+
+	const header = "LZ77(\n" +
+		"\tcapacity = 32\n" +
+		"\tbbits = 4\n" +
+		"\twbits = 4\n" +
+		"\thbits = 4\n" +
+		"\tminLen = 4\n" +
+		"\tmaxLen = 16\n" +
+		"\tmaxDist = 16\n" +
+		"\thashMask = 0x0000000f\n" +
+		"\tbCap = 16\n" +
+		"\twCap = 16\n" +
+		"\th = 16\n" +
+		"\ti = 28\n" +
+		"\tj = 32\n" +
+		"\tlength = 4\n"
+
+	type testRow struct {
+		Opts   LZ77DumpOptions
+		Expect string
+	}
+
+	testData := [...]testRow{
+		{
+			Opts: LZ77DumpOptions{},
+			Expect: header +
+				"\thashtable = [ 0x00:{count=1 newest=26 oldest=26} 0x01:{count=1 newest=27 oldest=27} 0x02:{count=3 newest=24 oldest=16} 0x03:{count=2 newest=22 oldest=18} 0x06:{count=2 newest=21 oldest=17} 0x09:{count=1 newest=25 oldest=25} 0x0c:{count=2 newest=23 oldest=19} ]\n" +
+				")\n",
+		},
+		{
+			Opts: LZ77DumpOptions{IncludeBytes: true, MaxBytesPerRegion: 3},
+			Expect: header +
+				"\tbytes = [ ... 62 63 64 | 77 78 79 ... ]\n" +
+				"\thashtable = [ 0x00:{count=1 newest=26 oldest=26} 0x01:{count=1 newest=27 oldest=27} 0x02:{count=3 newest=24 oldest=16} 0x03:{count=2 newest=22 oldest=18} 0x06:{count=2 newest=21 oldest=17} 0x09:{count=1 newest=25 oldest=25} 0x0c:{count=2 newest=23 oldest=19} ]\n" +
+				")\n",
+		},
+		{
+			Opts: LZ77DumpOptions{IncludeBytes: true, FullBuckets: true},
+			Expect: header +
+				"\tbytes = [ 61 62 63 64 61 62 63 64 61 62 63 64 | 77 78 79 7a ]\n" +
+				"\thashtable = [ 0x00:[26] 0x01:[27] 0x02:[24 20 16] 0x03:[22 18] 0x06:[21 17] 0x09:[25] 0x0c:[23 19] ]\n" +
+				")\n",
+		},
+	}
+
+	for index, row := range testData {
+		var sb strings.Builder
+		if err := lz77.DumpTo(&sb, row.Opts); err != nil {
+			t.Errorf("[%d]: DumpTo failed: %v", index, err)
+		}
+		if actual := sb.String(); row.Expect != actual {
+			t.Errorf("[%d]: DumpTo wrote wrong output:\n\texpect: %q\n\tactual: %q", index, row.Expect, actual)
+		}
+	}
+
+	if expect, actual := testData[2].Expect, lz77.DebugString(); expect != actual {
+		t.Errorf("DebugString returned wrong output:\n\texpect: %q\n\tactual: %q", expect, actual)
+	}
+
+	if err := lz77.DumpTo(&shortWriter{max: 0}, LZ77DumpOptions{}); err != io.ErrShortWrite {
+		t.Errorf("DumpTo returned wrong error for short writer:\n\texpect: %v\n\tactual: %v", io.ErrShortWrite, err)
+	}
+}
+
+func TestLZ77_ConstantInput(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping 64 MiB test in short mode")
+	}
+
+	lz77 := NewLZ77(LZ77Options{
+		BufferNumBits:       16,
+		WindowNumBits:       15,
+		HashNumBits:         16,
+		MaxMatchLength:      258,
+		HasMaxMatchLength:   true,
+		MaxMatchDistance:    1 << 15,
+		HasMaxMatchDistance: true,
+	})
+	n := lz77.WindowSize() + lz77.BufferSize()
+
+	const total = 64 << 20
+	var written, consumed, chunks, tokens int
+	for written < total {
+		tmp := lz77.PrepareBulkWrite(uint(total - written))
+		for index := range tmp {
+			tmp[index] = 'a'
+		}
+		lz77.CommitBulkWrite(uint(len(tmp)))
+		written += len(tmp)
+		chunks++
+
+		for {
+			buf, _, _, _ := lz77.Advance()
+			if buf == nil {
+				break
+			}
+			consumed += len(buf)
+			tokens++
+		}
+	}
+
+	if consumed != total {
+		t.Errorf("consumed %d bytes, expected %d", consumed, total)
+	}
+
+	// Every match but the last of each chunk should be of maximum length.
+	if limit := total/258 + 5*chunks; tokens > limit {
+		t.Errorf("produced %d tokens, expected at most %d", tokens, limit)
+	}
+
+	// The hash chains are intrusive, so the number of retained positions
+	// is bounded by the size of the LZ77, no matter how long any one
+	// chain grows.
+	if uint(lz77.htPrevByIndex.len()) != n {
+		t.Errorf("htPrevByIndex has %d entries, expected %d", lz77.htPrevByIndex.len(), n)
+	}
+	_, _ = lz77.WriteString("aaaa")
+	candidates := make([]LZ77Candidate, 2*n)
+	if count := lz77.MatchCandidates(candidates); uint(count) > lz77.WindowLen()+1 {
+		t.Errorf("hash chain has %d candidates, expected at most %d", count, lz77.WindowLen()+1)
+	}
+	if err := lz77.CheckInvariants(); err != nil {
+		t.Errorf("CheckInvariants failed: %v", err)
+	}
+}
+
+func TestLZ77Options_Validate(t *testing.T) {
+	type testRow struct {
+		Opts   LZ77Options
+		Expect string
+	}
+
+	testData := [...]testRow{
+		{LZ77Options{BufferNumBits: 4}, ""},
+		{LZ77Options{BufferNumBits: 1}, "invalid options: BufferNumBits 1 must be at least 2"},
+		{LZ77Options{BufferNumBits: lz77MaxBufferNumBits, WindowNumBits: lz77MaxWindowNumBits, HashNumBits: 32}, ""},
+		{
+			LZ77Options{BufferNumBits: lz77MaxBufferNumBits + 1, WindowNumBits: lz77MaxWindowNumBits + 1, HashNumBits: 33},
+			fmt.Sprintf("invalid options: BufferNumBits %d must not exceed %d; WindowNumBits %d must not exceed %d; HashNumBits 33 must not exceed 32", lz77MaxBufferNumBits+1, lz77MaxBufferNumBits, lz77MaxWindowNumBits+1, lz77MaxWindowNumBits),
+		},
+		{
+			LZ77Options{BufferNumBits: 4, MinMatchLength: 17, HasMinMatchLength: true},
+			"invalid options: MinMatchLength 17 > buffer capacity 16",
+		},
+		{
+			LZ77Options{BufferNumBits: 1, WindowNumBits: 3, MinMatchLength: 5, MinMatchDistance: 9, HasMinMatchLength: true, HasMinMatchDistance: true},
+			"invalid options: BufferNumBits 1 must be at least 2; MinMatchLength 5 > buffer capacity 4; MinMatchDistance 9 > MaxMatchDistance 8",
+		},
+		{
+			LZ77Options{BufferNumBits: 4, MinMatchLength: 9, MaxMatchLength: 8, HasMinMatchLength: true, HasMaxMatchLength: true},
+			"invalid options: MinMatchLength 9 > MaxMatchLength 8",
+		},
+		{
+			LZ77Options{BufferNumBits: 4, WindowNumBits: 3, MinMatchDistance: 9, HasMinMatchDistance: true},
+			"invalid options: MinMatchDistance 9 > MaxMatchDistance 8",
+		},
+	}
+
+	for _, row := range testData {
+		err := row.Opts.Validate()
+		actual := ""
+		if err != nil {
+			actual = err.Error()
+			if !errors.Is(err, ErrBadOptions) {
+				t.Errorf("Validate(%+v) returned error which does not wrap ErrBadOptions: %v", row.Opts, err)
+			}
+		}
+		if row.Expect != actual {
+			t.Errorf("Validate(%+v) returned wrong error:\n\texpect: %q\n\tactual: %q", row.Opts, row.Expect, actual)
+		}
+	}
+}
+
+func TestLZ77Options_Normalize(t *testing.T) {
+	rng := rand.New(rand.NewSource(42))
+	randBits := func(max uint) uint {
+		if rng.Intn(10) == 0 {
+			return max + 1 + uint(rng.Intn(3))
+		}
+		return uint(rng.Intn(int(max) + 1))
+	}
+	randLen := func() uint {
+		switch rng.Intn(4) {
+		case 0:
+			return 0
+		case 1:
+			return uint(rng.Intn(8))
+		default:
+			return uint(rng.Intn(1 << 13))
+		}
+	}
+
+	var valid, invalid int
+	for index := 0; index < 2000; index++ {
+		opts := LZ77Options{
+			BufferNumBits:          randBits(12),
+			WindowNumBits:          randBits(12),
+			HashNumBits:            randBits(14),
+			MinMatchLength:         randLen(),
+			MaxMatchLength:         randLen(),
+			MaxMatchDistance:       randLen(),
+			MaxChainLength:         randLen(),
+			MinMatchDistance:       randLen(),
+			TailLiteralBytes:       randLen(),
+			RepeatOffsetBias:       randLen(),
+			NiceMatchLength:        randLen(),
+			HashInsertStride:       randLen(),
+			MinMatchScore:          int(randLen()) - 100,
+			HasMinMatchLength:      rng.Intn(2) == 0,
+			HasMaxMatchLength:      rng.Intn(2) == 0,
+			HasMaxMatchDistance:    rng.Intn(2) == 0,
+			HasMaxChainLength:      rng.Intn(2) == 0,
+			HasMinMatchDistance:    rng.Intn(2) == 0,
+			HasMinMatchScore:       rng.Intn(2) == 0,
+			BackwardMatchExtension: rng.Intn(2) == 0,
+		}
+		if rng.Intn(2) == 0 {
+			opts.ScoreMatch = func(distance, length uint) int { return int(length) }
+		}
+
+		if err := opts.Validate(); err != nil {
+			invalid++
+			if !lz77InitPanics(opts) {
+				t.Errorf("Validate(%+v) failed, but Init did not panic: %v", opts, err)
+			}
+			continue
+		}
+
+		valid++
+		expect := opts.Normalize()
+		actual := NewLZ77(opts).Options()
+		if !expect.Equal(actual) {
+			t.Errorf("Normalize(%+v) disagrees with Init:\n\texpect: %+v\n\tactual: %+v", opts, expect, actual)
+		}
+		if again := expect.Normalize(); !again.Equal(expect) {
+			t.Errorf("Normalize is not idempotent for %+v:\n\texpect: %+v\n\tactual: %+v", opts, expect, again)
+		}
+	}
+
+	if valid == 0 || invalid == 0 {
+		t.Errorf("randomized options were not diverse enough: %d valid, %d invalid", valid, invalid)
+	}
+}
+
+func lz77InitPanics(opts LZ77Options) (panicked bool) {
+	defer func() {
+		if recover() != nil {
+			panicked = true
+		}
+	}()
+	var lz77 LZ77
+	lz77.Init(opts)
+	return false
+}
+
 func BenchmarkLZ77_WriteByte_8_8(b *testing.B) {
 	var lz77 LZ77
 	lz77.Init(LZ77Options{
@@ -269,6 +3104,51 @@ func BenchmarkLZ77_WriteByte_15_16(b *testing.B) {
 	}
 }
 
+func benchmarkLZ77Drain(b *testing.B, enabled bool) {
+	var lz77 LZ77
+	lz77.Init(LZ77Options{
+		BufferNumBits: 16,
+		WindowNumBits: 15,
+		HashNumBits:   16,
+	})
+	lz77.SetMatchingEnabled(enabled)
+	var tmp [1 << 12]byte
+	for n := 0; n < b.N; n++ {
+		buf := lz77.PrepareBulkWrite(1 << 16)
+		for index := range buf {
+			buf[index] = byte(index)
+		}
+		lz77.CommitBulkWrite(uint(len(buf)))
+		for !lz77.IsEmpty() {
+			_, _ = lz77.Read(tmp[:])
+		}
+	}
+}
+
+func BenchmarkLZ77_Drain_Matching(b *testing.B) {
+	benchmarkLZ77Drain(b, true)
+}
+
+func BenchmarkLZ77_Drain_NoMatching(b *testing.B) {
+	benchmarkLZ77Drain(b, false)
+}
+
+func BenchmarkLZ77_Drain_Baseline(b *testing.B) {
+	var buffer Buffer
+	buffer.Init(16)
+	var tmp [1 << 12]byte
+	for n := 0; n < b.N; n++ {
+		buf := buffer.PrepareBulkWrite(1 << 16)
+		for index := range buf {
+			buf[index] = byte(index)
+		}
+		buffer.CommitBulkWrite(uint(len(buf)))
+		for !buffer.IsEmpty() {
+			_, _ = buffer.Read(tmp[:])
+		}
+	}
+}
+
 func BenchmarkLZ77_Advance_A(b *testing.B) {
 	var lz77 LZ77
 	lz77.Init(LZ77Options{
@@ -352,3 +3232,306 @@ func BenchmarkLZ77_Advance_C(b *testing.B) {
 		}
 	}
 }
+
+func BenchmarkLZ77_AdvanceAll_C(b *testing.B) {
+	var lz77 LZ77
+	lz77.Init(LZ77Options{
+		BufferNumBits:       16,
+		WindowNumBits:       15,
+		HashNumBits:         24,
+		MinMatchLength:      4,
+		MaxMatchLength:      258,
+		MaxMatchDistance:    1 << 15,
+		HasMinMatchLength:   true,
+		HasMaxMatchLength:   true,
+		HasMaxMatchDistance: true,
+	})
+	var tokens [64]LZ77Token
+	for n := 0; n < b.N; n++ {
+		tmp := lz77.PrepareBulkWrite(1 << 16)
+		for index := range tmp {
+			tmp[index] = 'a'
+		}
+		lz77.CommitBulkWrite(uint(len(tmp)))
+		for lz77.AdvanceAll(tokens[:]) != 0 {
+		}
+	}
+}
+
+func BenchmarkLZ77_Advance_Text(b *testing.B) {
+	benchmarkLZ77Text(b, 0)
+}
+
+func BenchmarkLZ77_Advance_Text_Nice16(b *testing.B) {
+	benchmarkLZ77Text(b, 16)
+}
+
+func benchmarkLZ77Text(b *testing.B, nice uint) {
+	var lz77 LZ77
+	lz77.Init(LZ77Options{
+		BufferNumBits:       16,
+		WindowNumBits:       15,
+		HashNumBits:         16,
+		MinMatchLength:      4,
+		MaxMatchLength:      258,
+		MaxMatchDistance:    1 << 15,
+		HasMinMatchLength:   true,
+		HasMaxMatchLength:   true,
+		HasMaxMatchDistance: true,
+		NiceMatchLength:     nice,
+	})
+	rng := rand.New(rand.NewSource(1))
+	words := strings.Fields(benchmarkLZ77String)
+	var sb strings.Builder
+	for sb.Len() < 1<<15 {
+		sb.WriteString(words[rng.Intn(len(words))])
+		sb.WriteByte(' ')
+	}
+	input := sb.String()
+	b.SetBytes(int64(len(input)))
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		_, _ = lz77.WriteString(input)
+		for {
+			buf, _, _, _ := lz77.Advance()
+			if buf == nil {
+				break
+			}
+		}
+	}
+}
+
+func BenchmarkLZ77_Advance_Binary(b *testing.B) {
+	benchmarkLZ77Binary(b, 1)
+}
+
+func BenchmarkLZ77_Advance_Binary_Stride4(b *testing.B) {
+	benchmarkLZ77Binary(b, 4)
+}
+
+func benchmarkLZ77Binary(b *testing.B, stride uint) {
+	exe, err := os.Executable()
+	if err != nil {
+		b.Skipf("failed to locate test binary: %v", err)
+	}
+	input, err := os.ReadFile(exe)
+	if err != nil {
+		b.Skipf("failed to read test binary: %v", err)
+	}
+	if len(input) > 1<<19 {
+		input = input[:1<<19]
+	}
+
+	// Replace every other 8 KiB block with noise, to mix incompressible
+	// regions into the corpus.
+	rng := rand.New(rand.NewSource(1))
+	for start := 1 << 13; start < len(input); start += 1 << 14 {
+		end := start + 1<<13
+		if end > len(input) {
+			end = len(input)
+		}
+		_, _ = rng.Read(input[start:end])
+	}
+
+	var lz77 LZ77
+	lz77.Init(LZ77Options{
+		BufferNumBits:       16,
+		WindowNumBits:       15,
+		HashNumBits:         16,
+		MinMatchLength:      4,
+		MaxMatchLength:      258,
+		MaxMatchDistance:    1 << 15,
+		HasMinMatchLength:   true,
+		HasMaxMatchLength:   true,
+		HasMaxMatchDistance: true,
+		MaxChainLength:      64,
+		HasMaxChainLength:   true,
+		HashInsertStride:    stride,
+	})
+	b.SetBytes(int64(len(input)))
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		for remaining := input; len(remaining) != 0; {
+			written, _ := lz77.Write(remaining)
+			remaining = remaining[written:]
+			for {
+				if buf, _, _, _ := lz77.Advance(); buf == nil {
+					break
+				}
+			}
+		}
+	}
+}
+
+func BenchmarkLZ77_Advance_Random(b *testing.B) {
+	benchmarkLZ77Random(b, func(lz77 *LZ77) {
+		for {
+			buf, _, _, _ := lz77.Advance()
+			if buf == nil {
+				break
+			}
+		}
+	})
+}
+
+func BenchmarkLZ77_Skip_Random(b *testing.B) {
+	benchmarkLZ77Random(b, func(lz77 *LZ77) {
+		_, _ = lz77.Skip(lz77.Len())
+	})
+}
+
+func BenchmarkLZ77_AdvanceLiteralRun_Random(b *testing.B) {
+	benchmarkLZ77Random(b, func(lz77 *LZ77) {
+		for !lz77.IsEmpty() {
+			if buf := lz77.AdvanceLiteralRun(lz77.Len()); buf == nil {
+				_, _, _, _ = lz77.Advance()
+			}
+		}
+	})
+}
+
+func benchmarkLZ77Random(b *testing.B, consume func(*LZ77)) {
+	rng := rand.New(rand.NewSource(1))
+	input := make([]byte, 1<<16)
+	_, _ = rng.Read(input)
+
+	var lz77 LZ77
+	lz77.Init(LZ77Options{
+		BufferNumBits:       16,
+		WindowNumBits:       15,
+		HashNumBits:         16,
+		MinMatchLength:      4,
+		MaxMatchLength:      258,
+		MaxMatchDistance:    1 << 15,
+		HasMinMatchLength:   true,
+		HasMaxMatchLength:   true,
+		HasMaxMatchDistance: true,
+	})
+	b.SetBytes(int64(len(input)))
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		_, _ = lz77.Write(input)
+		consume(&lz77)
+	}
+}
+
+func BenchmarkLZ77_Advance_B_Chain16(b *testing.B) {
+	var lz77 LZ77
+	lz77.Init(LZ77Options{
+		BufferNumBits:       16,
+		WindowNumBits:       15,
+		HashNumBits:         24,
+		MinMatchLength:      4,
+		MaxMatchLength:      1 << 16,
+		MaxMatchDistance:    1 << 15,
+		MaxChainLength:      16,
+		HasMinMatchLength:   true,
+		HasMaxMatchLength:   true,
+		HasMaxMatchDistance: true,
+		HasMaxChainLength:   true,
+	})
+	for n := 0; n < b.N; n++ {
+		tmp := lz77.PrepareBulkWrite(1 << 16)
+		for index := range tmp {
+			tmp[index] = 'a'
+		}
+		lz77.CommitBulkWrite(uint(len(tmp)))
+		for {
+			buf, _, _, _ := lz77.Advance()
+			if buf == nil {
+				break
+			}
+		}
+	}
+}
+
+var benchmarkLZ77String = strings.Repeat("The quick brown fox jumps over the lazy dog. ", 16)
+
+var benchmarkLZ77Writer io.Writer
+
+func BenchmarkLZ77_Write_String_15_16(b *testing.B) {
+	lz77 := NewLZ77(LZ77Options{
+		BufferNumBits: 16,
+		WindowNumBits: 15,
+		HashNumBits:   24,
+	})
+	benchmarkLZ77Writer = lz77
+	w := benchmarkLZ77Writer
+	str := benchmarkLZ77String
+	b.ResetTimer()
+	b.ReportAllocs()
+	b.SetBytes(int64(len(str)))
+	for n := 0; n < b.N; n++ {
+		_, _ = w.Write([]byte(str))
+		lz77.CommitBulkRead(lz77.Len())
+	}
+}
+
+func BenchmarkLZ77_WriteString_15_16(b *testing.B) {
+	lz77 := NewLZ77(LZ77Options{
+		BufferNumBits: 16,
+		WindowNumBits: 15,
+		HashNumBits:   24,
+	})
+	benchmarkLZ77Writer = lz77
+	w := benchmarkLZ77Writer
+	str := benchmarkLZ77String
+	b.ResetTimer()
+	b.ReportAllocs()
+	b.SetBytes(int64(len(str)))
+	for n := 0; n < b.N; n++ {
+		_, _ = io.WriteString(w, str)
+		lz77.CommitBulkRead(lz77.Len())
+	}
+}
+
+func BenchmarkLZ77_Init(b *testing.B) {
+	opts := LZ77Options{
+		BufferNumBits: 16,
+		WindowNumBits: 15,
+		HashNumBits:   15,
+	}
+	var lz77 LZ77
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		lz77.Init(opts)
+		_, _ = lz77.WriteString(benchmarkLZ77String)
+	}
+}
+
+func BenchmarkLZ77_ClearCycle(b *testing.B) {
+	var lz77 LZ77
+	lz77.Init(LZ77Options{
+		BufferNumBits: 12,
+		WindowNumBits: 12,
+		HashNumBits:   12,
+	})
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		lz77.Clear()
+		_, _ = lz77.WriteString(benchmarkLZ77String)
+		for {
+			buf, _, _, _ := lz77.Advance()
+			if buf == nil {
+				break
+			}
+		}
+	}
+}
+
+func BenchmarkLZ77_ResetWithOptions(b *testing.B) {
+	opts := LZ77Options{
+		BufferNumBits: 16,
+		WindowNumBits: 15,
+		HashNumBits:   15,
+	}
+	pool := sync.Pool{New: func() interface{} { return NewLZ77(opts) }}
+	b.ResetTimer()
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		lz77 := pool.Get().(*LZ77)
+		lz77.ResetWithOptions(opts)
+		_, _ = lz77.WriteString(benchmarkLZ77String)
+		pool.Put(lz77)
+	}
+}
@@ -1,9 +1,15 @@
 package buffer
 
 import (
+	"bytes"
+	"encoding"
+	"encoding/binary"
+	"encoding/gob"
 	"fmt"
 	"hash"
 	"io"
+	"math/bits"
+	"sync/atomic"
 
 	"github.com/chronos-tachyon/assert"
 	"github.com/chronos-tachyon/bufferpool"
@@ -12,11 +18,73 @@ import (
 
 // Window implements a sliding window.  The Window has space for 2**N bytes for
 // user-specified N.
+//
+// Internally, the Window is a circular buffer of exactly 2**N bytes.  Methods
+// which return a single slice into the Window's contents, such as BytesView and
+// LookupSlice, must therefore allocate a copy when the requested bytes wrap
+// around the end of the circular buffer; use BytesViews or LookupSlices to
+// avoid this.
 type Window struct {
-	slice []byte
-	end   uint32
-	size  uint32
-	nbits byte
+	slice   []byte
+	total   uint64
+	written uint64
+	wraps   uint64
+	hiwat   uint32
+	end     uint32
+	size    uint32
+	fill    uint32
+	zrun    uint32
+	rollK   uint32
+	rollA   uint32
+	rollB   uint32
+	gen     uint32
+	nbits   byte
+	cow     *windowShare
+	hashers []hash.Hash
+	stage   []byte
+	staged  uint32
+	direct  bool
+}
+
+// FrozenWindow is an immutable view of a Window's contents, as captured by
+// Window.Freeze.  It shares storage with the Window it was captured from until
+// that Window is next mutated.  Call Release when the view is no longer needed.
+type FrozenWindow struct {
+	window Window
+	share  *windowShare
+}
+
+type windowShare struct {
+	refs int32
+}
+
+// WindowMetrics holds usage counters for a Window, as returned by
+// Window.Metrics.
+type WindowMetrics struct {
+	// BytesWritten is the total number of bytes written to the Window,
+	// including bytes which were dropped immediately because a single
+	// write exceeded the Window's size.
+	BytesWritten uint64
+
+	// Wraps is the number of times that writing has wrapped around the
+	// end of the Window's circular buffer.
+	Wraps uint64
+
+	// HighWater is the largest value of Window.Len() observed.
+	HighWater uint
+}
+
+// WindowSnapshot holds the logical contents and counters of a Window, as
+// captured by Window.Snapshot.  It can be passed to Window.Restore to return a
+// Window to the captured state.
+type WindowSnapshot struct {
+	data    []byte
+	total   uint64
+	written uint64
+	wraps   uint64
+	hiwat   uint32
+	nbits   byte
+	valid   bool
 }
 
 // NewWindow is a convenience function that allocates a Window and calls Init on it.
@@ -26,6 +94,16 @@ func NewWindow(numBits uint) *Window {
 	return window
 }
 
+// NewWindowE is like NewWindow, but returns an error instead of panicking if
+// the argument is out of range.
+func NewWindowE(numBits uint) (*Window, error) {
+	window := new(Window)
+	if err := window.InitE(numBits); err != nil {
+		return nil, err
+	}
+	return window, nil
+}
+
 // NumBits returns the number of bits used to initialize this Window.
 func (window Window) NumBits() uint {
 	return uint(window.nbits)
@@ -36,39 +114,294 @@ func (window Window) Size() uint {
 	return uint(window.size)
 }
 
-// IsZero returns true iff the Window contains only 0 bytes.
+// Len returns the number of bytes which have been written to the Window since
+// it was last initialized or cleared, up to a maximum of Window.Size().  Bytes
+// older than this are always 0.
+func (window Window) Len() uint {
+	return uint(window.fill)
+}
+
+// TotalWritten returns the total number of bytes which have been written to
+// the Window.  This is not reset by Clear; see ResetCounters.
+func (window Window) TotalWritten() uint64 {
+	return window.total
+}
+
+// OldestOffset returns the absolute stream offset of the oldest byte written to
+// the Window which is still retained, i.e. Window.TotalWritten() minus
+// Window.Len().
+func (window Window) OldestOffset() uint64 {
+	return window.total - uint64(window.fill)
+}
+
+// ResetCounters resets the stream offset counters, such that the oldest byte
+// still retained by the Window has an absolute offset of 0.
+func (window *Window) ResetCounters() {
+	window.total = uint64(window.fill)
+}
+
+// Metrics returns the Window's usage counters.  BytesWritten is preserved by
+// Clear and SecureClear, while Wraps and HighWater are reset.  All counters are
+// reset by Init and ResetMetrics.
+func (window Window) Metrics() WindowMetrics {
+	return WindowMetrics{
+		BytesWritten: window.written,
+		Wraps:        window.wraps,
+		HighWater:    uint(window.hiwat),
+	}
+}
+
+// ResetMetrics resets all of the counters returned by Metrics to zero.
+func (window *Window) ResetMetrics() {
+	window.written = 0
+	window.wraps = 0
+	window.hiwat = 0
+}
+
+// IsZero returns true iff the Window contains only 0 bytes.  This is O(1), as
+// the Window keeps track of how many of the most recently written bytes were 0.
 func (window Window) IsZero() bool {
-	slice := window.slice
-	j := window.end
-	i := j - window.size
-	for i < j {
-		if slice[i] != 0 {
-			return false
+	return window.zrun >= window.fill
+}
+
+// EnableRollingHash enables the maintenance of a weak rolling checksum, in the
+// style of rsync, over the most recent k bytes of the Window.  The checksum is
+// updated in O(1) time per byte written.  The argument must be between 1 and
+// Window.Size() inclusive.  The rolling checksum remains enabled until the
+// next call to Init or DisableRollingHash.
+func (window *Window) EnableRollingHash(k uint) {
+	assert.Assertf(k >= 1, "k %d must be at least 1", k)
+	assert.Assertf(k <= uint(window.size), "k %d must not exceed window size %d", k, uint(window.size))
+	window.rollK = uint32(k)
+	window.rollReset()
+}
+
+// DisableRollingHash disables the weak rolling checksum.
+func (window *Window) DisableRollingHash() {
+	window.rollK = 0
+	window.rollA = 0
+	window.rollB = 0
+}
+
+// RollingSum returns the weak rolling checksum of the most recent k bytes of
+// the Window, where k is the argument to EnableRollingHash.  The low 16 bits
+// hold the plain sum of the bytes, and the high 16 bits hold the sum weighted
+// by each byte's distance from the end of the k-byte span.  Returns 0 if the
+// rolling checksum is not enabled.
+func (window Window) RollingSum() uint32 {
+	return (window.rollA & 0xffff) | (window.rollB << 16)
+}
+
+// AttachHasher arranges for every byte subsequently written to the Window to
+// also be written to h, in order and exactly once.  This includes bytes which
+// are dropped immediately because a single write exceeded Window.Size(), so the
+// attached hashers always see the complete input stream.  The hasher remains
+// attached until the next call to Init or DetachHasher.
+func (window *Window) AttachHasher(h hash.Hash) {
+	assert.Assert(h != nil, "hash.Hash is nil")
+	window.hashers = append(window.hashers, h)
+}
+
+// DetachHasher reverses a previous call to AttachHasher.  It is a no-op if h is
+// not attached.
+func (window *Window) DetachHasher(h hash.Hash) {
+	for index, other := range window.hashers {
+		if other == h {
+			window.hashers = append(window.hashers[:index:index], window.hashers[index+1:]...)
+			return
 		}
-		i++
 	}
-	return true
 }
 
 // Init initializes the Window.  The Window will hold a maximum of 2**N bits,
 // where N is the argument provided.  The argument must be a number between 0
 // and 31 inclusive.
 func (window *Window) Init(numBits uint) {
-	assert.Assertf(numBits <= 31, "numBits %d must not exceed 31", numBits)
+	assert.Assertf(numBits <= maxWindowBits, "numBits %d must not exceed %d", numBits, uint(maxWindowBits))
 
 	size := (uint32(1) << numBits)
-	*window = Window{
-		slice: make([]byte, size*2),
-		end:   size,
-		size:  size,
-		nbits: byte(numBits),
+	window.initSlice(make([]byte, size), numBits)
+}
+
+// InitE is like Init, but returns an error instead of panicking if the argument
+// is out of range.  Use this when the size comes from user configuration or
+// from untrusted input.  On error, the Window is left unchanged.
+func (window *Window) InitE(numBits uint) error {
+	if err := checkWindowBits(numBits); err != nil {
+		return err
 	}
+	window.Init(numBits)
+	return nil
+}
+
+// InitWithSlice initializes the Window to use the provided slice as its
+// storage, rather than allocating.  The length of the slice determines the
+// size of the Window, and must be a power of 2 no greater than 2**31.  The
+// slice is zeroed, and all subsequent writes to the Window are made directly
+// into it; the caller must not modify it while the Window is in use.
+//
+// The Window's contents are always held in the provided slice, but
+// PrepareBulkWrite and ReadFrom, once the Window is full, stage bytes in a
+// separate area of up to 64 KiB, which is allocated on first use and kept
+// until the next call to Init or InitWithSlice.
+func (window *Window) InitWithSlice(backing []byte) {
+	length := uint(len(backing))
+	assert.Assertf(length != 0 && (length&(length-1)) == 0, "len(backing) %d must be a power of 2", length)
+	assert.Assertf(length <= (uint(1) << maxWindowBits), "len(backing) %d must not exceed 2**%d", length, uint(maxWindowBits))
+
+	bzero.Uint8(backing)
+	window.initSlice(backing, uint(bits.TrailingZeros(length)))
 }
 
-// Clear erases the contents of the Window.
+// Clear erases the contents of the Window.  Only the bytes written since the
+// last Init or Clear are zeroed, so the cost is proportional to Window.Len()
+// rather than to Window.Size().  The stream offset counters are preserved; see
+// ResetCounters.
 func (window *Window) Clear() {
+	window.unshare()
+	a, b := window.span(window.fill, window.fill)
+	bzero.Uint8(a)
+	bzero.Uint8(b)
+	window.end = 0
+	window.fill = 0
+	window.zrun = 0
+	window.rollA = 0
+	window.rollB = 0
+	window.wraps = 0
+	window.hiwat = 0
+	window.gen++
+}
+
+// SecureClear erases the contents of the Window, and also zeroes all of the
+// Window's internal storage, including bytes which are no longer reachable
+// through the public API.  Use this when the Window may have held sensitive
+// data.
+func (window *Window) SecureClear() {
+	window.abandon()
+	if window.cow != nil {
+		if atomic.LoadInt32(&window.cow.refs) > 0 {
+			window.slice = make([]byte, len(window.slice))
+		}
+		window.cow = nil
+	}
 	bzero.Uint8(window.slice)
-	window.end = window.size
+	window.end = 0
+	window.fill = 0
+	window.zrun = 0
+	window.rollA = 0
+	window.rollB = 0
+	window.wraps = 0
+	window.hiwat = 0
+	window.gen++
+}
+
+// Clone returns an independent copy of the Window, with its own storage.  The
+// copy has no attached hashers.  It is safe to call Clone on a zero-value
+// Window.
+func (window Window) Clone() *Window {
+	dupe := window
+	dupe.cow = nil
+	dupe.hashers = nil
+	dupe.stage = nil
+	dupe.staged = 0
+	dupe.direct = false
+	if window.slice != nil {
+		dupe.slice = make([]byte, len(window.slice))
+		copy(dupe.slice, window.slice)
+		if window.direct {
+			j := window.end
+			bzero.Uint8(dupe.slice[j : j+window.staged])
+		}
+	}
+	return &dupe
+}
+
+// Snapshot captures the logical contents of the Window, together with its
+// stream offset counters and the counters returned by Metrics.  Unlike Clone,
+// only the bytes written since the last Init or Clear are copied.
+func (window Window) Snapshot() WindowSnapshot {
+	data := make([]byte, window.fill)
+	window.copyOut(data, window.fill)
+	return WindowSnapshot{
+		data:    data,
+		total:   window.total,
+		written: window.written,
+		wraps:   window.wraps,
+		hiwat:   window.hiwat,
+		nbits:   window.nbits,
+		valid:   window.slice != nil,
+	}
+}
+
+// Restore returns the Window to the state captured by a previous call to
+// Snapshot, including its counters.  The Window's existing storage is reused
+// if it has the same size as the Window which was captured; otherwise it is
+// reallocated at the captured size.  Either way, attached hashers remain
+// attached and the rolling checksum remains enabled, unless k now exceeds
+// Window.Size(), in which case it is disabled.  The restored bytes are not
+// rewritten, so they are not passed to any attached hashers.
+//
+// If the snapshot was not returned by Snapshot, such as a zero-value
+// WindowSnapshot or a snapshot of a zero-value Window, then ErrCorrupt is
+// returned and the Window is left unchanged.
+func (window *Window) Restore(snapshot WindowSnapshot) error {
+	if !snapshot.valid || snapshot.nbits > maxWindowBits || uint64(len(snapshot.data)) > (uint64(1)<<snapshot.nbits) {
+		return ErrCorrupt
+	}
+
+	if window.slice == nil || window.nbits != snapshot.nbits {
+		hashers := window.hashers
+		rollK := window.rollK
+		window.Init(uint(snapshot.nbits))
+		window.hashers = hashers
+		if rollK <= window.size {
+			window.rollK = rollK
+		}
+	} else {
+		window.Clear()
+	}
+
+	data := snapshot.data
+	fill := uint32(copy(window.slice, data))
+	zrun := fill
+	for zrun != 0 && data[zrun-1] == 0 {
+		zrun--
+	}
+	window.end = fill & (window.size - 1)
+	window.fill = fill
+	window.zrun = fill - zrun
+	window.total = snapshot.total
+	window.written = snapshot.written
+	window.wraps = snapshot.wraps
+	window.hiwat = snapshot.hiwat
+	window.rollReset()
+	return nil
+}
+
+// Freeze returns an immutable view of the Window's current contents.  No bytes
+// are copied: the view shares the Window's storage, and the Window is marked
+// copy-on-write.  The next mutating method called on the Window copies the
+// storage first if any views returned by Freeze have not yet been released, or
+// resumes using the existing storage in place if all views have been released.
+//
+// If the Window was initialized with InitWithSlice, note that the deferred copy
+// moves the Window's contents into newly allocated storage, after which the
+// caller-provided slice is no longer used by the Window.
+func (window *Window) Freeze() *FrozenWindow {
+	window.abandon()
+	share := window.cow
+	if share == nil {
+		share = new(windowShare)
+		window.cow = share
+	}
+	atomic.AddInt32(&share.refs, 1)
+
+	frozen := &FrozenWindow{window: *window, share: share}
+	frozen.window.cow = nil
+	frozen.window.hashers = nil
+	frozen.window.stage = nil
+	frozen.window.staged = 0
+	return frozen
 }
 
 // PrepareBulkWrite obtains a slice into which the caller can write bytes.  The
@@ -76,23 +409,45 @@ func (window *Window) Clear() {
 // called.  If CommitBulkWrite is not subsequently called, the write is
 // considered abandoned.
 //
+// While the Window is not yet full, the returned slice points directly into
+// the unused bytes of the Window's circular buffer which follow the newest
+// byte, and CommitBulkWrite copies nothing.  Until the write is committed or
+// abandoned, bytes written into the slice may be seen in place of the 0 bytes
+// which Bytes and similar methods report beyond Window.Len().
+//
+// Once the Window is full, the next bytes to be written would overwrite the
+// oldest bytes still retained, so the returned slice is instead a staging area
+// of up to 64 KiB owned by the Window, and CommitBulkWrite copies the committed
+// bytes into place.  This keeps the Window's contents undisturbed by an
+// abandoned or partially committed write, at the cost of one extra copy, which
+// roughly halves throughput when no hashers are attached; compare
+// BenchmarkWindow_BulkWrite_Direct_20 and BenchmarkWindow_BulkWrite_Staged_20.
+//
 // The returned slice may contain fewer bytes than requested, if the provided
-// length is greater than the size of the Window.  The caller must check the
-// slice's length before using it.
+// length is greater than the number of unused bytes before the end of the
+// circular buffer, or, once the Window is full, greater than the size of the
+// Window or than 64 KiB.  The caller must check the slice's length before
+// using it, and should call PrepareBulkWrite again to write any remaining
+// bytes.
+//
+// The initial contents of the returned slice are unspecified.
 //
 // The returned slice is only valid until the next call to any mutating method
 // on this Window; mutating methods are those which take a pointer receiver.
 //
 func (window *Window) PrepareBulkWrite(length uint) []byte {
-	size := window.size
-	if length > uint(size) {
-		length = uint(size)
+	window.abandon()
+	if free := window.free(); free != 0 {
+		if length > uint(free) {
+			length = uint(free)
+		}
+		window.unshare()
+		j := window.end
+		window.staged = uint32(length)
+		window.direct = true
+		return window.slice[j : j+uint32(length)]
 	}
-
-	window.shift(uint32(length))
-	j := window.end
-	k := j + uint32(length)
-	return window.slice[j:k]
+	return window.prepare(length)
 }
 
 // CommitBulkWrite completes the bulk write begun by the previous call to
@@ -100,19 +455,25 @@ func (window *Window) PrepareBulkWrite(length uint) []byte {
 // slice returned by PrepareBulkWrite.
 //
 func (window *Window) CommitBulkWrite(length uint) {
-	size := window.size
-	assert.Assertf(length <= uint(size), "length %d > window size %d", length, uint(size))
-	j := window.end
-	k := j + uint32(length)
-	window.end = k
+	staged := window.staged
+	assert.Assertf(length <= uint(staged), "length %d > prepared length %d", length, uint(staged))
+	window.staged = 0
+	if window.direct {
+		window.direct = false
+		j := window.end
+		bzero.Uint8(window.slice[j+uint32(length) : j+staged])
+		window.commit(uint32(length))
+		return
+	}
+	window.store(window.stage[:length])
 }
 
 // WriteByte writes a single byte to the Window.  The oldest byte in the Window
 // is dropped to make room.
 func (window *Window) WriteByte(ch byte) error {
-	window.shift(1)
+	window.unshare()
 	window.slice[window.end] = ch
-	window.end++
+	window.commit(1)
 	return nil
 }
 
@@ -125,46 +486,221 @@ func (window *Window) Write(data []byte) (int, error) {
 	size := window.size
 	if length > uint(size) {
 		x := length - uint(size)
+		for _, h := range window.hashers {
+			_, _ = h.Write(data[:x])
+		}
 		data = data[x:]
+		window.total += uint64(x)
+		window.written += uint64(x)
+	}
+
+	window.store(data)
+	return result, nil
+}
+
+// WriteString writes a string to the Window.  It behaves identically to Write,
+// but avoids the cost of converting the string to a byte slice.
+func (window *Window) WriteString(str string) (int, error) {
+	window.unshare()
+	result := len(str)
+	length := uint(result)
+	size := window.size
+	if length > uint(size) {
+		x := length - uint(size)
+		for _, h := range window.hashers {
+			_, _ = io.WriteString(h, str[:x])
+		}
+		str = str[x:]
 		length = uint(size)
+		window.total += uint64(x)
+		window.written += uint64(x)
 	}
 
-	window.shift(uint32(length))
 	j := window.end
-	k := j + uint32(length)
-	copy(window.slice[j:k], data)
-	window.end = k
+	n := copy(window.slice[j:], str)
+	copy(window.slice, str[n:])
+	window.commit(uint32(length))
 	return result, nil
 }
 
-// BytesView returns a slice into the Window's contents.
+// WriteByteRun writes n copies of ch to the Window.  It behaves identically to
+// calling WriteByte n times, but fills each contiguous region of the Window in
+// a single pass.  If n exceeds Window.Size(), then only the last Window.Size()
+// copies will be recorded.
+func (window *Window) WriteByteRun(ch byte, n uint) (int, error) {
+	window.unshare()
+	length := n
+	size := window.size
+	if length > uint(size) {
+		x := length - uint(size)
+		length = uint(size)
+		window.total += uint64(x)
+		window.written += uint64(x)
+
+		// The entire slice is about to be filled with ch, so it can
+		// serve as the source of the dropped bytes for the hashers.
+		memset(window.slice, ch)
+		for _, h := range window.hashers {
+			for y := x; y != 0; {
+				chunk := window.slice
+				if y < uint(len(chunk)) {
+					chunk = chunk[:y]
+				}
+				_, _ = h.Write(chunk)
+				y -= uint(len(chunk))
+			}
+		}
+	}
+
+	j := window.end
+	k := j + uint32(length)
+	if k > size {
+		memset(window.slice[j:size], ch)
+		memset(window.slice[:k-size], ch)
+	} else {
+		memset(window.slice[j:k], ch)
+	}
+	window.commit(uint32(length))
+	return int(n), nil
+}
+
+// ReadFrom fills the Window by reading from the provided Reader until EOF.  As
+// with Write, the oldest bytes in the Window are dropped to make room, and if
+// the Reader supplies more than Window.Size() bytes then only the last
+// Window.Size() bytes are retained.  Returns the total number of bytes read,
+// and any error returned by the Reader other than io.EOF.
+//
+// While the Window is not yet full, the Reader reads directly into the unused
+// bytes of the Window's circular buffer.  Once the Window is full, each Read
+// is instead made into a staging area of up to 64 KiB and then copied into
+// place, as io.Reader permits Read to scribble over its entire buffer, which
+// would otherwise destroy retained bytes beyond those actually read.  In the
+// steady state, therefore, every byte is copied once more than a direct read
+// would require; compare BenchmarkWindow_ReadFrom_Direct_20 and
+// BenchmarkWindow_ReadFrom_Staged_20.
+func (window *Window) ReadFrom(r io.Reader) (int64, error) {
+	total, err := window.readFrom(r, ^uint64(0))
+	if err == io.EOF {
+		err = nil
+	}
+	return total, err
+}
+
+// ReadFromN is like ReadFrom, but stops after reading n bytes.  As with
+// io.CopyN, the returned count is equal to n if and only if the returned error
+// is nil; if the Reader reaches EOF early, io.EOF is returned.  Once the
+// Window is full, each Read is staged and copied, just as for ReadFrom.
+func (window *Window) ReadFromN(r io.Reader, n uint) (int64, error) {
+	total, err := window.readFrom(r, uint64(n))
+	switch {
+	case uint64(total) == uint64(n):
+		err = nil
+	case err == nil:
+		err = io.EOF
+	}
+	return total, err
+}
+
+// BytesView returns a slice into the Window's contents.  If the contents wrap
+// around the end of the Window's circular buffer, a copy is allocated and
+// returned instead.
 //
 // The returned slice is only valid until the next call to any mutating method
 // on this Window; mutating methods are those which take a pointer receiver.
 //
 func (window Window) BytesView() []byte {
-	size := window.size
-	j := window.end
-	i := j - size
-	return window.slice[i:j]
+	return window.view(window.size, window.size)
+}
+
+// BytesViews returns the Window's contents as two slices into the Window's
+// circular buffer, such that the contents are the concatenation of the two.
+// The second slice is empty if the contents do not wrap around.  This never
+// allocates.
+//
+// The returned slices are only valid until the next call to any mutating
+// method on this Window; mutating methods are those which take a pointer
+// receiver.
+//
+func (window Window) BytesViews() ([]byte, []byte) {
+	return window.span(window.size, window.size)
 }
 
 // Bytes allocates and returns a copy of the Window's contents.
 func (window Window) Bytes() []byte {
-	size := window.size
-	j := window.end
-	i := j - size
-	out := make([]byte, size)
-	copy(out, window.slice[i:j])
+	out := make([]byte, window.size)
+	window.copyOut(out, window.size)
+	return out
+}
+
+// AppendBytes appends a copy of the Window's contents to dst and returns the
+// extended slice.  Unlike Bytes, this does not allocate if dst has sufficient
+// capacity.
+func (window Window) AppendBytes(dst []byte) []byte {
+	a, b := window.BytesViews()
+	dst = append(dst, a...)
+	dst = append(dst, b...)
+	return dst
+}
+
+// Last returns a slice into the Window's contents, holding the most recent
+// min(n, Window.Len()) bytes in the order in which they were written.  As with
+// BytesView, a copy is allocated if these bytes wrap around the end of the
+// Window's circular buffer.
+//
+// The returned slice is only valid until the next call to any mutating method
+// on this Window; mutating methods are those which take a pointer receiver.
+//
+func (window Window) Last(n uint) []byte {
+	if fill := uint(window.fill); n > fill {
+		n = fill
+	}
+	return window.view(uint32(n), uint32(n))
+}
+
+// LastCopy allocates and returns a copy of the slice that Last would return.
+func (window Window) LastCopy(n uint) []byte {
+	if fill := uint(window.fill); n > fill {
+		n = fill
+	}
+	out := make([]byte, n)
+	window.copyOut(out, uint32(n))
 	return out
 }
 
+// ExportDictionary allocates and returns a copy of the most recent
+// min(maxLen, Window.Len()) bytes, suitable for use as a preset dictionary with
+// compress/flate's NewWriterDict and NewReaderDict, zstd's WithEncoderDict, and
+// similar APIs.
+//
+// The bytes are returned in the order in which they were written: the most
+// recently written byte is the *last* byte of the returned slice.  This is the
+// ordering that those APIs expect; reversing it will silently destroy the
+// compression ratio (or, for a decoder, corrupt the output).
+//
+// For compress/flate, maxLen should be 32768.
+func (window Window) ExportDictionary(maxLen uint) []byte {
+	return window.LastCopy(maxLen)
+}
+
+// ExportDictionaryTo is like ExportDictionary, but copies the most recent
+// min(len(dst), Window.Len()) bytes into the start of dst rather than allocating.
+// Returns the number of bytes copied.  The ordering is the same as for
+// ExportDictionary, i.e. dst[n-1] is the most recently written byte.
+func (window Window) ExportDictionaryTo(dst []byte) int {
+	n := uint(len(dst))
+	if fill := uint(window.fill); n > fill {
+		n = fill
+	}
+	return window.copyOut(dst[:n], uint32(n))
+}
+
 // Hash non-destructively writes the contents of the Window into the provided
 // Hash object(s).
 func (window Window) Hash(hashes ...hash.Hash) {
-	view := window.BytesView()
+	a, b := window.BytesViews()
 	for _, h := range hashes {
-		h.Write(view)
+		h.Write(a)
+		h.Write(b)
 	}
 }
 
@@ -172,7 +708,7 @@ func (window Window) Hash(hashes ...hash.Hash) {
 // with it, and calls Sum32 on it.
 func (window Window) Hash32(fn func() hash.Hash32) uint32 {
 	h := fn()
-	h.Write(window.BytesView())
+	window.Hash(h)
 	return h.Sum32()
 }
 
@@ -185,17 +721,29 @@ func (window Window) LookupByte(distance uint) (byte, error) {
 		return 0, ErrBadDistance
 	}
 
-	j := window.end
-	k := j - uint32(distance)
+	k := (window.end - uint32(distance)) & (size - 1)
 	return window.slice[k], nil
 }
 
+// LookupByteAt returns a byte which was written previously.  The argument is
+// the absolute stream offset of the byte, counting from 0 for the first byte
+// written to the Window.  If the byte is no longer retained by the Window,
+// ErrBadDistance is returned.
+func (window Window) LookupByteAt(offset uint64) (byte, error) {
+	total := window.total
+	if offset >= total || offset < window.OldestOffset() {
+		return 0, ErrBadDistance
+	}
+	return window.LookupByte(uint(total - offset))
+}
+
 // LookupSlice returns a slice which was written previously.  The distance
 // argument measures the offset into the Window, with 1 representing the most
 // recently written byte and Window.Size() representing the oldest byte still
 // within the Window.  The length argument is the maximum length of the slice
 // to be returned; it may be shorter if it would otherwise extend past the most
-// recently written byte.
+// recently written byte.  As with BytesView, a copy is allocated if the
+// requested bytes wrap around the end of the Window's circular buffer.
 func (window Window) LookupSlice(distance uint, length uint) ([]byte, error) {
 	size := window.size
 	if distance == 0 || distance > uint(size) {
@@ -206,38 +754,311 @@ func (window Window) LookupSlice(distance uint, length uint) ([]byte, error) {
 		length = distance
 	}
 
+	return window.view(uint32(distance), uint32(length)), nil
+}
+
+// LookupSlices is like LookupSlice, but returns the requested bytes as two
+// slices into the Window's circular buffer instead of allocating when they
+// wrap around.  The second slice is empty if the bytes do not wrap around.
+func (window Window) LookupSlices(distance uint, length uint) ([]byte, []byte, error) {
+	size := window.size
+	if distance == 0 || distance > uint(size) {
+		return nil, nil, ErrBadDistance
+	}
+
+	if length > distance {
+		length = distance
+	}
+
+	a, b := window.span(uint32(distance), uint32(length))
+	return a, b, nil
+}
+
+// CopyTo copies bytes which were written previously into dst.  The distance
+// argument has the same meaning as for LookupSlice.  Up to len(dst) bytes are
+// copied, stopping early at the most recently written byte.  Returns the number
+// of bytes copied.
+func (window Window) CopyTo(dst []byte, distance uint) (int, error) {
+	size := window.size
+	if distance == 0 || distance > uint(size) {
+		return 0, ErrBadDistance
+	}
+
+	if length := uint(len(dst)); length > distance {
+		dst = dst[:distance]
+	}
+
+	return window.copyOut(dst, uint32(distance)), nil
+}
+
+// Compare returns the length of the longest common prefix of data and the bytes
+// of the Window starting at the given distance, with the same meaning as for
+// LookupSlice, and walking forward toward the most recently written byte.  If
+// len(data) exceeds distance, the comparison continues past the most recently
+// written byte using the leading bytes of data itself, as though each byte of
+// data had been written to the Window once matched; this is the overlapping
+// copy semantics of an LZ77 back-reference.  Nothing is allocated.
+func (window Window) Compare(distance uint, data []byte) (uint, error) {
+	size := window.size
+	if distance == 0 || distance > uint(size) {
+		return 0, ErrBadDistance
+	}
+
+	slice := window.slice
+	mask := size - 1
+	k := window.end - uint32(distance)
+	length := uint(len(data))
+	limit := length
+	if limit > distance {
+		limit = distance
+	}
+
+	n := uint(0)
+	for n < limit && slice[(k+uint32(n))&mask] == data[n] {
+		n++
+	}
+	if n < limit {
+		return n, nil
+	}
+	for n < length && data[n-distance] == data[n] {
+		n++
+	}
+	return n, nil
+}
+
+// FindLongestMatch searches the Window for the longest prefix of data which is
+// present in the Window, and returns its distance (with the same meaning as for
+// LookupSlice) and length.  Only bytes written since the last Init or Clear are
+// searched, and a match never extends past the most recently written byte.
+//
+// Matches shorter than minLen are ignored, and matches are truncated to at
+// most maxLen bytes.  If several matches are equally long, the one with the
+// smallest distance is returned.  If no match is found, ok is false.
+func (window Window) FindLongestMatch(data []byte, minLen uint, maxLen uint) (distance uint, length uint, ok bool) {
+	if n := uint(len(data)); maxLen > n {
+		maxLen = n
+	}
+	if minLen == 0 {
+		minLen = 1
+	}
+	if minLen > maxLen {
+		return
+	}
+
+	slice := window.slice
+	mask := window.size - 1
 	j := window.end
-	k := j - uint32(distance)
-	l := k + uint32(length)
-	return window.slice[k:l], nil
+	fill := uint(window.fill)
+	for d := minLen; d <= fill; d++ {
+		limit := maxLen
+		if limit > d {
+			limit = d
+		}
+		if limit <= length {
+			continue
+		}
+
+		k := j - uint32(d)
+		n := uint(0)
+		for n < limit && slice[(k+uint32(n))&mask] == data[n] {
+			n++
+		}
+
+		if n >= minLen && n > length {
+			distance = d
+			length = n
+			ok = true
+			if n >= maxLen {
+				break
+			}
+		}
+	}
+	return
+}
+
+// Index returns the offset of the first occurrence of pattern within the
+// Window's contents, or -1 if pattern is not present.  Offsets are indices into
+// the slice returned by Bytes, so 0 represents the oldest byte in the Window.
+func (window Window) Index(pattern []byte) int {
+	a, b := window.BytesViews()
+	if index := bytes.Index(a, pattern); index >= 0 {
+		return index
+	}
+
+	if m := len(pattern); m > 1 && len(b) != 0 {
+		x := len(a) - (m - 1)
+		if x < 0 {
+			x = 0
+		}
+		y := m - 1
+		if y > len(b) {
+			y = len(b)
+		}
+		seam := make([]byte, 0, (len(a)-x)+y)
+		seam = append(seam, a[x:]...)
+		seam = append(seam, b[:y]...)
+		if index := bytes.Index(seam, pattern); index >= 0 {
+			return x + index
+		}
+	}
+
+	if index := bytes.Index(b, pattern); index >= 0 {
+		return len(a) + index
+	}
+	return -1
 }
 
-// DebugString returns a detailed dump of the Window's internal state.
+// Contains returns true iff pattern is present within the Window's contents.
+func (window Window) Contains(pattern []byte) bool {
+	return window.Index(pattern) >= 0
+}
+
+// MarshalBinary encodes the Window's size, contents, stream offset counter,
+// and the counters returned by Metrics into a binary form.  Only the bytes
+// written since the last Init or Clear are included.
+func (window Window) MarshalBinary() ([]byte, error) {
+	out := make([]byte, 2, 2+5*binary.MaxVarintLen64+int(window.fill))
+	out[0] = windowBinaryVersion
+	out[1] = window.nbits
+	out = appendUvarint(out, uint64(window.fill))
+	out = appendUvarint(out, window.total)
+	out = appendUvarint(out, window.written)
+	out = appendUvarint(out, window.wraps)
+	out = appendUvarint(out, uint64(window.hiwat))
+	out = out[:len(out)+int(window.fill)]
+	window.copyOut(out[len(out)-int(window.fill):], window.fill)
+	return out, nil
+}
+
+// UnmarshalBinary replaces the Window with one decoded from the output of
+// MarshalBinary.  If the data is malformed, ErrCorrupt is returned and the
+// Window is left untouched.
+//
+// The Window's storage is allocated at the size recorded in the data, which
+// may be as large as 2**31 bytes however few bytes the data holds.  Use
+// UnmarshalBinaryLimit to decode untrusted data.
+func (window *Window) UnmarshalBinary(data []byte) error {
+	return window.UnmarshalBinaryLimit(data, maxWindowBits)
+}
+
+// UnmarshalBinaryLimit is like UnmarshalBinary, but returns a NumBitsError
+// without allocating if the decoded Window would hold more than 2**maxNumBits
+// bytes.
+func (window *Window) UnmarshalBinaryLimit(data []byte, maxNumBits uint) error {
+	if len(data) < 2 || data[0] != windowBinaryVersion || data[1] > maxWindowBits {
+		return ErrCorrupt
+	}
+	nbits := uint(data[1])
+	data = data[2:]
+
+	fill, n := binary.Uvarint(data)
+	if n <= 0 || fill > (uint64(1)<<nbits) {
+		return ErrCorrupt
+	}
+	data = data[n:]
+
+	var fields [4]uint64
+	for index := range fields {
+		value, n := binary.Uvarint(data)
+		if n <= 0 {
+			return ErrCorrupt
+		}
+		fields[index] = value
+		data = data[n:]
+	}
+	total, written, wraps, hiwat := fields[0], fields[1], fields[2], fields[3]
+	if total < fill || hiwat > (uint64(1)<<nbits) {
+		return ErrCorrupt
+	}
+
+	if uint64(len(data)) != fill {
+		return ErrCorrupt
+	}
+	if nbits > maxNumBits {
+		return NumBitsError{NumBits: nbits, Max: maxNumBits}
+	}
+
+	// As with Restore, the state is set directly rather than by writing
+	// the contents, which would disturb the counters.
+	window.Init(nbits)
+	copy(window.slice, data)
+	zrun := uint32(fill)
+	for zrun != 0 && data[zrun-1] == 0 {
+		zrun--
+	}
+	window.end = uint32(fill) & (window.size - 1)
+	window.fill = uint32(fill)
+	window.zrun = uint32(fill) - zrun
+	window.total = total
+	window.written = written
+	window.wraps = wraps
+	window.hiwat = uint32(hiwat)
+	return nil
+}
+
+// GobEncode implements gob.GobEncoder.  It is equivalent to MarshalBinary.
+func (window Window) GobEncode() ([]byte, error) {
+	return window.MarshalBinary()
+}
+
+// GobDecode implements gob.GobDecoder.  It is equivalent to UnmarshalBinary,
+// so a few bytes of data may demand a Window as large as 2**31 bytes.  When
+// decoding an untrusted gob stream, decode the Window's encoding as a []byte
+// instead and pass it to UnmarshalBinaryLimit.
+func (window *Window) GobDecode(data []byte) error {
+	return window.UnmarshalBinary(data)
+}
+
+// DebugString returns a detailed dump of the Window's internal state.  Only
+// the most recently written bytes are included; use HexDump to control how
+// many.
 func (window Window) DebugString() string {
 	bb := bufferpool.Get()
 	defer bufferpool.Put(bb)
 
-	nbits := window.nbits
-	size := window.size
-	j := window.end
-	i := j - size
-	slice := window.slice
-
 	bb.WriteString("Window(")
-	fmt.Fprintf(bb, "nbits=%d, ", nbits)
-	fmt.Fprintf(bb, "size=%d, ", size)
-	fmt.Fprintf(bb, "i=%d, ", i)
-	fmt.Fprintf(bb, "j=%d, ", j)
-	bb.WriteString("[")
-	for i < j {
-		ch := slice[i]
-		i++
-		fmt.Fprintf(bb, " %02x", ch)
-	}
-	bb.WriteString(" ])")
+	fmt.Fprintf(bb, "nbits=%d, ", window.nbits)
+	fmt.Fprintf(bb, "size=%d, ", window.size)
+	fmt.Fprintf(bb, "fill=%d, ", window.fill)
+	fmt.Fprintf(bb, "end=%d", window.end)
+	bb.WriteString(")\n")
+	_ = window.HexDump(bb, debugDumpBytes)
 	return bb.String()
 }
 
+// HexDump writes the contents of the Window to w in the style of "hexdump -C":
+// rows of 16 bytes, each prefixed with the offset of its first byte (with 0
+// representing the oldest byte in the Window) and followed by an ASCII gutter.
+// Only the most recent maxBytes bytes are written, preceded by a marker line
+// stating how many older bytes were omitted.  If maxBytes is 0, the entire
+// Window is written.
+func (window Window) HexDump(w io.Writer, maxBytes uint) error {
+	size := uint(window.size)
+
+	start := uint(0)
+	if maxBytes != 0 && maxBytes < size {
+		start = size - maxBytes
+		if _, err := fmt.Fprintf(w, "[... %d bytes omitted ...]\n", start); err != nil {
+			return err
+		}
+	}
+
+	var row [hexDumpRowLen]byte
+	var line [hexDumpLineLen]byte
+	for offset := start; offset < size; offset += hexDumpRowLen {
+		rowLen := size - offset
+		if rowLen > hexDumpRowLen {
+			rowLen = hexDumpRowLen
+		}
+		window.copyOut(row[:rowLen], uint32(size-offset))
+		n := formatHexDumpLine(line[:], offset, row[:rowLen])
+		if _, err := w.Write(line[:n]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // GoString returns a brief dump of the Window's internal state.
 func (window Window) GoString() string {
 	return fmt.Sprintf("Window(size=%d,end=%d)", window.size, window.end)
@@ -248,24 +1069,366 @@ func (window Window) String() string {
 	return string(window.BytesView())
 }
 
-func (window *Window) shift(n uint32) {
+const windowBinaryVersion = 1
+
+const maxWindowBits = 31
+
+// windowStageMax is the largest number of bytes which PrepareBulkWrite and
+// ReadFrom stage at a time.
+const windowStageMax = 1 << 16
+
+func checkWindowBits(numBits uint) error {
+	if numBits > maxWindowBits {
+		return NumBitsError{NumBits: numBits, Max: maxWindowBits}
+	}
+	return nil
+}
+
+func appendUvarint(out []byte, value uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], value)
+	return append(out, tmp[:n]...)
+}
+
+const (
+	debugDumpBytes = 256
+	hexDumpRowLen  = 16
+	hexDumpLineLen = 8 + 2 + 3*hexDumpRowLen + 1 + 2 + hexDumpRowLen + 2
+	hexDigits      = "0123456789abcdef"
+)
+
+func formatHexDumpLine(line []byte, offset uint, row []byte) int {
+	n := 0
+	for shift := 28; shift >= 0; shift -= 4 {
+		line[n] = hexDigits[(offset>>uint(shift))&0xf]
+		n++
+	}
+	line[n] = ' '
+	line[n+1] = ' '
+	n += 2
+
+	for index := 0; index < hexDumpRowLen; index++ {
+		if index == hexDumpRowLen/2 {
+			line[n] = ' '
+			n++
+		}
+		if index < len(row) {
+			ch := row[index]
+			line[n] = hexDigits[ch>>4]
+			line[n+1] = hexDigits[ch&0xf]
+		} else {
+			line[n] = ' '
+			line[n+1] = ' '
+		}
+		line[n+2] = ' '
+		n += 3
+	}
+
+	line[n] = ' '
+	line[n+1] = '|'
+	n += 2
+	for _, ch := range row {
+		if ch < 0x20 || ch > 0x7e {
+			ch = '.'
+		}
+		line[n] = ch
+		n++
+	}
+	line[n] = '|'
+	line[n+1] = '\n'
+	n += 2
+	return n
+}
+
+// span returns, as two slices, the length bytes starting distance bytes back
+// from the most recently written byte.  The caller must ensure that length <=
+// distance <= size.
+func (window Window) span(distance uint32, length uint32) ([]byte, []byte) {
+	slice := window.slice
+	size := window.size
+	k := (window.end - distance) & (size - 1)
+	l := k + length
+	if l <= size {
+		return slice[k:l], slice[:0]
+	}
+	return slice[k:size], slice[:l-size]
+}
+
+// view is like span, but returns a single slice, allocating a copy if the bytes
+// wrap around.
+func (window Window) view(distance uint32, length uint32) []byte {
+	a, b := window.span(distance, length)
+	if len(b) == 0 {
+		return a
+	}
+	out := make([]byte, length)
+	copy(out[copy(out, a):], b)
+	return out
+}
+
+// copyOut copies len(dst) bytes starting distance bytes back from the most
+// recently written byte into dst.  The caller must ensure that len(dst) <=
+// distance <= size.
+func (window Window) copyOut(dst []byte, distance uint32) int {
+	a, b := window.span(distance, uint32(len(dst)))
+	n := copy(dst, a)
+	n += copy(dst[n:], b)
+	return n
+}
+
+func memset(slice []byte, ch byte) {
+	if len(slice) == 0 {
+		return
+	}
+	slice[0] = ch
+	for i := 1; i < len(slice); i *= 2 {
+		copy(slice[i:], slice[:i])
+	}
+}
+
+func (window *Window) initSlice(slice []byte, numBits uint) {
+	*window = Window{
+		slice: slice,
+		size:  uint32(len(slice)),
+		gen:   window.gen + 1,
+		nbits: byte(numBits),
+	}
+}
+
+// readFrom reads directly into the unused bytes following the newest byte,
+// if there are any, and otherwise through the staging area, as io.Reader
+// permits Read to use all of its buffer as scratch space even when it returns
+// fewer bytes.  Unused bytes are always 0, so any scratch bytes left behind by
+// a direct read are zeroed again.
+func (window *Window) readFrom(r io.Reader, limit uint64) (int64, error) {
+	var total uint64
+	for total < limit {
+		length := uint64(windowStageMax)
+		if x := limit - total; length > x {
+			length = x
+		}
+
+		if free := window.free(); free != 0 {
+			if length > uint64(free) {
+				length = uint64(free)
+			}
+			window.unshare()
+			j := window.end
+			buf := window.slice[j : j+uint32(length)]
+			nn, err := r.Read(buf)
+			assert.Assertf(nn >= 0, "Read() returned %d, which is < 0", nn)
+			assert.Assertf(nn <= len(buf), "Read() returned %d, which is > len(buffer) %d", nn, len(buf))
+			bzero.Uint8(buf[nn:])
+			window.commit(uint32(nn))
+			total += uint64(nn)
+			if err != nil {
+				return int64(total), err
+			}
+			continue
+		}
+
+		buf := window.prepare(uint(length))
+		nn, err := r.Read(buf)
+		assert.Assertf(nn >= 0, "Read() returned %d, which is < 0", nn)
+		assert.Assertf(nn <= len(buf), "Read() returned %d, which is > len(buffer) %d", nn, len(buf))
+		window.staged = 0
+		window.store(buf[:nn])
+		total += uint64(nn)
+		if err != nil {
+			return int64(total), err
+		}
+	}
+	return int64(total), nil
+}
+
+// free returns the number of unused bytes which follow the newest byte without
+// wrapping around the end of the circular buffer.
+func (window Window) free() uint32 {
+	free := window.size - window.fill
+	if x := window.size - window.end; free > x {
+		free = x
+	}
+	return free
+}
+
+// prepare returns the staging area, with room for up to length bytes.
+func (window *Window) prepare(length uint) []byte {
+	if size := uint(window.size); length > size {
+		length = size
+	}
+	if length > windowStageMax {
+		length = windowStageMax
+	}
+	if uint(len(window.stage)) < length {
+		window.stage = make([]byte, length)
+	}
+	window.staged = uint32(length)
+	return window.stage[:length]
+}
+
+// store copies data, which must not exceed Window.Size() bytes, into the
+// Window's circular buffer and commits it.
+func (window *Window) store(data []byte) {
+	window.unshare()
+	j := window.end
+	n := copy(window.slice[j:], data)
+	copy(window.slice, data[n:])
+	window.commit(uint32(len(data)))
+}
+
+// abandon discards any bulk write still pending since the last call to
+// PrepareBulkWrite, zeroing again any unused bytes it handed out.
+func (window *Window) abandon() {
+	if window.direct {
+		j := window.end
+		bzero.Uint8(window.slice[j : j+window.staged])
+		window.direct = false
+	}
+	window.staged = 0
+}
+
+func (window *Window) unshare() {
+	window.abandon()
+	if share := window.cow; share != nil {
+		if atomic.LoadInt32(&share.refs) > 0 {
+			dupe := make([]byte, len(window.slice))
+			copy(dupe, window.slice)
+			window.slice = dupe
+		}
+		window.cow = nil
+	}
+}
+
+func (window *Window) commit(n uint32) {
 	size := window.size
+	mask := size - 1
 	slice := window.slice
 	j := window.end
 	k := j + n
-	if k <= uint32(len(slice)) {
-		return
+	window.end = k & mask
+	window.total += uint64(n)
+	window.written += uint64(n)
+	window.gen++
+	if k >= size && n != 0 {
+		window.wraps++
+	}
+
+	if len(window.hashers) != 0 && n != 0 {
+		var a, b []byte
+		if k > size {
+			a = slice[j:size]
+			b = slice[:k-size]
+		} else {
+			a = slice[j:k]
+		}
+		for _, h := range window.hashers {
+			_, _ = h.Write(a)
+			_, _ = h.Write(b)
+		}
+	}
+
+	fill := window.fill + n
+	if fill > size || fill < n {
+		fill = size
+	}
+	window.fill = fill
+	if fill > window.hiwat {
+		window.hiwat = fill
+	}
+
+	x := k
+	for x > j && slice[(x-1)&mask] == 0 {
+		x--
 	}
+	if x == j {
+		zrun := window.zrun + n
+		if zrun > size || zrun < n {
+			zrun = size
+		}
+		window.zrun = zrun
+	} else {
+		window.zrun = k - x
+	}
+
+	if rollK := window.rollK; rollK != 0 {
+		if n >= rollK || uint64(n)+uint64(rollK) > uint64(size) {
+			window.rollReset()
+			return
+		}
 
-	i := j - size
-	copy(slice[0:size], slice[i:j])
-	bzero.Uint8(slice[size:])
-	window.end = size
+		a := window.rollA
+		b := window.rollB
+		for index := j; index < k; index++ {
+			in := uint32(slice[index&mask])
+			out := uint32(slice[(index-rollK)&mask])
+			a = a - out + in
+			b = b - rollK*out + a
+		}
+		window.rollA = a
+		window.rollB = b
+	}
+}
+
+func (window *Window) rollReset() {
+	var a, b uint32
+	if rollK := window.rollK; rollK != 0 {
+		x, y := window.span(rollK, rollK)
+		for _, ch := range x {
+			a += uint32(ch)
+			b += a
+		}
+		for _, ch := range y {
+			a += uint32(ch)
+			b += a
+		}
+	}
+	window.rollA = a
+	window.rollB = b
 }
 
 var (
-	_ io.Writer      = (*Window)(nil)
-	_ io.ByteWriter  = (*Window)(nil)
-	_ fmt.GoStringer = Window{}
-	_ fmt.Stringer   = Window{}
+	_ io.Writer       = (*Window)(nil)
+	_ io.ByteWriter   = (*Window)(nil)
+	_ io.StringWriter = (*Window)(nil)
+	_ io.ReaderFrom   = (*Window)(nil)
+	_ fmt.GoStringer  = Window{}
+	_ fmt.Stringer    = Window{}
+
+	_ encoding.BinaryMarshaler   = Window{}
+	_ encoding.BinaryUnmarshaler = (*Window)(nil)
+	_ gob.GobEncoder             = Window{}
+	_ gob.GobDecoder             = (*Window)(nil)
 )
+
+// Release indicates that the FrozenWindow is no longer needed, allowing the
+// Window it was captured from to resume mutating its storage in place.  The
+// FrozenWindow must not be used after Release is called.
+func (frozen *FrozenWindow) Release() {
+	assert.NotNil(&frozen.share)
+	refs := atomic.AddInt32(&frozen.share.refs, -1)
+	assert.Assertf(refs >= 0, "FrozenWindow released too many times")
+	frozen.share = nil
+	frozen.window = Window{}
+}
+
+// Len returns the number of bytes held by the FrozenWindow.
+func (frozen *FrozenWindow) Len() uint {
+	return frozen.window.Len()
+}
+
+// Bytes returns a copy of the FrozenWindow's contents, oldest byte first.
+func (frozen *FrozenWindow) Bytes() []byte {
+	return frozen.window.Bytes()
+}
+
+// LookupByte returns the byte which was written the given number of bytes
+// before the FrozenWindow was captured, as with Window.LookupByte.
+func (frozen *FrozenWindow) LookupByte(distance uint) (byte, error) {
+	return frozen.window.LookupByte(distance)
+}
+
+// Hash non-destructively writes the contents of the FrozenWindow into the
+// provided Hash object(s).
+func (frozen *FrozenWindow) Hash(hashes ...hash.Hash) {
+	frozen.window.Hash(hashes...)
+}
@@ -0,0 +1,36 @@
+//go:build go1.23
+// +build go1.23
+
+package buffer
+
+import (
+	"fmt"
+	"iter"
+)
+
+// All returns an iterator over the Window's contents, oldest byte first.  Each
+// byte is yielded together with its offset, which is an index into the slice
+// returned by Bytes, so 0 represents the oldest byte in the Window.  No bytes
+// are copied.
+//
+// The Window must not be mutated while an iteration is in progress.  If it is,
+// the iteration panics at its next step, with an error wrapping ErrInvariant,
+// rather than yield stale bytes.
+func (window *Window) All() iter.Seq2[uint, byte] {
+	return func(yield func(uint, byte) bool) {
+		gen := window.gen
+		a, b := window.BytesViews()
+		offset := uint(0)
+		for _, part := range [2][]byte{a, b} {
+			for _, ch := range part {
+				if window.gen != gen {
+					panic(fmt.Errorf("%w: Window was mutated during iteration by All", ErrInvariant))
+				}
+				if !yield(offset, ch) {
+					return
+				}
+				offset++
+			}
+		}
+	}
+}
@@ -0,0 +1,57 @@
+//go:build go1.23
+// +build go1.23
+
+package buffer
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestWindow_All(t *testing.T) {
+	var window Window
+	window.Init(4)
+
+	check := func(name string) {
+		t.Helper()
+		var actual []byte
+		for offset, ch := range window.All() {
+			if offset != uint(len(actual)) {
+				t.Errorf("%s: All yielded wrong offset:\n\texpect: %d\n\tactual: %d", name, len(actual), offset)
+			}
+			actual = append(actual, ch)
+		}
+		if expect := window.Bytes(); !bytes.Equal(expect, actual) {
+			t.Errorf("%s: All yielded wrong data:\n\texpect: %q\n\tactual: %q", name, expect, actual)
+		}
+	}
+
+	check("empty")
+	_, _ = window.WriteString("abc")
+	check("partial")
+	_, _ = window.WriteString("0123456789abcdef")
+	check("wrapped")
+	_, _ = window.WriteString("0123456789abcdefXYZ")
+	check("oversized")
+	window.Clear()
+	check("cleared")
+}
+
+func TestWindow_All_Mutation(t *testing.T) {
+	var window Window
+	window.Init(4)
+	_, _ = window.WriteString("abcdef")
+
+	defer func() {
+		r := recover()
+		if r == nil {
+			t.Errorf("All did not panic when the Window was mutated during iteration")
+		} else if err, ok := r.(error); !ok || !errors.Is(err, ErrInvariant) {
+			t.Errorf("All panicked with wrong value:\n\texpect: %v\n\tactual: %v", ErrInvariant, r)
+		}
+	}()
+	for range window.All() {
+		_ = window.WriteByte('x')
+	}
+}
@@ -1,9 +1,1372 @@
 package buffer
 
 import (
+	"bytes"
+	"compress/flate"
+	"encoding/gob"
+	"errors"
+	"hash/crc32"
+	"io"
+	"math/rand"
+	"strings"
 	"testing"
+	"testing/iotest"
+
+	"github.com/chronos-tachyon/bzero"
 )
 
+func TestWindow_Clear(t *testing.T) {
+	var fresh, window Window
+	fresh.Init(4)
+	window.Init(4)
+
+	_, _ = window.Write([]byte("0123456789abcdefghij"))
+	window.Clear()
+
+	if window.Len() != 0 {
+		t.Errorf("Len returned wrong value after Clear:\n\texpect: %d\n\tactual: %d", 0, window.Len())
+	}
+	if !window.IsZero() {
+		t.Errorf("IsZero returned false after Clear")
+	}
+	if expect, actual := fresh.Bytes(), window.Bytes(); !bytes.Equal(expect, actual) {
+		t.Errorf("Bytes returned wrong contents after Clear:\n\texpect: %q\n\tactual: %q", expect, actual)
+	}
+
+	for _, w := range []*Window{&fresh, &window} {
+		_, _ = w.Write([]byte("xyz"))
+		_ = w.WriteByte('!')
+		tmp := w.PrepareBulkWrite(2)
+		copy(tmp, "AB")
+		w.CommitBulkWrite(uint(len(tmp)))
+	}
+
+	if expect, actual := fresh.Bytes(), window.Bytes(); !bytes.Equal(expect, actual) {
+		t.Errorf("Bytes returned wrong contents:\n\texpect: %q\n\tactual: %q", expect, actual)
+	}
+	if expect, actual := fresh.Len(), window.Len(); expect != actual {
+		t.Errorf("Len returned wrong value:\n\texpect: %d\n\tactual: %d", expect, actual)
+	}
+	for distance := uint(1); distance <= fresh.Size(); distance++ {
+		expect, _ := fresh.LookupByte(distance)
+		actual, _ := window.LookupByte(distance)
+		if expect != actual {
+			t.Errorf("LookupByte(%d) returned wrong byte:\n\texpect: %q\n\tactual: %q", distance, expect, actual)
+		}
+	}
+
+	window.SecureClear()
+	for index, ch := range window.slice {
+		if ch != 0 {
+			t.Errorf("SecureClear left non-zero byte %#02x at index %d", ch, index)
+			break
+		}
+	}
+	if expect, actual := fresh.NumBits(), window.NumBits(); expect != actual {
+		t.Errorf("NumBits returned wrong value after SecureClear:\n\texpect: %d\n\tactual: %d", expect, actual)
+	}
+}
+
+func TestWindow_WriteString(t *testing.T) {
+	var window Window
+	window.Init(3)
+
+	nn, err := window.WriteString("abc")
+	if err != nil {
+		t.Errorf("WriteString unexpectedly returned non-nil error: %v", err)
+	}
+	if nn != 3 {
+		t.Errorf("WriteString unexpectedly returned nn=%d, expected %d", nn, 3)
+	}
+	if expect, actual := "\x00\x00\x00\x00\x00abc", window.String(); expect != actual {
+		t.Errorf("WriteString recorded wrong contents:\n\texpect: %q\n\tactual: %q", expect, actual)
+	}
+
+	str := "0123456789abcdefghij"
+	nn, err = window.WriteString(str)
+	if err != nil {
+		t.Errorf("WriteString unexpectedly returned non-nil error: %v", err)
+	}
+	if nn != len(str) {
+		t.Errorf("WriteString unexpectedly returned nn=%d, expected %d", nn, len(str))
+	}
+	if expect, actual := "cdefghij", window.String(); expect != actual {
+		t.Errorf("WriteString recorded wrong contents:\n\texpect: %q\n\tactual: %q", expect, actual)
+	}
+	if window.Len() != 8 {
+		t.Errorf("Len returned wrong value:\n\texpect: %d\n\tactual: %d", 8, window.Len())
+	}
+}
+
+type chunkReader struct {
+	data   []byte
+	chunks []int
+	index  int
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	n := r.chunks[r.index%len(r.chunks)]
+	r.index++
+	if n > len(p) {
+		n = len(p)
+	}
+	if n > len(r.data) {
+		n = len(r.data)
+	}
+	copy(p, r.data[:n])
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestWindow_ReadFrom(t *testing.T) {
+	data := []byte("The quick brown fox jumps over the lazy dog.")
+	chunks := []int{1, 7, 0, 3, 13, 2}
+
+	for _, numBits := range []uint{2, 4, 6} {
+		var expect, window Window
+		expect.Init(numBits)
+		window.Init(numBits)
+
+		_, _ = expect.Write(data)
+		total, err := window.ReadFrom(&chunkReader{data: data, chunks: chunks})
+		if err != nil {
+			t.Errorf("ReadFrom unexpectedly returned non-nil error: %v", err)
+		}
+		if total != int64(len(data)) {
+			t.Errorf("ReadFrom unexpectedly returned total=%d, expected %d", total, len(data))
+		}
+		if e, a := expect.String(), window.String(); e != a {
+			t.Errorf("ReadFrom recorded wrong contents for numBits=%d:\n\texpect: %q\n\tactual: %q", numBits, e, a)
+		}
+		if e, a := expect.Len(), window.Len(); e != a {
+			t.Errorf("Len returned wrong value for numBits=%d:\n\texpect: %d\n\tactual: %d", numBits, e, a)
+		}
+	}
+
+	var window Window
+	window.Init(4)
+	total, err := window.ReadFromN(&chunkReader{data: data, chunks: chunks}, 10)
+	if err != nil {
+		t.Errorf("ReadFromN unexpectedly returned non-nil error: %v", err)
+	}
+	if total != 10 {
+		t.Errorf("ReadFromN unexpectedly returned total=%d, expected %d", total, 10)
+	}
+	if expect, actual := "\x00\x00\x00\x00\x00\x00The quick ", window.String(); expect != actual {
+		t.Errorf("ReadFromN recorded wrong contents:\n\texpect: %q\n\tactual: %q", expect, actual)
+	}
+
+	total, err = window.ReadFromN(&chunkReader{data: []byte("abc"), chunks: chunks}, 10)
+	if err != io.EOF {
+		t.Errorf("ReadFromN returned wrong error:\n\texpect: [%v]\n\tactual: [%v]", io.EOF, err)
+	}
+	if total != 3 {
+		t.Errorf("ReadFromN unexpectedly returned total=%d, expected %d", total, 3)
+	}
+	if expect, actual := "\x00\x00\x00The quick abc", window.String(); expect != actual {
+		t.Errorf("ReadFromN recorded wrong contents:\n\texpect: %q\n\tactual: %q", expect, actual)
+	}
+
+	total, err = window.ReadFromN(iotest.DataErrReader(strings.NewReader("wxyz")), 4)
+	if err != nil {
+		t.Errorf("ReadFromN with DataErrReader unexpectedly returned non-nil error: %v", err)
+	}
+	if total != 4 {
+		t.Errorf("ReadFromN with DataErrReader unexpectedly returned total=%d, expected %d", total, 4)
+	}
+	if expect, actual := "he quick abcwxyz", window.String(); expect != actual {
+		t.Errorf("ReadFromN with DataErrReader recorded wrong contents:\n\texpect: %q\n\tactual: %q", expect, actual)
+	}
+}
+
+func TestWindow_InitE(t *testing.T) {
+	if err := checkWindowBits(31); err != nil {
+		t.Errorf("checkWindowBits(31) returned unexpected error: %v", err)
+	}
+	if err := checkWindowBits(32); err == nil {
+		t.Errorf("checkWindowBits(32) unexpectedly succeeded")
+	}
+
+	var window Window
+	window.Init(4)
+	_, _ = window.WriteString("abc")
+	expect := window.Bytes()
+
+	err := window.InitE(32)
+	if !errors.Is(err, ErrBadNumBits) {
+		t.Errorf("InitE(32) returned wrong error:\n\texpect: %v\n\tactual: %v", ErrBadNumBits, err)
+	}
+	if expect, actual := "number of bits is out of range: numBits 32 must not exceed 31", err.Error(); expect != actual {
+		t.Errorf("InitE(32) returned wrong error message:\n\texpect: %q\n\tactual: %q", expect, actual)
+	}
+	if actual := window.Bytes(); !bytes.Equal(expect, actual) {
+		t.Errorf("InitE(32) modified the Window:\n\texpect: %q\n\tactual: %q", expect, actual)
+	}
+
+	if err := window.InitE(5); err != nil {
+		t.Errorf("InitE(5) returned unexpected error: %v", err)
+	}
+	if expect, actual := uint(32), window.Size(); expect != actual {
+		t.Errorf("InitE(5) produced wrong Size:\n\texpect: %d\n\tactual: %d", expect, actual)
+	}
+
+	if w, err := NewWindowE(32); w != nil || !errors.Is(err, ErrBadNumBits) {
+		t.Errorf("NewWindowE(32) returned wrong result:\n\texpect: %v, %v\n\tactual: %v, %v", nil, ErrBadNumBits, w, err)
+	}
+}
+
+func TestWindow_AttachHasher(t *testing.T) {
+	var window Window
+	window.Init(4)
+
+	var stream bytes.Buffer
+	h := crc32.NewIEEE()
+	window.AttachHasher(h)
+
+	write := func(data string) {
+		stream.WriteString(data)
+		_, _ = window.Write([]byte(data))
+	}
+	writeString := func(data string) {
+		stream.WriteString(data)
+		_, _ = window.WriteString(data)
+	}
+
+	write("abc")
+	writeString("0123456789")
+	_ = window.WriteByte('X')
+	stream.WriteByte('X')
+
+	// Writes longer than the Window must still hash the dropped prefix.
+	write("the quick brown fox jumps over the lazy dog")
+	writeString("THE QUICK BROWN FOX JUMPS OVER THE LAZY DOG")
+	_, _ = window.WriteByteRun('z', 40)
+	stream.WriteString(strings.Repeat("z", 40))
+	_, _ = window.WriteByteRun('y', 5)
+	stream.WriteString("yyyyy")
+
+	for _, data := range []string{"bulk", "write"} {
+		buf := window.PrepareBulkWrite(uint(len(data)))
+		n := copy(buf, data)
+		window.CommitBulkWrite(uint(n))
+		stream.WriteString(data[:n])
+	}
+
+	_, _ = window.ReadFrom(strings.NewReader("read from a reader, in several chunks"))
+	stream.WriteString("read from a reader, in several chunks")
+
+	if expect, actual := crc32.ChecksumIEEE(stream.Bytes()), h.Sum32(); expect != actual {
+		t.Errorf("attached hasher produced wrong checksum:\n\texpect: %08x\n\tactual: %08x", expect, actual)
+	}
+
+	window.DetachHasher(h)
+	_, _ = window.WriteString("after detach")
+	if expect, actual := crc32.ChecksumIEEE(stream.Bytes()), h.Sum32(); expect != actual {
+		t.Errorf("detached hasher was still written to:\n\texpect: %08x\n\tactual: %08x", expect, actual)
+	}
+
+	panicked := func() (panicked bool) {
+		defer func() {
+			if recover() != nil {
+				panicked = true
+			}
+		}()
+		window.AttachHasher(nil)
+		return false
+	}()
+	if !panicked {
+		t.Errorf("AttachHasher(nil) did not panic")
+	}
+	if _, err := window.WriteString("after nil"); err != nil {
+		t.Errorf("Write after AttachHasher(nil) failed unexpectedly: %v", err)
+	}
+}
+
+func TestWindow_Metrics(t *testing.T) {
+	var window Window
+	window.Init(4)
+
+	check := func(name string, expect WindowMetrics) {
+		t.Helper()
+		if actual := window.Metrics(); expect != actual {
+			t.Errorf("%s: Metrics returned wrong value:\n\texpect: %+v\n\tactual: %+v", name, expect, actual)
+		}
+	}
+
+	check("initial", WindowMetrics{})
+	_, _ = window.WriteString("abcdefghij")
+	check("partial", WindowMetrics{BytesWritten: 10, Wraps: 0, HighWater: 10})
+	_, _ = window.WriteString("0123456")
+	check("first wrap", WindowMetrics{BytesWritten: 17, Wraps: 1, HighWater: 16})
+	_, _ = window.Write(bytes.Repeat([]byte("abcd"), 10))
+	check("oversized", WindowMetrics{BytesWritten: 57, Wraps: 2, HighWater: 16})
+	for i := 0; i < 15; i++ {
+		_ = window.WriteByte('x')
+	}
+	check("WriteByte to end", WindowMetrics{BytesWritten: 72, Wraps: 3, HighWater: 16})
+	window.Clear()
+	check("Clear", WindowMetrics{BytesWritten: 72, Wraps: 0, HighWater: 0})
+	_, _ = window.WriteString("abc")
+	check("after Clear", WindowMetrics{BytesWritten: 75, Wraps: 0, HighWater: 3})
+	window.ResetMetrics()
+	check("ResetMetrics", WindowMetrics{})
+}
+
+func TestWindow_Clone(t *testing.T) {
+	var zero Window
+	if dupe := zero.Clone(); dupe.slice != nil || dupe.Size() != 0 {
+		t.Errorf("Clone of zero-value Window returned %#v", *dupe)
+	}
+
+	var window Window
+	window.Init(3)
+	_, _ = window.WriteString("abcdef")
+
+	dupe := window.Clone()
+	snapshot := window.Snapshot()
+	expect := window.Bytes()
+
+	for index := 0; index < 100; index++ {
+		_ = window.WriteByte(byte(index))
+	}
+	_, _ = window.WriteString("0123456789")
+	window.Clear()
+	_, _ = window.WriteString("xyz")
+
+	for distance := uint(1); distance <= 8; distance++ {
+		ch, err := dupe.LookupByte(distance)
+		if err != nil {
+			t.Errorf("LookupByte(%d) unexpectedly returned non-nil error: %v", distance, err)
+		}
+		if e := expect[8-distance]; ch != e {
+			t.Errorf("LookupByte(%d) on clone returned wrong byte:\n\texpect: %q\n\tactual: %q", distance, e, ch)
+		}
+	}
+
+	slice := window.slice
+	if err := window.Restore(snapshot); err != nil {
+		t.Errorf("Restore unexpectedly returned non-nil error: %v", err)
+	}
+	if &window.slice[0] != &slice[0] {
+		t.Errorf("Restore unexpectedly reallocated the Window's storage")
+	}
+	if actual := window.Bytes(); !bytes.Equal(expect, actual) {
+		t.Errorf("Restore produced wrong contents:\n\texpect: %q\n\tactual: %q", expect, actual)
+	}
+	if window.Len() != 6 {
+		t.Errorf("Len returned wrong value after Restore:\n\texpect: %d\n\tactual: %d", 6, window.Len())
+	}
+
+	var other Window
+	other.Init(5)
+	h := crc32.NewIEEE()
+	other.AttachHasher(h)
+	other.EnableRollingHash(4)
+	if err := other.Restore(snapshot); err != nil {
+		t.Errorf("Restore unexpectedly returned non-nil error: %v", err)
+	}
+	if other.NumBits() != 3 {
+		t.Errorf("NumBits returned wrong value after Restore:\n\texpect: %d\n\tactual: %d", 3, other.NumBits())
+	}
+	if actual := other.Bytes(); !bytes.Equal(expect, actual) {
+		t.Errorf("Restore produced wrong contents:\n\texpect: %q\n\tactual: %q", expect, actual)
+	}
+
+	// Resizing keeps the attached hashers and the rolling checksum.
+	_ = other.WriteByte('!')
+	if expect, actual := crc32.ChecksumIEEE([]byte("!")), h.Sum32(); expect != actual {
+		t.Errorf("Restore detached the hasher:\n\texpect: %#08x\n\tactual: %#08x", expect, actual)
+	}
+	var rolling Window
+	rolling.Init(3)
+	rolling.EnableRollingHash(4)
+	_, _ = rolling.Write(other.Bytes())
+	if expect, actual := rolling.RollingSum(), other.RollingSum(); expect != actual {
+		t.Errorf("Restore disabled the rolling checksum:\n\texpect: %#08x\n\tactual: %#08x", expect, actual)
+	}
+
+	for _, invalid := range [...]WindowSnapshot{{}, (Window{}).Snapshot()} {
+		if err := other.Restore(invalid); err != ErrCorrupt {
+			t.Errorf("Restore of invalid snapshot returned wrong error:\n\texpect: %v\n\tactual: %v", ErrCorrupt, err)
+		}
+		if other.NumBits() != 3 || other.RollingSum() != rolling.RollingSum() {
+			t.Errorf("Restore of invalid snapshot modified the Window: %#v", other)
+		}
+	}
+}
+
+func TestWindow_Restore(t *testing.T) {
+	var window Window
+	window.Init(7)
+	h := crc32.NewIEEE()
+	window.AttachHasher(h)
+
+	var stream bytes.Buffer
+	data := make([]byte, 166)
+	for index := range data {
+		data[index] = byte('a' + index%26)
+	}
+	stream.Write(data)
+
+	_, _ = window.Write(data[:100])
+	snapshot := window.Snapshot()
+	_, _ = window.Write(data[100:])
+	if err := window.Restore(snapshot); err != nil {
+		t.Errorf("Restore unexpectedly returned non-nil error: %v", err)
+	}
+
+	if expect, actual := uint64(100), window.TotalWritten(); expect != actual {
+		t.Errorf("TotalWritten returned wrong value after Restore:\n\texpect: %d\n\tactual: %d", expect, actual)
+	}
+	if expect, actual := uint64(0), window.OldestOffset(); expect != actual {
+		t.Errorf("OldestOffset returned wrong value after Restore:\n\texpect: %d\n\tactual: %d", expect, actual)
+	}
+	if ch, err := window.LookupByteAt(99); err != nil || ch != data[99] {
+		t.Errorf("LookupByteAt(99) returned wrong result after Restore:\n\texpect: %q, %v\n\tactual: %q, %v", data[99], nil, ch, err)
+	}
+	if expect, actual := (WindowMetrics{BytesWritten: 100, HighWater: 100}), window.Metrics(); expect != actual {
+		t.Errorf("Metrics returned wrong value after Restore:\n\texpect: %+v\n\tactual: %+v", expect, actual)
+	}
+	if expect, actual := crc32.ChecksumIEEE(stream.Bytes()), h.Sum32(); expect != actual {
+		t.Errorf("Restore fed bytes to the attached hasher:\n\texpect: %#08x\n\tactual: %#08x", expect, actual)
+	}
+
+	_, _ = window.WriteString("xyz")
+	stream.WriteString("xyz")
+	if expect, actual := string(data[:100])+"xyz", window.String()[128-103:]; expect != actual {
+		t.Errorf("Write after Restore recorded wrong contents:\n\texpect: %q\n\tactual: %q", expect, actual)
+	}
+	if expect, actual := crc32.ChecksumIEEE(stream.Bytes()), h.Sum32(); expect != actual {
+		t.Errorf("Write after Restore produced wrong hasher sum:\n\texpect: %#08x\n\tactual: %#08x", expect, actual)
+	}
+}
+
+func TestWindow_AbandonedBulkWrite(t *testing.T) {
+	var window Window
+	window.Init(4)
+
+	tmp := window.PrepareBulkWrite(4)
+	copy(tmp, "XXXX")
+	window.CommitBulkWrite(0)
+	if !window.IsZero() {
+		t.Errorf("IsZero returned false after abandoned bulk write")
+	}
+	if expect, actual := make([]byte, 16), window.Bytes(); !bytes.Equal(expect, actual) {
+		t.Errorf("abandoned bulk write changed contents:\n\texpect: %q\n\tactual: %q", expect, actual)
+	}
+
+	_, _ = window.WriteString("0123456789abcdef")
+	tmp = window.PrepareBulkWrite(4)
+	copy(tmp, "XXXX")
+	window.CommitBulkWrite(0)
+	if expect, actual := "0123456789abcdef", window.String(); expect != actual {
+		t.Errorf("abandoned bulk write changed contents:\n\texpect: %q\n\tactual: %q", expect, actual)
+	}
+
+	tmp = window.PrepareBulkWrite(4)
+	copy(tmp, "WXYZ")
+	window.CommitBulkWrite(2)
+	if expect, actual := "23456789abcdefWX", window.String(); expect != actual {
+		t.Errorf("partial bulk write recorded wrong contents:\n\texpect: %q\n\tactual: %q", expect, actual)
+	}
+
+	// io.Reader permits Read to scribble over all of p.
+	_, _ = window.ReadFromN(scribbleReader{}, 1)
+	if expect, actual := "3456789abcdefWX!", window.String(); expect != actual {
+		t.Errorf("ReadFromN recorded wrong contents:\n\texpect: %q\n\tactual: %q", expect, actual)
+	}
+
+	window.Clear()
+	tmp = window.PrepareBulkWrite(4)
+	copy(tmp, "XXXX")
+	window.CommitBulkWrite(0)
+	if !window.IsZero() {
+		t.Errorf("IsZero returned false after Clear and abandoned bulk write")
+	}
+	if expect, actual := make([]byte, 16), window.Bytes(); !bytes.Equal(expect, actual) {
+		t.Errorf("Clear and abandoned bulk write left wrong contents:\n\texpect: %q\n\tactual: %q", expect, actual)
+	}
+
+	// While the Window is not full, ReadFromN reads in place, so it must
+	// undo any scribbling past the bytes returned.
+	_, _ = window.ReadFromN(scribbleReader{}, 3)
+	if expect, actual := "\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00!!!", window.String(); expect != actual {
+		t.Errorf("ReadFromN recorded wrong contents:\n\texpect: %q\n\tactual: %q", expect, actual)
+	}
+	window.Clear()
+	if !window.IsZero() {
+		t.Errorf("IsZero returned false after ReadFromN and Clear")
+	}
+
+	// While the Window is not full, PrepareBulkWrite hands out the unused
+	// bytes in place, so a write that is never committed must be undone.
+	tmp = window.PrepareBulkWrite(4)
+	copy(tmp, "XXXX")
+	clone := window.Clone()
+	if expect, actual := make([]byte, 16), clone.Bytes(); !bytes.Equal(expect, actual) {
+		t.Errorf("Clone copied pending bulk write:\n\texpect: %q\n\tactual: %q", expect, actual)
+	}
+	tmp = window.PrepareBulkWrite(4)
+	copy(tmp, "XXXX")
+	frozen := window.Freeze()
+	if expect, actual := make([]byte, 16), frozen.Bytes(); !bytes.Equal(expect, actual) {
+		t.Errorf("Freeze captured pending bulk write:\n\texpect: %q\n\tactual: %q", expect, actual)
+	}
+	frozen.Release()
+	tmp = window.PrepareBulkWrite(4)
+	copy(tmp, "XXXX")
+	_ = window.WriteByte('!')
+	if expect, actual := "\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00!", window.String(); expect != actual {
+		t.Errorf("abandoned bulk write changed contents:\n\texpect: %q\n\tactual: %q", expect, actual)
+	}
+	if expect, actual := append(make([]byte, 15), '!'), window.Bytes(); !bytes.Equal(expect, actual) {
+		t.Errorf("abandoned bulk write left unused bytes:\n\texpect: %q\n\tactual: %q", expect, actual)
+	}
+}
+
+type scribbleReader struct{}
+
+func (scribbleReader) Read(p []byte) (int, error) {
+	for index := range p {
+		p[index] = '?'
+	}
+	if len(p) != 0 {
+		p[0] = '!'
+	}
+	return 1, nil
+}
+
+func TestWindow_IsZero(t *testing.T) {
+	var window Window
+	window.Init(3)
+
+	expectIsZero := func(expect bool) {
+		t.Helper()
+		actual := window.IsZero()
+		if actual != expect {
+			t.Errorf("IsZero returned wrong result for %q:\n\texpect: %t\n\tactual: %t", window.String(), expect, actual)
+		}
+		scan := bytes.Count(window.BytesView(), []byte{0}) == int(window.Size())
+		if actual != scan {
+			t.Errorf("IsZero disagrees with a full scan for %q:\n\texpect: %t\n\tactual: %t", window.String(), scan, actual)
+		}
+	}
+
+	expectIsZero(true)
+	_, _ = window.Write([]byte{0, 0, 0})
+	expectIsZero(true)
+	_ = window.WriteByte('a')
+	expectIsZero(false)
+	_, _ = window.Write([]byte{0, 0, 0, 0, 0, 0, 0})
+	expectIsZero(false)
+	_ = window.WriteByte(0)
+	expectIsZero(true)
+	_, _ = window.Write([]byte{'b', 0, 0})
+	expectIsZero(false)
+	for remaining := uint(6); remaining > 0; {
+		tmp := window.PrepareBulkWrite(remaining)
+		bzero.Uint8(tmp)
+		window.CommitBulkWrite(uint(len(tmp)))
+		remaining -= uint(len(tmp))
+	}
+	expectIsZero(true)
+	_, _ = window.WriteString("c\x00")
+	expectIsZero(false)
+	window.Clear()
+	expectIsZero(true)
+	_, _ = window.Write([]byte("0123456789\x00"))
+	expectIsZero(false)
+	_, _ = window.ReadFromN(bytes.NewReader(make([]byte, 20)), 20)
+	expectIsZero(true)
+}
+
+func TestWindow_CopyTo(t *testing.T) {
+	var window Window
+	window.Init(3)
+	_, _ = window.WriteString("abcdefgh")
+
+	type testRow struct {
+		distance uint
+		dstLen   int
+		expectN  int
+		expect   string
+		err      error
+	}
+
+	testData := [...]testRow{
+		{8, 3, 3, "abc", nil},
+		{8, 8, 8, "abcdefgh", nil},
+		{8, 10, 8, "abcdefgh", nil},
+		{3, 2, 2, "fg", nil},
+		{3, 5, 3, "fgh", nil},
+		{1, 4, 1, "h", nil},
+		{4, 0, 0, "", nil},
+		{0, 4, 0, "", ErrBadDistance},
+		{9, 4, 0, "", ErrBadDistance},
+	}
+
+	for _, row := range testData {
+		dst := bytes.Repeat([]byte{'-'}, row.dstLen)
+		nn, err := window.CopyTo(dst, row.distance)
+		if err != row.err {
+			t.Errorf("CopyTo(%d, %d) returned wrong error:\n\texpect: [%v]\n\tactual: [%v]", row.dstLen, row.distance, row.err, err)
+		}
+		if nn != row.expectN {
+			t.Errorf("CopyTo(%d, %d) unexpectedly returned nn=%d, expected %d", row.dstLen, row.distance, nn, row.expectN)
+		}
+		if actual := string(dst[:nn]); actual != row.expect {
+			t.Errorf("CopyTo(%d, %d) copied wrong bytes:\n\texpect: %q\n\tactual: %q", row.dstLen, row.distance, row.expect, actual)
+		}
+	}
+
+	dst := make([]byte, 4)
+	_, _ = window.CopyTo(dst, 4)
+	_, _ = window.WriteString("WXYZ")
+	if expect, actual := "efgh", string(dst); expect != actual {
+		t.Errorf("CopyTo result changed after a Write:\n\texpect: %q\n\tactual: %q", expect, actual)
+	}
+}
+
+func TestWindow_HexDump(t *testing.T) {
+	var window Window
+	window.Init(5)
+	_, _ = window.WriteString("Hello, world!\n\x00\x01The quick brown")
+
+	expect := strings.Join([]string{
+		"00000000  00 48 65 6c 6c 6f 2c 20  77 6f 72 6c 64 21 0a 00  |.Hello, world!..|\n",
+		"00000010  01 54 68 65 20 71 75 69  63 6b 20 62 72 6f 77 6e  |.The quick brown|\n",
+	}, "")
+	var sb strings.Builder
+	if err := window.HexDump(&sb, 0); err != nil {
+		t.Errorf("HexDump unexpectedly returned non-nil error: %v", err)
+	}
+	if actual := sb.String(); actual != expect {
+		t.Errorf("HexDump returned unexpected result.\n\tExpect: %s\n\tActual: %s", expect, actual)
+	}
+
+	_, _ = window.WriteString(" fox")
+	expect = strings.Join([]string{
+		"[... 12 bytes omitted ...]\n",
+		"0000000c  01 54 68 65 20 71 75 69  63 6b 20 62 72 6f 77 6e  |.The quick brown|\n",
+		"0000001c  20 66 6f 78                                       | fox|\n",
+	}, "")
+	sb.Reset()
+	if err := window.HexDump(&sb, 20); err != nil {
+		t.Errorf("HexDump unexpectedly returned non-nil error: %v", err)
+	}
+	if actual := sb.String(); actual != expect {
+		t.Errorf("HexDump returned unexpected result.\n\tExpect: %s\n\tActual: %s", expect, actual)
+	}
+}
+
+func TestWindow_Last(t *testing.T) {
+	var window Window
+	window.Init(4)
+
+	check := func() {
+		t.Helper()
+		all := window.Bytes()
+		for n := uint(0); n <= 20; n++ {
+			length := n
+			if length > window.Len() {
+				length = window.Len()
+			}
+			expect := all[uint(len(all))-length:]
+			if actual := window.Last(n); !bytes.Equal(expect, actual) {
+				t.Errorf("Last(%d) returned wrong bytes:\n\texpect: %q\n\tactual: %q", n, expect, actual)
+			}
+			if actual := window.LastCopy(n); !bytes.Equal(expect, actual) {
+				t.Errorf("LastCopy(%d) returned wrong bytes:\n\texpect: %q\n\tactual: %q", n, expect, actual)
+			}
+		}
+	}
+
+	check()
+	_, _ = window.WriteString("abc")
+	check()
+	_ = window.WriteByte('d')
+	check()
+	_, _ = window.WriteString("0123456789ABCDEFGHIJ")
+	check()
+	for index := 0; index < 21; index++ {
+		_ = window.WriteByte(byte('a' + index))
+		check()
+	}
+	window.Clear()
+	check()
+	_, _ = window.WriteString("xyz")
+	check()
+}
+
+func TestWindow_FindLongestMatch(t *testing.T) {
+	var window Window
+	window.Init(4)
+	_, _ = window.WriteString("abcdXabcYabcdeZ")
+
+	type testRow struct {
+		data     string
+		minLen   uint
+		maxLen   uint
+		distance uint
+		length   uint
+		ok       bool
+	}
+
+	testData := [...]testRow{
+		{"abcdef", 1, 16, 6, 5, true},
+		{"abcdef", 1, 4, 6, 4, true},
+		{"abcY", 1, 16, 10, 4, true},
+		{"abc", 1, 16, 6, 3, true},
+		{"abcdXa", 1, 16, 15, 6, true},
+		{"abcdXa", 7, 16, 0, 0, false},
+		{"Z", 1, 16, 1, 1, true},
+		{"Zabc", 2, 16, 0, 0, false},
+		{"QQQ", 1, 16, 0, 0, false},
+		{"", 1, 16, 0, 0, false},
+		{"abc", 4, 3, 0, 0, false},
+	}
+
+	for _, row := range testData {
+		distance, length, ok := window.FindLongestMatch([]byte(row.data), row.minLen, row.maxLen)
+		if distance != row.distance || length != row.length || ok != row.ok {
+			t.Errorf(
+				"FindLongestMatch(%q, %d, %d) returned unexpected data.\n\tExpect: %d, %d, %t\n\tActual: %d, %d, %t",
+				row.data, row.minLen, row.maxLen,
+				row.distance, row.length, row.ok,
+				distance, length, ok,
+			)
+		}
+	}
+
+	window.Clear()
+	_, _ = window.WriteString("ab")
+	if _, _, ok := window.FindLongestMatch([]byte{0, 0}, 1, 2); ok {
+		t.Errorf("FindLongestMatch unexpectedly matched bytes from before the last Clear")
+	}
+}
+
+func TestWindow_Compare(t *testing.T) {
+	type testRow struct {
+		Distance uint
+		Data     string
+		Length   uint
+		Err      error
+	}
+
+	var window Window
+	window.Init(4)
+	_, _ = window.WriteString("xxxxxxxxxxxx")
+	_, _ = window.WriteString("abcabcdeab")
+
+	testData := [...]testRow{
+		{0, "ab", 0, ErrBadDistance},
+		{17, "ab", 0, ErrBadDistance},
+		{10, "", 0, nil},
+		{10, "abcabd", 5, nil},
+		{10, "abcabcdeab", 10, nil},
+		{7, "abcdeabX", 7, nil},
+		{2, "ab", 2, nil},
+		{2, "ababababX", 8, nil},
+		{2, "abba", 2, nil},
+		{1, "bbbbb", 5, nil},
+		{1, "a", 0, nil},
+		{3, "eabeabeaX", 8, nil},
+		{16, "xxxxxxabcX", 9, nil},
+		{12, "xxabcabcdeabxxaY", 15, nil},
+	}
+
+	for _, row := range testData {
+		length, err := window.Compare(row.Distance, []byte(row.Data))
+		if err != row.Err {
+			t.Errorf("Compare(%d, %q) returned wrong error:\n\texpect: %v\n\tactual: %v", row.Distance, row.Data, row.Err, err)
+		}
+		if length != row.Length {
+			t.Errorf("Compare(%d, %q) returned wrong length:\n\texpect: %d\n\tactual: %d", row.Distance, row.Data, row.Length, length)
+		}
+	}
+}
+
+func TestWindow_Index(t *testing.T) {
+	var window Window
+	window.Init(4)
+	_, _ = window.WriteString("abcdefgh")
+
+	type testRow struct {
+		pattern string
+		index   int
+	}
+
+	testData := [...]testRow{
+		{"abc", 8},
+		{"gh", 14},
+		{"h", 15},
+		{"\x00\x00a", 6},
+		{"", 0},
+		{"hi", -1},
+		{"abcdefghi", -1},
+	}
+
+	for _, row := range testData {
+		if actual := window.Index([]byte(row.pattern)); actual != row.index {
+			t.Errorf("Index(%q) returned wrong offset:\n\texpect: %d\n\tactual: %d", row.pattern, row.index, actual)
+		}
+		if expect, actual := row.index >= 0, window.Contains([]byte(row.pattern)); actual != expect {
+			t.Errorf("Contains(%q) returned wrong result:\n\texpect: %t\n\tactual: %t", row.pattern, expect, actual)
+		}
+	}
+}
+
+func TestWindow_Offsets(t *testing.T) {
+	var window Window
+	window.Init(3)
+
+	var stream []byte
+	write := func(str string) {
+		_, _ = window.WriteString(str)
+		stream = append(stream, str...)
+	}
+
+	check := func() {
+		t.Helper()
+		total := uint64(len(stream))
+		if actual := window.TotalWritten(); actual != total {
+			t.Errorf("TotalWritten returned wrong value:\n\texpect: %d\n\tactual: %d", total, actual)
+		}
+		oldest := total - uint64(window.Len())
+		if actual := window.OldestOffset(); actual != oldest {
+			t.Errorf("OldestOffset returned wrong value:\n\texpect: %d\n\tactual: %d", oldest, actual)
+		}
+		for offset := uint64(0); offset < total+2; offset++ {
+			ch, err := window.LookupByteAt(offset)
+			if offset < oldest || offset >= total {
+				if err != ErrBadDistance {
+					t.Errorf("LookupByteAt(%d) returned wrong error:\n\texpect: [%v]\n\tactual: [%v]", offset, ErrBadDistance, err)
+				}
+				continue
+			}
+			if err != nil {
+				t.Errorf("LookupByteAt(%d) unexpectedly returned non-nil error: %v", offset, err)
+			}
+			if expect := stream[offset]; ch != expect {
+				t.Errorf("LookupByteAt(%d) returned wrong byte:\n\texpect: %q\n\tactual: %q", offset, expect, ch)
+			}
+		}
+	}
+
+	check()
+	write("abc")
+	check()
+	for index := 0; index < 40; index++ {
+		write(string(rune('A' + index%26)))
+		check()
+	}
+	write("0123456789abcdef0123456789")
+	check()
+	write("xyz")
+	check()
+
+	window.Clear()
+	if expect, actual := uint64(len(stream)), window.TotalWritten(); actual != expect {
+		t.Errorf("TotalWritten returned wrong value after Clear:\n\texpect: %d\n\tactual: %d", expect, actual)
+	}
+	check()
+	write("pq")
+	check()
+
+	window.ResetCounters()
+	stream = stream[uint(len(stream))-window.Len():]
+	check()
+	write("rstuvwxyz")
+	check()
+}
+
+func TestWindow_ExportDictionary(t *testing.T) {
+	var window Window
+	window.Init(16)
+
+	history := strings.Repeat("It was the best of times, it was the worst of times. ", 1000)
+	_, _ = window.WriteString(history)
+
+	dict := window.ExportDictionary(32768)
+	if len(dict) != 32768 {
+		t.Fatalf("ExportDictionary returned wrong length:\n\texpect: %d\n\tactual: %d", 32768, len(dict))
+	}
+	if expect := history[len(history)-32768:]; string(dict) != expect {
+		t.Errorf("ExportDictionary returned wrong bytes")
+	}
+
+	dst := make([]byte, 40000)
+	nn := window.ExportDictionaryTo(dst)
+	if nn != 40000 {
+		t.Errorf("ExportDictionaryTo unexpectedly returned nn=%d, expected %d", nn, 40000)
+	}
+	if expect := history[len(history)-40000:]; string(dst[:nn]) != expect {
+		t.Errorf("ExportDictionaryTo returned wrong bytes")
+	}
+
+	input := []byte("It was the age of wisdom, it was the best of times, it was the worst of times.")
+
+	var compressed bytes.Buffer
+	fw, err := flate.NewWriterDict(&compressed, flate.BestCompression, dict)
+	if err != nil {
+		t.Fatalf("flate.NewWriterDict failed unexpectedly: %v", err)
+	}
+	_, _ = fw.Write(input)
+	if err = fw.Close(); err != nil {
+		t.Fatalf("flate.Writer.Close failed unexpectedly: %v", err)
+	}
+	if compressed.Len() >= len(input)/2 {
+		t.Errorf("compressing with the exported dictionary was ineffective: %d bytes -> %d bytes", len(input), compressed.Len())
+	}
+
+	fr := flate.NewReaderDict(&compressed, dict)
+	output, err := io.ReadAll(fr)
+	if err != nil {
+		t.Fatalf("io.ReadAll failed unexpectedly: %v", err)
+	}
+	if !bytes.Equal(input, output) {
+		t.Errorf("flate round trip produced wrong bytes:\n\texpect: %q\n\tactual: %q", input, output)
+	}
+
+	var small Window
+	small.Init(16)
+	_, _ = small.WriteString("abc")
+	if actual := small.ExportDictionary(32768); string(actual) != "abc" {
+		t.Errorf("ExportDictionary returned wrong bytes:\n\texpect: %q\n\tactual: %q", "abc", actual)
+	}
+}
+
+func TestWindow_Wraparound(t *testing.T) {
+	var window Window
+	window.Init(4)
+	model := make([]byte, 16)
+
+	rng := rand.New(rand.NewSource(42))
+	for step := 0; step < 500; step++ {
+		var data []byte
+		switch rng.Intn(4) {
+		case 0:
+			ch := byte('a' + rng.Intn(26))
+			_ = window.WriteByte(ch)
+			data = []byte{ch}
+		case 1:
+			data = make([]byte, rng.Intn(24))
+			for index := range data {
+				data[index] = byte('A' + rng.Intn(26))
+			}
+			_, _ = window.Write(data)
+		case 2:
+			data = make([]byte, rng.Intn(24))
+			for index := range data {
+				data[index] = byte('0' + rng.Intn(10))
+			}
+			_, _ = window.WriteString(string(data))
+		default:
+			tmp := window.PrepareBulkWrite(uint(rng.Intn(20)))
+			for index := range tmp {
+				tmp[index] = byte('k' + rng.Intn(10))
+			}
+			window.CommitBulkWrite(uint(len(tmp)))
+			data = tmp
+		}
+		model = append(model, data...)
+		model = model[len(model)-16:]
+
+		if actual := window.Bytes(); !bytes.Equal(model, actual) {
+			t.Fatalf("step %d: Bytes returned wrong contents:\n\texpect: %q\n\tactual: %q", step, model, actual)
+		}
+		if actual := window.BytesView(); !bytes.Equal(model, actual) {
+			t.Fatalf("step %d: BytesView returned wrong contents:\n\texpect: %q\n\tactual: %q", step, model, actual)
+		}
+		a, b := window.BytesViews()
+		if actual := append(append([]byte(nil), a...), b...); !bytes.Equal(model, actual) {
+			t.Fatalf("step %d: BytesViews returned wrong contents:\n\texpect: %q\n\tactual: %q", step, model, actual)
+		}
+
+		distance := uint(1 + rng.Intn(16))
+		length := uint(rng.Intn(20))
+		expect := model[16-distance:]
+		if length < distance {
+			expect = expect[:length]
+		}
+		slice, _ := window.LookupSlice(distance, length)
+		if !bytes.Equal(expect, slice) {
+			t.Fatalf("step %d: LookupSlice(%d, %d) returned wrong bytes:\n\texpect: %q\n\tactual: %q", step, distance, length, expect, slice)
+		}
+		a, b, _ = window.LookupSlices(distance, length)
+		if actual := append(append([]byte(nil), a...), b...); !bytes.Equal(expect, actual) {
+			t.Fatalf("step %d: LookupSlices(%d, %d) returned wrong bytes:\n\texpect: %q\n\tactual: %q", step, distance, length, expect, actual)
+		}
+
+		start := rng.Intn(16)
+		pattern := model[start : start+rng.Intn(17-start)]
+		if expect, actual := bytes.Index(model, pattern), window.Index(pattern); expect != actual {
+			t.Fatalf("step %d: Index(%q) returned wrong offset:\n\texpect: %d\n\tactual: %d", step, pattern, expect, actual)
+		}
+	}
+}
+
+func TestWindow_Index_Seam(t *testing.T) {
+	var window Window
+	window.Init(3)
+	_, _ = window.WriteString("abcd")
+	_, _ = window.WriteString("efghijkl")
+
+	a, b := window.BytesViews()
+	if string(a) != "efgh" || string(b) != "ijkl" {
+		t.Fatalf("BytesViews returned unexpected regions: %q, %q", a, b)
+	}
+
+	type testRow struct {
+		pattern string
+		index   int
+	}
+
+	testData := [...]testRow{
+		{"hi", 3},
+		{"fghijk", 1},
+		{"efghijkl", 0},
+		{"ijkl", 4},
+		{"hij", 3},
+		{"ghx", -1},
+	}
+
+	for _, row := range testData {
+		if actual := window.Index([]byte(row.pattern)); actual != row.index {
+			t.Errorf("Index(%q) returned wrong offset:\n\texpect: %d\n\tactual: %d", row.pattern, row.index, actual)
+		}
+	}
+}
+
+func TestWindow_Gob(t *testing.T) {
+	type state struct {
+		Name   string
+		Window Window
+		Count  int
+	}
+
+	var input state
+	input.Name = "example"
+	input.Count = 42
+	input.Window.Init(4)
+	_, _ = input.Window.WriteString("The quick brown fox")
+	_, _ = input.Window.WriteString("!!")
+
+	var bb bytes.Buffer
+	if err := gob.NewEncoder(&bb).Encode(input); err != nil {
+		t.Fatalf("gob.Encoder.Encode failed unexpectedly: %v", err)
+	}
+
+	var output state
+	if err := gob.NewDecoder(&bb).Decode(&output); err != nil {
+		t.Fatalf("gob.Decoder.Decode failed unexpectedly: %v", err)
+	}
+
+	if output.Name != input.Name || output.Count != input.Count {
+		t.Errorf("gob round trip lost neighboring fields:\n\texpect: %q, %d\n\tactual: %q, %d", input.Name, input.Count, output.Name, output.Count)
+	}
+	if expect, actual := input.Window.NumBits(), output.Window.NumBits(); expect != actual {
+		t.Errorf("gob round trip produced wrong NumBits:\n\texpect: %d\n\tactual: %d", expect, actual)
+	}
+	if expect, actual := input.Window.Bytes(), output.Window.Bytes(); !bytes.Equal(expect, actual) {
+		t.Errorf("gob round trip produced wrong contents:\n\texpect: %q\n\tactual: %q", expect, actual)
+	}
+	if expect, actual := input.Window.Len(), output.Window.Len(); expect != actual {
+		t.Errorf("gob round trip produced wrong Len:\n\texpect: %d\n\tactual: %d", expect, actual)
+	}
+	if expect, actual := input.Window.TotalWritten(), output.Window.TotalWritten(); expect != actual {
+		t.Errorf("gob round trip produced wrong TotalWritten:\n\texpect: %d\n\tactual: %d", expect, actual)
+	}
+	if expect, actual := input.Window.Metrics(), output.Window.Metrics(); expect != actual {
+		t.Errorf("gob round trip produced wrong Metrics:\n\texpect: %+v\n\tactual: %+v", expect, actual)
+	}
+	if expect, actual := input.Window.IsZero(), output.Window.IsZero(); expect != actual {
+		t.Errorf("gob round trip produced wrong IsZero:\n\texpect: %t\n\tactual: %t", expect, actual)
+	}
+
+	// Writing after the round trip continues from the same position.
+	_, _ = input.Window.WriteString("xyz")
+	_, _ = output.Window.WriteString("xyz")
+	if expect, actual := input.Window.String(), output.Window.String(); expect != actual {
+		t.Errorf("Write after gob round trip recorded wrong contents:\n\texpect: %q\n\tactual: %q", expect, actual)
+	}
+	if expect, actual := input.Window.Metrics(), output.Window.Metrics(); expect != actual {
+		t.Errorf("Write after gob round trip produced wrong Metrics:\n\texpect: %+v\n\tactual: %+v", expect, actual)
+	}
+}
+
+func TestWindow_UnmarshalBinary(t *testing.T) {
+	var window Window
+	window.Init(2)
+	_, _ = window.WriteString("ab")
+
+	good, err := window.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary failed unexpectedly: %v", err)
+	}
+	if expect := []byte{1, 2, 2, 2, 2, 0, 2, 'a', 'b'}; !bytes.Equal(expect, good) {
+		t.Errorf("MarshalBinary returned wrong data:\n\texpect: %#v\n\tactual: %#v", expect, good)
+	}
+
+	testData := [...][]byte{
+		nil,
+		{1},
+		{2, 2, 2, 2, 2, 0, 2, 'a', 'b'},
+		{1, 32, 0, 0, 0, 0, 0},
+		{1, 2, 5, 5, 5, 0, 4, 'a', 'b', 'c', 'd', 'e'},
+		{1, 2, 2, 1, 2, 0, 2, 'a', 'b'},
+		{1, 2, 2, 2, 2, 0, 5, 'a', 'b'},
+		{1, 2, 2, 2, 2, 0, 2, 'a'},
+		{1, 2, 2, 2, 2, 0, 2, 'a', 'b', 'c'},
+		{1, 2, 2, 2, 2},
+		{1, 2, 0x80},
+	}
+
+	for _, data := range testData {
+		other := window.Clone()
+		if err := other.UnmarshalBinary(data); err != ErrCorrupt {
+			t.Errorf("UnmarshalBinary(%#v) returned wrong error:\n\texpect: [%v]\n\tactual: [%v]", data, ErrCorrupt, err)
+		}
+		if expect, actual := window.String(), other.String(); expect != actual {
+			t.Errorf("UnmarshalBinary(%#v) modified the Window on failure", data)
+		}
+	}
+
+	for _, contents := range []string{"", "hello"} {
+		big := NewWindow(20)
+		_, _ = big.WriteString(contents)
+		data, _ := big.MarshalBinary()
+
+		other := window.Clone()
+		err := other.UnmarshalBinaryLimit(data, 16)
+		if expect := (NumBitsError{NumBits: 20, Max: 16}); err != expect {
+			t.Errorf("UnmarshalBinaryLimit of a 2**20 byte Window returned wrong error:\n\texpect: [%v]\n\tactual: [%v]", expect, err)
+		}
+		if expect, actual := window.String(), other.String(); expect != actual {
+			t.Errorf("UnmarshalBinaryLimit modified the Window on failure")
+		}
+
+		if err := other.UnmarshalBinary(data); err != nil {
+			t.Errorf("UnmarshalBinary of a 2**20 byte Window holding %q failed unexpectedly: %v", contents, err)
+		}
+		if other.NumBits() != 20 || other.Len() != uint(len(contents)) || !bytes.Equal(big.Bytes(), other.Bytes()) {
+			t.Errorf("UnmarshalBinary of a 2**20 byte Window holding %q produced wrong state", contents)
+		}
+	}
+}
+
+func TestWindow_RollingSum(t *testing.T) {
+	bruteForce := func(data []byte) uint32 {
+		var a, b uint32
+		k := uint32(len(data))
+		for index, ch := range data {
+			a += uint32(ch)
+			b += (k - uint32(index)) * uint32(ch)
+		}
+		return (a & 0xffff) | (b << 16)
+	}
+
+	rng := rand.New(rand.NewSource(7))
+	for _, k := range []uint{1, 5, 16, 32} {
+		var window Window
+		window.Init(5)
+		_, _ = window.WriteString("prefix data")
+		window.EnableRollingHash(k)
+
+		for step := 0; step < 300; step++ {
+			switch rng.Intn(3) {
+			case 0:
+				_ = window.WriteByte(byte(rng.Intn(256)))
+			case 1:
+				data := make([]byte, rng.Intn(40))
+				_, _ = rng.Read(data)
+				_, _ = window.Write(data)
+			default:
+				tmp := window.PrepareBulkWrite(uint(rng.Intn(8)))
+				_, _ = rng.Read(tmp)
+				window.CommitBulkWrite(uint(len(tmp)))
+			}
+			if step == 150 {
+				window.Clear()
+			}
+
+			all := window.Bytes()
+			expect := bruteForce(all[uint(len(all))-k:])
+			if actual := window.RollingSum(); actual != expect {
+				t.Fatalf("k=%d, step %d: RollingSum returned wrong value:\n\texpect: %#08x\n\tactual: %#08x", k, step, expect, actual)
+			}
+		}
+	}
+}
+
+func TestWindow_InitWithSlice(t *testing.T) {
+	arena := bytes.Repeat([]byte{0xaa}, 64)
+	backing := arena[16:32]
+
+	var window Window
+	allocs := testing.AllocsPerRun(10, func() {
+		window.InitWithSlice(backing)
+	})
+	if allocs != 0 {
+		t.Errorf("InitWithSlice unexpectedly allocated: %f allocs per run", allocs)
+	}
+	if window.NumBits() != 4 || window.Size() != 16 {
+		t.Errorf("InitWithSlice produced wrong size:\n\texpect: %d, %d\n\tactual: %d, %d", 4, 16, window.NumBits(), window.Size())
+	}
+	if !window.IsZero() {
+		t.Errorf("IsZero returned false after InitWithSlice")
+	}
+
+	_, _ = window.WriteString("The quick brown fox jumps over the lazy dog.")
+	_ = window.WriteByte('!')
+	window.Clear()
+	_, _ = window.WriteString("0123456789abcdefgh")
+
+	if expect, actual := "23456789abcdefgh", window.String(); expect != actual {
+		t.Errorf("InitWithSlice Window recorded wrong contents:\n\texpect: %q\n\tactual: %q", expect, actual)
+	}
+	if expect, actual := "23456789abcdefgh", string(backing); expect != actual {
+		t.Errorf("InitWithSlice Window did not write into the provided slice:\n\texpect: %q\n\tactual: %q", expect, actual)
+	}
+	for index, ch := range arena {
+		if (index < 16 || index >= 32) && ch != 0xaa {
+			t.Errorf("InitWithSlice Window wrote outside of the provided slice at arena index %d", index)
+			break
+		}
+	}
+}
+
+func TestWindow_AppendBytes(t *testing.T) {
+	var window Window
+	window.Init(4)
+	_, _ = window.WriteString("abcdefgh")
+	_, _ = window.WriteString("0123456789abcdef")
+	_, _ = window.WriteString("XYZ")
+
+	expect := append([]byte("prefix:"), window.Bytes()...)
+	if actual := window.AppendBytes([]byte("prefix:")); !bytes.Equal(expect, actual) {
+		t.Errorf("AppendBytes returned wrong data:\n\texpect: %q\n\tactual: %q", expect, actual)
+	}
+
+	dst := make([]byte, 0, 64)
+	allocs := testing.AllocsPerRun(10, func() {
+		dst = window.AppendBytes(dst[:0])
+	})
+	if allocs != 0 {
+		t.Errorf("AppendBytes unexpectedly allocated: %f allocs per run", allocs)
+	}
+	if expect := window.Bytes(); !bytes.Equal(expect, dst) {
+		t.Errorf("AppendBytes returned wrong data:\n\texpect: %q\n\tactual: %q", expect, dst)
+	}
+}
+
+func TestWindow_WriteByteRun(t *testing.T) {
+	type testRow struct {
+		Prefix string
+		Ch     byte
+		N      uint
+	}
+
+	testData := [...]testRow{
+		{"", 'a', 0},
+		{"", 'a', 1},
+		{"xyz", 'a', 5},
+		{"0123456789abc", 'b', 7},
+		{"0123456789abc", 'c', 16},
+		{"0123456789abc", 'd', 100},
+		{"", 0, 17},
+	}
+
+	for _, row := range testData {
+		var expect, actual Window
+		expect.Init(4)
+		actual.Init(4)
+		_, _ = expect.WriteString(row.Prefix)
+		_, _ = actual.WriteString(row.Prefix)
+		for i := uint(0); i < row.N; i++ {
+			_ = expect.WriteByte(row.Ch)
+		}
+
+		n, err := actual.WriteByteRun(row.Ch, row.N)
+		if err != nil {
+			t.Errorf("WriteByteRun(%q, %d) returned unexpected error: %v", row.Ch, row.N, err)
+		}
+		if uint(n) != row.N {
+			t.Errorf("WriteByteRun(%q, %d) returned wrong count:\n\texpect: %d\n\tactual: %d", row.Ch, row.N, row.N, n)
+		}
+		if e, a := expect.Bytes(), actual.Bytes(); !bytes.Equal(e, a) {
+			t.Errorf("WriteByteRun(%q, %d) after %q produced wrong data:\n\texpect: %q\n\tactual: %q", row.Ch, row.N, row.Prefix, e, a)
+		}
+		if e, a := expect.TotalWritten(), actual.TotalWritten(); e != a {
+			t.Errorf("WriteByteRun(%q, %d) after %q produced wrong TotalWritten:\n\texpect: %d\n\tactual: %d", row.Ch, row.N, row.Prefix, e, a)
+		}
+		if e, a := expect.IsZero(), actual.IsZero(); e != a {
+			t.Errorf("WriteByteRun(%q, %d) after %q produced wrong IsZero:\n\texpect: %v\n\tactual: %v", row.Ch, row.N, row.Prefix, e, a)
+		}
+	}
+}
+
+func TestWindow_Freeze(t *testing.T) {
+	var window Window
+	window.Init(4)
+	_, _ = window.WriteString("0123456789")
+
+	expect := window.Bytes()
+	frozen := window.Freeze()
+
+	_, _ = window.WriteString("abcdefghij")
+	_ = window.WriteByte('X')
+	_, _ = window.WriteByteRun('Y', 3)
+	window.Clear()
+	_, _ = window.WriteString("ZZZZZZZZZZZZZZZZ")
+	window.SecureClear()
+
+	if actual := frozen.Bytes(); !bytes.Equal(expect, actual) {
+		t.Errorf("FrozenWindow.Bytes returned wrong data:\n\texpect: %q\n\tactual: %q", expect, actual)
+	}
+	if ch, err := frozen.LookupByte(1); err != nil || ch != '9' {
+		t.Errorf("FrozenWindow.LookupByte(1) returned wrong result:\n\texpect: %q, %v\n\tactual: %q, %v", '9', error(nil), ch, err)
+	}
+	if actual := window.Len(); actual != 0 {
+		t.Errorf("Len returned wrong value after SecureClear:\n\texpect: %d\n\tactual: %d", 0, actual)
+	}
+	frozen.Release()
+}
+
+func TestWindow_Freeze_Release(t *testing.T) {
+	var window Window
+	window.Init(4)
+	_, _ = window.WriteString("0123456789")
+	before := &window.slice[0]
+
+	a := window.Freeze()
+	b := window.Freeze()
+	a.Release()
+	b.Release()
+
+	_, _ = window.WriteString("abc")
+	if after := &window.slice[0]; after != before {
+		t.Errorf("Window copied its storage even though all FrozenWindows were released")
+	}
+
+	expectFrozen := window.Bytes()
+	c := window.Freeze()
+	_ = window.WriteByte('d')
+	if after := &window.slice[0]; after == before {
+		t.Errorf("Window did not copy its storage while a FrozenWindow was live")
+	}
+	if expect, actual := expectFrozen, c.Bytes(); !bytes.Equal(expect, actual) {
+		t.Errorf("FrozenWindow.Bytes returned wrong data:\n\texpect: %q\n\tactual: %q", expect, actual)
+	}
+	if expect, actual := append(expectFrozen[1:], 'd'), window.Bytes(); !bytes.Equal(expect, actual) {
+		t.Errorf("Bytes returned wrong data:\n\texpect: %q\n\tactual: %q", expect, actual)
+	}
+	c.Release()
+}
+
 func BenchmarkWindow_WriteByte_1(b *testing.B) {
 	var window Window
 	window.Init(1)
@@ -27,3 +1390,188 @@ func BenchmarkWindow_WriteByte_15(b *testing.B) {
 		_ = window.WriteByte('a')
 	}
 }
+
+var benchmarkWindowString = strings.Repeat("The quick brown fox jumps over the lazy dog. ", 16)
+
+var benchmarkWindowWriter io.Writer
+
+func BenchmarkWindow_Write_String_15(b *testing.B) {
+	benchmarkWindowWriter = NewWindow(15)
+	w := benchmarkWindowWriter
+	str := benchmarkWindowString
+	b.ReportAllocs()
+	b.SetBytes(int64(len(str)))
+	for n := 0; n < b.N; n++ {
+		_, _ = w.Write([]byte(str))
+	}
+}
+
+func BenchmarkWindow_WriteString_15(b *testing.B) {
+	benchmarkWindowWriter = NewWindow(15)
+	w := benchmarkWindowWriter
+	str := benchmarkWindowString
+	b.ReportAllocs()
+	b.SetBytes(int64(len(str)))
+	for n := 0; n < b.N; n++ {
+		_, _ = io.WriteString(w, str)
+	}
+}
+
+func BenchmarkWindow_Write_15(b *testing.B) {
+	var window Window
+	window.Init(15)
+	data := bytes.Repeat([]byte("abcdefgh"), 128)
+	b.SetBytes(int64(len(data)))
+	for n := 0; n < b.N; n++ {
+		_, _ = window.Write(data)
+	}
+}
+
+func BenchmarkWindow_Write_22(b *testing.B) {
+	var window Window
+	window.Init(22)
+	data := bytes.Repeat([]byte("abcdefgh"), 128)
+	b.SetBytes(int64(len(data)))
+	for n := 0; n < b.N; n++ {
+		_, _ = window.Write(data)
+	}
+}
+
+func BenchmarkWindow_ReadFrom_Direct_20(b *testing.B) {
+	benchmarkWindowReadFrom(b, false)
+}
+
+func BenchmarkWindow_ReadFrom_Staged_20(b *testing.B) {
+	benchmarkWindowReadFrom(b, true)
+}
+
+// benchmarkWindowReadFrom reads half a Window's worth of data per iteration,
+// either into an empty Window, which reads in place, or into a full one,
+// which stages the data.
+func benchmarkWindowReadFrom(b *testing.B, full bool) {
+	var window Window
+	window.Init(20)
+	data := bytes.Repeat([]byte("abcdefgh"), 1<<16)
+	r := bytes.NewReader(data)
+	if full {
+		_, _ = window.WriteByteRun('x', 1<<20)
+	}
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if !full {
+			b.StopTimer()
+			window.Clear()
+			b.StartTimer()
+		}
+		r.Reset(data)
+		_, _ = window.ReadFrom(r)
+	}
+}
+
+func BenchmarkWindow_BulkWrite_Direct_20(b *testing.B) {
+	benchmarkWindowBulkWrite(b, false)
+}
+
+func BenchmarkWindow_BulkWrite_Staged_20(b *testing.B) {
+	benchmarkWindowBulkWrite(b, true)
+}
+
+// benchmarkWindowBulkWrite writes half a Window's worth of data per iteration
+// through PrepareBulkWrite, either into an empty Window, which writes in
+// place, or into a full one, which stages the data.
+func benchmarkWindowBulkWrite(b *testing.B, full bool) {
+	var window Window
+	window.Init(20)
+	data := bytes.Repeat([]byte("abcdefgh"), 1<<16)
+	if full {
+		_, _ = window.WriteByteRun('x', 1<<20)
+	}
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if !full {
+			b.StopTimer()
+			window.Clear()
+			b.StartTimer()
+		}
+		remaining := data
+		for len(remaining) != 0 {
+			tmp := window.PrepareBulkWrite(uint(len(remaining)))
+			nn := copy(tmp, remaining)
+			window.CommitBulkWrite(uint(nn))
+			remaining = remaining[nn:]
+		}
+	}
+}
+
+func BenchmarkWindow_WriteByteLoop_1KiB(b *testing.B) {
+	benchmarkWindowWriteByteLoop(b, 1<<10)
+}
+
+func BenchmarkWindow_WriteByteLoop_1MiB(b *testing.B) {
+	benchmarkWindowWriteByteLoop(b, 1<<20)
+}
+
+func BenchmarkWindow_WriteByteRun_1KiB(b *testing.B) {
+	benchmarkWindowWriteByteRun(b, 1<<10)
+}
+
+func BenchmarkWindow_WriteByteRun_1MiB(b *testing.B) {
+	benchmarkWindowWriteByteRun(b, 1<<20)
+}
+
+func benchmarkWindowWriteByteLoop(b *testing.B, n uint) {
+	var window Window
+	window.Init(22)
+	b.SetBytes(int64(n))
+	for i := 0; i < b.N; i++ {
+		for j := uint(0); j < n; j++ {
+			_ = window.WriteByte('a')
+		}
+	}
+}
+
+func benchmarkWindowWriteByteRun(b *testing.B, n uint) {
+	var window Window
+	window.Init(22)
+	b.SetBytes(int64(n))
+	for i := 0; i < b.N; i++ {
+		_, _ = window.WriteByteRun('a', n)
+	}
+}
+
+func BenchmarkWindow_IsZero_20(b *testing.B) {
+	var window Window
+	window.Init(20)
+	_ = window.WriteByte('a')
+	_, _ = window.Write(make([]byte, 1<<19))
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if window.IsZero() {
+			b.Fatal("IsZero returned true")
+		}
+	}
+}
+
+func BenchmarkWindow_Clear_26(b *testing.B) {
+	var window Window
+	window.Init(26)
+	data := bytes.Repeat([]byte("a"), 4096)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		_, _ = window.Write(data)
+		window.Clear()
+	}
+}
+
+func BenchmarkWindow_SecureClear_26(b *testing.B) {
+	var window Window
+	window.Init(26)
+	data := bytes.Repeat([]byte("a"), 4096)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		_, _ = window.Write(data)
+		window.SecureClear()
+	}
+}